@@ -4,25 +4,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
 	ce "github.com/cloudevents/sdk-go/v2"
-	"github.com/cloudevents/sdk-go/v2/protocol"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vapi/tags"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"go.temporal.io/sdk/activity"
 	"go.temporal.io/sdk/temporal"
 )
 
+// DefaultAnnotationKey is the name of the custom field holding the annotation
+// of a VM if the worker does not configure a key
+const DefaultAnnotationKey = "com.vmware.workflows.vsphere.preemption"
+
 const (
-	eventType              = "com.vmware.workflows.vsphere.VmPreemptedEvent.v0" // returned event if requested
-	customField            = "com.vmware.workflows.vsphere.preemption"          // custom field info in vm
+	eventType              = "com.vmware.workflows.vsphere.VmPreemptedEvent.v0"                   // returned event if requested
+	approvalEventType      = "com.vmware.workflows.vsphere.VmPreemptionApprovalRequestedEvent.v0" // sent when approval is required
+	failedEventType        = "com.vmware.workflows.vsphere.PreemptionFailedEvent.v0"              // sent when a run failed
 	heartBeatInterval      = time.Second * 2
 	maxPreemptVms          = 10 // never preempt more vms
 	concurrentVCenterCalls = 5
@@ -43,22 +48,75 @@ type EnvConfig struct {
 	VCAddress  string `envconfig:"VCENTER_URL" required:"true"`
 	SecretPath string `envconfig:"VCENTER_SECRET_PATH" default:""`
 
+	// Preemption settings
+	VetoHook string `envconfig:"VETO_HOOK_URL" default:""` // always called, workflow requests can only add a hook
+
+	// Annotation settings
+	AnnotationKey    string   `envconfig:"ANNOTATION_KEY" default:""`    // custom field holding the annotation, defaults to DefaultAnnotationKey
+	AnnotationFields []string `envconfig:"ANNOTATION_FIELDS" default:""` // record fields kept in the annotation, all fields if empty
+
+	// Drain settings
+	DrainCommands map[string]string `envconfig:"DRAIN_COMMANDS" default:""` // guest command per name, e.g. drain:/opt/app/drain.sh --graceful, drain is rejected if empty
+
+	// Sink settings
+	SinkSecretDir   string            `envconfig:"SINK_SECRET_DIR" default:""`   // directory of the secrets referenced by sinks, sink secrets are rejected if empty
+	SinkSecretHosts map[string]string `envconfig:"SINK_SECRET_HOSTS" default:""` // sink host per secret name, e.g. token:broker.local, unbound secrets are rejected for sinks with a host
+	FileSinkDir     string            `envconfig:"FILE_SINK_DIR" default:""`     // directory of file sinks, file sinks are rejected if empty
+
 	Debug bool `envconfig:"DEBUG" default:"false"`
 }
 
 type eventResponseData struct {
-	annotationData
+	AnnotationRecord
 	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"`
+	Migrated        []Migration                    `json:"migrated,omitempty"` // VMs migrated instead of preempted
+	Drain           []DrainResult                  `json:"drain,omitempty"`    // guest drain result per VM
+}
+
+type approvalRequestData struct {
+	Tag             string                         `json:"tag"`
+	Criticality     Criticality                    `json:"criticality"`
+	WorkflowID      string                         `json:"workflowID"`
+	RunID           string                         `json:"workflowRunID"`
+	RequestedBy     string                         `json:"requestedBy,omitempty"`
+	Timeout         string                         `json:"timeout"`
+	DefaultDecision Decision                       `json:"defaultDecision"` // applied on timeout
+	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"` // preemption candidates
+	Event           ce.Event                       `json:"event"`           // event that triggered preemption
+}
+
+type failedEventData struct {
+	Tag         string      `json:"tag"`
+	Criticality Criticality `json:"criticality"`
+	WorkflowID  string      `json:"workflowID"`
+	RunID       string      `json:"workflowRunID"`
+	Error       RunError    `json:"error"`
+	Event       ce.Event    `json:"event"` // event that triggered preemption
+}
+
+// candidateQuery selects the preemptible VMs
+type candidateQuery struct {
+	Scope
+	Host      string `json:"host,omitempty"`      // only VMs running on this host if set
+	Datastore string `json:"datastore,omitempty"` // only VMs with files on this datastore if set
 }
 
-type annotationData struct {
-	Preempted       bool        `json:"preempted"`
-	Tag             string      `json:"tag"`
-	ForcedShutdown  bool        `json:"forcedShutdown" `
-	Criticality     Criticality `json:"criticality"`
-	WorkflowID      string      `json:"workflowID"`
-	WorkflowStarted time.Time   `json:"workflowStarted"`
-	Event           ce.Event    `json:"event"` // event that triggered preemption
+// UnmarshalJSON also accepts a plain tag as used by activities scheduled by
+// earlier releases
+func (q *candidateQuery) UnmarshalJSON(b []byte) error {
+	var tag string
+	if err := json.Unmarshal(b, &tag); err == nil {
+		*q = candidateQuery{Scope: Scope{Tag: tag}}
+		return nil
+	}
+
+	type query candidateQuery // avoid recursion
+	var cq query
+	if err := json.Unmarshal(b, &cq); err != nil {
+		return err
+	}
+	*q = candidateQuery(cq)
+	return nil
 }
 
 type Client struct {
@@ -66,9 +124,30 @@ type Client struct {
 	tagManager *tags.Manager
 	ceclient   ce.Client
 	clock      clock.Clock
+
+	annotationKey    string   // defaults to DefaultAnnotationKey
+	annotationFields []string // all fields if empty
+
+	drainCommands map[string]string // guest drain command per name
+
+	secretDir   string            // sink secrets, disabled if empty
+	secretHosts map[string]string // sink host per secret name
+	fileSinkDir string            // file sinks, disabled if empty
+
+	tlsMu      sync.Mutex
+	tlsClients map[tlsClientKey]cachedTLSClient // cloudevents clients of HTTP sinks with TLS settings
 }
 
 func NewClient(ctx context.Context) (*Client, error) {
+	var env EnvConfig
+	if err := envconfig.Process("", &env); err != nil {
+		return nil, err
+	}
+
+	if err := validateAnnotationFields(env.AnnotationFields); err != nil {
+		return nil, fmt.Errorf("validate annotation fields: %w", err)
+	}
+
 	vclient, err := newSOAPClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("create vsphere SOAP client: %w", err)
@@ -95,12 +174,29 @@ func NewClient(ctx context.Context) (*Client, error) {
 		tagManager: tm,
 		ceclient:   ceclient,
 		clock:      clock.New(),
+
+		annotationKey:    env.AnnotationKey,
+		annotationFields: env.AnnotationFields,
+
+		drainCommands: env.DrainCommands,
+
+		secretDir:   env.SinkSecretDir,
+		secretHosts: env.SinkSecretHosts,
+		fileSinkDir: env.FileSinkDir,
 	}
 
 	return &client, nil
 }
 
-func (c *Client) GetPreemptibleVMs(ctx context.Context, tag string) ([]types.ManagedObjectReference, error) {
+// customField returns the name of the custom field holding the annotation
+func (c *Client) customField() string {
+	if c.annotationKey == "" {
+		return DefaultAnnotationKey
+	}
+	return c.annotationKey
+}
+
+func (c *Client) GetPreemptibleVMs(ctx context.Context, query candidateQuery) ([]types.ManagedObjectReference, error) {
 	logger := activity.GetLogger(ctx)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -108,32 +204,99 @@ func (c *Client) GetPreemptibleVMs(ctx context.Context, tag string) ([]types.Man
 	// send heartbeats
 	go heartbeat(ctx)
 
-	logger.Debug("searching for preemptible vms", "maxPreemptVMs", maxPreemptVms)
-	tagRefs, err := c.tagManager.ListAttachedObjects(ctx, tag)
+	logger.Debug("searching for preemptible vms", "maxPreemptVMs", maxPreemptVms, "cluster", query.Cluster, "host", query.Host, "datastore", query.Datastore)
+	candidates, err := c.findCandidates(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err = c.filterPoweredOn(ctx, candidates)
 	if err != nil {
-		return nil, fmt.Errorf("get tag %q: %w", tag, err)
+		return nil, err
 	}
+	logger.Debug("powered on preemptible vms", "vms", candidates)
 
 	refs := make([]types.ManagedObjectReference, 0, maxPreemptVms)
-	logger.Debug("tag to vm mapping", "tag", tag, "vms", tagRefs)
-	for i, ref := range tagRefs {
+	for i, ref := range candidates {
 		if i == maxPreemptVms {
 			logger.Debug("maximum search count for preemptible vms reached", "maxPreemptVMs", maxPreemptVms)
 			break
 		}
-		refs = append(refs, ref.Reference())
+		refs = append(refs, ref)
 	}
 
 	return refs, nil
 }
 
+// findCandidates returns all tagged VMs matching the given query
+func (c *Client) findCandidates(ctx context.Context, query candidateQuery) ([]types.ManagedObjectReference, error) {
+	logger := activity.GetLogger(ctx)
+
+	if query.VCenter != "" {
+		if err := checkVCenter(query.VCenter); err != nil {
+			return nil, err
+		}
+	}
+
+	tag := query.Tag
+	tagRefs, err := c.tagManager.ListAttachedObjects(ctx, tag)
+	if err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("get tag %q", tag), errVSphere, err)
+	}
+
+	candidates := make([]types.ManagedObjectReference, 0, len(tagRefs))
+	for _, ref := range tagRefs {
+		candidates = append(candidates, ref.Reference())
+	}
+	logger.Debug("tag to vm mapping", "tag", tag, "vms", candidates)
+
+	if query.Cluster != "" {
+		candidates, err = c.filterCluster(ctx, query.Cluster, candidates)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("cluster to vm mapping", "cluster", query.Cluster, "vms", candidates)
+	}
+
+	if query.Host != "" {
+		candidates, err = c.filterHost(ctx, query.Host, candidates)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("host to vm mapping", "host", query.Host, "vms", candidates)
+	}
+
+	if query.Datastore != "" {
+		candidates, err = c.filterDatastore(ctx, query.Datastore, candidates)
+		if err != nil {
+			return nil, err
+		}
+		logger.Debug("datastore to vm mapping", "datastore", query.Datastore, "vms", candidates)
+	}
+
+	return candidates, nil
+}
+
 func (c *Client) PowerOffVMs(ctx context.Context, refs []types.ManagedObjectReference, force bool) ([]types.ManagedObjectReference, error) {
+	return c.forEachVM(ctx, refs, func(ctx context.Context, ref types.ManagedObjectReference) bool {
+		return c.powerOffVm(ctx, ref, force)
+	})
+}
+
+// SuspendVMs suspends the given VMs and returns the suspended VMs
+func (c *Client) SuspendVMs(ctx context.Context, refs []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	return c.forEachVM(ctx, refs, c.suspendVm)
+}
+
+// forEachVM concurrently calls fn for the given VMs and returns the VMs for
+// which fn returned true
+func (c *Client) forEachVM(ctx context.Context, refs []types.ManagedObjectReference, fn func(ctx context.Context, ref types.ManagedObjectReference) bool) ([]types.ManagedObjectReference, error) {
 	logger := activity.GetLogger(ctx)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	if len(refs) == 0 {
-		logger.Debug("empty list of preemptible virtual machines")
+		logger.Debug("empty list of virtual machines")
 		return nil, nil
 	}
 
@@ -141,18 +304,27 @@ func (c *Client) PowerOffVMs(ctx context.Context, refs []types.ManagedObjectRefe
 	go heartbeat(ctx)
 
 	var (
-		wg         sync.WaitGroup
-		poweredOff []types.ManagedObjectReference
+		wg   sync.WaitGroup
+		done []types.ManagedObjectReference
 	)
 
 	refCh := make(chan types.ManagedObjectReference, len(refs))
 	lim := newLimiter(concurrentVCenterCalls) // limit concurrent vc calls
 
-	logger.Debug("powering off vms", "refs", refs)
+	logger.Debug("processing vms", "refs", refs)
 	for _, ref := range refs {
 		lim.acquire()
 		wg.Add(1)
-		go c.powerOffVm(ctx, ref, refCh, lim, &wg, force)
+		go func(ref types.ManagedObjectReference) {
+			defer func() {
+				lim.release()
+				wg.Done()
+			}()
+
+			if fn(ctx, ref) {
+				refCh <- ref
+			}
+		}(ref)
 	}
 
 	go func() {
@@ -162,18 +334,13 @@ func (c *Client) PowerOffVMs(ctx context.Context, refs []types.ManagedObjectRefe
 	}()
 
 	for ref := range refCh {
-		poweredOff = append(poweredOff, ref)
+		done = append(done, ref)
 	}
 
-	return poweredOff, nil
+	return done, nil
 }
 
-func (c *Client) powerOffVm(ctx context.Context, ref types.ManagedObjectReference, refCh chan types.ManagedObjectReference, lim *limiter, wg *sync.WaitGroup, force bool) {
-	defer func() {
-		lim.release()
-		wg.Done()
-	}()
-
+func (c *Client) powerOffVm(ctx context.Context, ref types.ManagedObjectReference, force bool) bool {
 	logger := activity.GetLogger(ctx)
 	o := object.NewVirtualMachine(c.vcclient, ref)
 
@@ -185,7 +352,7 @@ func (c *Client) powerOffVm(ctx context.Context, ref types.ManagedObjectReferenc
 
 	if !(state == types.VirtualMachinePowerStatePoweredOn) {
 		logger.Debug("vm is not powered on", "ref", ref.String())
-		return
+		return false
 	}
 
 	if !force {
@@ -193,62 +360,125 @@ func (c *Client) powerOffVm(ctx context.Context, ref types.ManagedObjectReferenc
 		// shutdown does not return task and immediately returns
 		if err = o.ShutdownGuest(ctx); err != nil {
 			logger.Warn("failed to shut down vm", "error", err, "ref", ref.String())
-			return
+			return false
 		}
-		refCh <- ref
-		return
+		return true
 	}
 
-	// hard shutdown
-	_, err = o.PowerOff(ctx)
+	// hard shutdown, waits for the task so that enforcement does not report the
+	// vm as powered on
+	task, err := o.PowerOff(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
 	if err != nil {
 		logger.Warn("failed to power off vm", "error", err, "ref", ref.String())
-		return
+		return false
 	}
-	refCh <- ref
+	return true
 }
 
-func (c *Client) AnnotateVms(ctx context.Context, refs []types.ManagedObjectReference, data annotationData) error {
+func (c *Client) suspendVm(ctx context.Context, ref types.ManagedObjectReference) bool {
+	logger := activity.GetLogger(ctx)
+	o := object.NewVirtualMachine(c.vcclient, ref)
+
+	state, err := o.PowerState(ctx)
+	if err != nil {
+		// log only and continue to attempt to suspend vm
+		logger.Warn("failed to get vm power state", "error", err, "ref", ref.String())
+	}
+
+	if !(state == types.VirtualMachinePowerStatePoweredOn) {
+		logger.Debug("vm is not powered on", "ref", ref.String())
+		return false
+	}
+
+	task, err := o.Suspend(ctx)
+	if err == nil {
+		err = task.Wait(ctx)
+	}
+	if err != nil {
+		logger.Warn("failed to suspend vm", "error", err, "ref", ref.String())
+		return false
+	}
+	return true
+}
+
+// AnnotateVms adds the given record to the annotation history of the given VMs
+// and returns the result for every VM. Preempted VMs are also marked with the
+// PreemptedTag tag of the given marker category if set. Annotated VMs are
+// recorded as heartbeat details and skipped when the activity is retried. If
+// any VM is not annotated, a retryable error with the results as details is
+// returned.
+func (c *Client) AnnotateVms(ctx context.Context, refs []types.ManagedObjectReference, record AnnotationRecord, markerCategory string) ([]AnnotationResult, error) {
 	logger := activity.GetLogger(ctx)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	if len(refs) == 0 {
-		return nil
+		return nil, nil
+	}
+
+	var p progress
+	if activity.HasHeartbeatDetails(ctx) {
+		if err := activity.GetHeartbeatDetails(ctx, &p.done); err != nil {
+			logger.Warn("get heartbeat details, annotating all vms", "error", err)
+			p.done = nil
+		}
 	}
 
 	// send heartbeats
-	go heartbeat(ctx)
+	go p.heartbeat(ctx)
+
+	pending := make([]types.ManagedObjectReference, 0, len(refs))
+	for _, ref := range refs {
+		if !p.contains(ref) {
+			pending = append(pending, ref)
+		}
+	}
+	if len(pending) < len(refs) {
+		logger.Debug("skipping vms annotated in previous attempt", "count", len(refs)-len(pending))
+	}
 
 	om, err := object.GetCustomFieldsManager(c.vcclient)
 	if err != nil {
-		return temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
+		return nil, temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
 	}
 
-	b, err := json.Marshal(data)
-	if err != nil {
-		return temporal.NewNonRetryableApplicationError("marshal annotation data", errInternal, err)
+	record.Time = c.clock.Now().UTC()
+
+	// tagged first, the annotation history is not idempotent on retry
+	if record.Preempted && markerCategory != "" && len(pending) > 0 {
+		logger.Debug("marking preempted vms", "category", markerCategory, "refs", pending)
+		if err = c.markPreempted(ctx, markerCategory, pending); err != nil {
+			return nil, err
+		}
 	}
 
-	key, err := om.FindKey(ctx, customField)
+	key, found, err := c.findCustomField(ctx, om)
 	if err != nil {
-		if !strings.Contains(err.Error(), "key name not found") {
-			return temporal.NewNonRetryableApplicationError("find custom field", errVSphere, err, "key", customField)
-		}
+		return nil, err
+	}
 
-		logger.Debug("custom field not found, creating field", "key", customField)
-		def, fieldErr := om.Add(ctx, customField, "VirtualMachine", nil, nil)
+	if !found {
+		logger.Debug("custom field not found, creating field", "key", c.customField())
+		def, fieldErr := om.Add(ctx, c.customField(), "VirtualMachine", nil, nil)
 		if fieldErr != nil {
-			return temporal.NewNonRetryableApplicationError("create custom field", errVSphere, fieldErr, "key", customField)
+			return nil, temporal.NewNonRetryableApplicationError("create custom field", errVSphere, fieldErr, "key", c.customField())
 		}
 		key = def.Key
 	}
 
-	logger.Debug("annotating preempted vms", "refs", refs)
+	var (
+		mu     sync.Mutex
+		failed = make(map[types.ManagedObjectReference]string)
+	)
+
+	logger.Debug("annotating vms", "refs", pending)
 	lim := newLimiter(concurrentVCenterCalls) // limit concurrent vc calls
 	wg := sync.WaitGroup{}
-	for i := range refs {
-		ref := refs[i]
+	for i := range pending {
+		ref := pending[i]
 		lim.acquire()
 		wg.Add(1)
 		go func() {
@@ -257,20 +487,126 @@ func (c *Client) AnnotateVms(ctx context.Context, refs []types.ManagedObjectRefe
 				wg.Done()
 			}()
 
-			err := om.Set(ctx, ref, key, string(b))
+			a, err := c.getAnnotation(ctx, key, ref)
 			if err != nil {
+				// do not overwrite history
+				logger.Warn("get custom field", "ref", ref, "error", err)
+				mu.Lock()
+				failed[ref] = err.Error()
+				mu.Unlock()
+				return
+			}
+			a.add(record)
+
+			if err = c.setAnnotation(ctx, om, key, ref, a); err != nil {
 				logger.Warn("set custom field", "ref", ref, "error", err)
+				mu.Lock()
+				failed[ref] = err.Error()
+				mu.Unlock()
+				return
 			}
+			p.add(ctx, ref)
 		}()
 	}
 
 	logger.Debug("waiting for operations to finish")
 	wg.Wait()
 
+	results := make([]AnnotationResult, 0, len(refs))
+	for _, ref := range refs {
+		res := AnnotationResult{VM: ref, Action: record.Action, Annotated: p.contains(ref)}
+		if !res.Annotated {
+			res.Error = failed[ref]
+		}
+		results = append(results, res)
+	}
+
+	if len(failed) > 0 {
+		msg := fmt.Sprintf("annotate %d of %d vms failed", len(failed), len(refs))
+		return nil, temporal.NewApplicationError(msg, errVSphere, results)
+	}
+	return results, nil
+}
+
+// SendPreemptedEvent sends the preempted event, one event per preempted VM if
+// the sink is configured for per VM events. meta is empty for activities
+// scheduled by earlier releases.
+func (c *Client) SendPreemptedEvent(ctx context.Context, wfID string, sink SinkConfig, data eventResponseData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s", wfID, data.Event.ID()) // format: wfID-vcEventID
+	if !sink.PerVM || len(data.VirtualMachines) == 0 {
+		return c.sendEvent(ctx, eventType, id, sink, c.withSubject(ctx, meta, data.VirtualMachines), data)
+	}
+
+	for _, vm := range data.VirtualMachines {
+		d := data
+		d.VirtualMachines = []types.ManagedObjectReference{vm}
+		d.Migrated = nil
+		d.Drain = nil
+		for _, res := range data.Drain {
+			if res.VM == vm {
+				d.Drain = append(d.Drain, res)
+			}
+		}
+
+		m := meta
+		m.Subject = vm.Value
+		if err := c.sendEvent(ctx, eventType, id+"-"+vm.Value, sink, m, d); err != nil { // format: wfID-vcEventID-vmID
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Client) SendPreemptedEvent(ctx context.Context, wfID, target string, data eventResponseData) error {
+// withSubject returns meta with the VM as subject if the event concerns a
+// single VM. For requests without cluster the subject is set to the cluster of
+// the VMs if they share one.
+func (c *Client) withSubject(ctx context.Context, meta EventMeta, vms []types.ManagedObjectReference) EventMeta {
+	switch {
+	case len(vms) == 1:
+		meta.Subject = vms[0].Value
+	case len(vms) > 1 && meta.Subject == "":
+		name, err := c.clusterName(ctx, vms)
+		if err != nil {
+			activity.GetLogger(ctx).Warn("could not resolve cluster of vms for event subject", "error", err)
+		}
+		meta.Subject = name
+	}
+	return meta
+}
+
+// clusterName returns the name of the cluster all given VMs are running in or
+// an empty string if they do not share a cluster
+func (c *Client) clusterName(ctx context.Context, refs []types.ManagedObjectReference) (string, error) {
+	var cluster *types.ManagedObjectReference
+	for _, ref := range refs {
+		vmCluster, err := c.vmCluster(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+		if vmCluster == nil || (cluster != nil && *cluster != *vmCluster) {
+			return "", nil
+		}
+		cluster = vmCluster
+	}
+
+	var ccr mo.ClusterComputeResource
+	if err := property.DefaultCollector(c.vcclient).RetrieveOne(ctx, *cluster, []string{"name"}, &ccr); err != nil {
+		return "", fmt.Errorf("retrieve cluster name: %w", err)
+	}
+	return ccr.Name, nil
+}
+
+func (c *Client) SendApprovalRequestEvent(ctx context.Context, wfID string, sink SinkConfig, data approvalRequestData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-approval", wfID, data.Event.ID()) // format: wfID-vcEventID-approval
+	return c.sendEvent(ctx, approvalEventType, id, sink, meta, data)
+}
+
+func (c *Client) SendFailedEvent(ctx context.Context, wfID string, sink SinkConfig, data failedEventData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-failed", wfID, data.Event.ID()) // format: wfID-vcEventID-failed
+	return c.sendEvent(ctx, failedEventType, id, sink, meta, data)
+}
+
+func (c *Client) sendEvent(ctx context.Context, eventType, id string, target SinkConfig, meta EventMeta, data interface{}) error {
 	var env EnvConfig
 	if err := envconfig.Process("", &env); err != nil {
 		return err
@@ -283,29 +619,55 @@ func (c *Client) SendPreemptedEvent(ctx context.Context, wfID, target string, da
 	// send heartbeats
 	go heartbeat(ctx)
 
-	ctx = ce.ContextWithTarget(ctx, target)
+	sink, err := c.sink(target)
+	if err != nil {
+		return temporal.NewApplicationError("create sink", errInternal, err)
+	}
 
 	source := fmt.Sprintf("%s/%s", env.Address, env.Namespace) // temporal URL + namespace
 	event := ce.NewEvent()
 	event.SetSource(source)
-	event.SetID(fmt.Sprintf("%s-%s", wfID, data.Event.ID())) // format: wfID-vcEventID
+	event.SetID(id)
 	event.SetTime(c.clock.Now().UTC())
 	event.SetType(eventType)
-	err := event.SetData(ce.ApplicationJSON, data)
-	if err != nil {
+	if meta.Subject != "" {
+		event.SetSubject(meta.Subject)
+	}
+	if target.Tracing {
+		setTraceContext(&event, meta, activity.GetInfo(ctx).WorkflowExecution.RunID)
+	}
+	if err = event.SetData(ce.ApplicationJSON, data); err != nil {
 		return fmt.Errorf("set event data: %w", err)
 	}
 
-	logger.Debug("sending cloudevent response", "id", event.ID(), "target", target)
-	result := c.ceclient.Send(ctx, event) // retries handled by activity options
-	if !protocol.IsACK(result) {
-		logger.Error("send cloudevent response", "id", event.ID(), "target", target, "error", result)
-		return result
+	if target.SigningKeyFile != "" {
+		if err = c.checkSecretHost(target.SigningKeyFile, target.URL); err != nil {
+			return temporal.NewNonRetryableApplicationError("read signing key", errInternal, err)
+		}
+		key, err := c.readSecret(target.SigningKeyFile)
+		if err != nil {
+			return temporal.NewApplicationError("read signing key", errInternal, err)
+		}
+		SignEvent(&event, key)
 	}
-	logger.Debug("successfully sent cloudevent response", "id", event.ID(), "target", target)
+
+	logger.Debug("sending cloudevent", "id", event.ID(), "type", eventType, "target", target.URL)
+	if err = sink.Send(ctx, event); err != nil { // retries handled by activity options
+		logger.Error("send cloudevent", "id", event.ID(), "type", eventType, "target", target.URL, "error", err)
+		return err
+	}
+	logger.Debug("successfully sent cloudevent", "id", event.ID(), "type", eventType, "target", target.URL)
 	return nil
 }
 
+// batchTimeout returns the start to close timeout for an activity processing
+// the given number of VMs with concurrentVCenterCalls, each VM taking up to
+// timeout
+func batchTimeout(timeout time.Duration, vms int) time.Duration {
+	batches := (vms + concurrentVCenterCalls - 1) / concurrentVCenterCalls
+	return timeout*time.Duration(batches) + time.Minute*5
+}
+
 func heartbeat(ctx context.Context) {
 	hbTicker := time.NewTicker(heartBeatInterval)
 	defer hbTicker.Stop()
@@ -321,3 +683,49 @@ func heartbeat(ctx context.Context) {
 		}
 	}
 }
+
+// progress holds the VMs processed by an activity which are recorded as
+// heartbeat details, so a retried activity can skip them
+type progress struct {
+	mu   sync.Mutex
+	done []types.ManagedObjectReference
+}
+
+// add marks the VM as processed and records a heartbeat
+func (p *progress) add(ctx context.Context, ref types.ManagedObjectReference) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = append(p.done, ref)
+	activity.RecordHeartbeat(ctx, p.done)
+}
+
+func (p *progress) contains(ref types.ManagedObjectReference) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, done := range p.done {
+		if done == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// heartbeat is like heartbeat but records the processed VMs in every
+// heartbeat
+func (p *progress) heartbeat(ctx context.Context) {
+	hbTicker := time.NewTicker(heartBeatInterval)
+	defer hbTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			activity.GetLogger(ctx).Debug("stopping heartbeat")
+			return
+		case <-hbTicker.C:
+			activity.GetLogger(ctx).Debug("sending heartbeat", "interval", heartBeatInterval.String())
+			p.mu.Lock()
+			activity.RecordHeartbeat(ctx, p.done)
+			p.mu.Unlock()
+		}
+	}
+}
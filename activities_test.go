@@ -0,0 +1,22 @@
+package preemption
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCandidateQuery_UnmarshalJSON(t *testing.T) {
+	t.Run("accepts plain tag", func(t *testing.T) {
+		var q candidateQuery
+		assert.NilError(t, json.Unmarshal([]byte(`"preemptible"`), &q))
+		assert.DeepEqual(t, q, candidateQuery{Scope: Scope{Tag: "preemptible"}})
+	})
+
+	t.Run("accepts query object", func(t *testing.T) {
+		var q candidateQuery
+		assert.NilError(t, json.Unmarshal([]byte(`{"cluster":"cluster01","tag":"preemptible","host":"esx01"}`), &q))
+		assert.DeepEqual(t, q, candidateQuery{Scope: Scope{Cluster: "cluster01", Tag: "preemptible"}, Host: "esx01"})
+	})
+}
@@ -0,0 +1,296 @@
+package preemption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+const (
+	DefaultAdmissionBudget = 3 // used when request does not specify admission budget
+
+	errInsufficientCapacity = "insufficient_capacity"
+)
+
+// AdmissionResult links the admitted VM with the VMs preempted to admit it
+type AdmissionResult struct {
+	Target   types.ManagedObjectReference   `json:"target"`
+	Cluster  string                         `json:"cluster,omitempty"`
+	Admitted bool                           `json:"admitted"`
+	Victims  []types.ManagedObjectReference `json:"victims"` // VMs preempted to admit the target
+}
+
+// capacity is an amount of compute resources
+type capacity struct {
+	MemoryMB int64 `json:"memoryMB"`
+	CpuMHz   int64 `json:"cpuMHz"`
+}
+
+// covers returns true if c is at least the given capacity
+func (c capacity) covers(other capacity) bool {
+	return c.MemoryMB >= other.MemoryMB && c.CpuMHz >= other.CpuMHz
+}
+
+// admissionQuery selects the VM to admit and the preemptible VMs
+type admissionQuery struct {
+	Scope
+	Target types.ManagedObjectReference `json:"target"`
+}
+
+type admissionCandidate struct {
+	Ref      types.ManagedObjectReference `json:"ref"`
+	Capacity capacity                     `json:"capacity"` // capacity released when preempted
+}
+
+// admissionPlan describes the capacity required to power on the target VM
+type admissionPlan struct {
+	Cluster    string               `json:"cluster"`
+	PoweredOn  bool                 `json:"poweredOn"` // target already powered on
+	Required   capacity             `json:"required"`  // capacity required by the target
+	Deficit    capacity             `json:"deficit"`   // capacity to release in the cluster
+	Candidates []admissionCandidate `json:"candidates"`
+}
+
+// selectVictims returns the number of candidates from the beginning of the
+// given list which release at least the deficit. All candidates are selected if
+// their total capacity does not cover the deficit.
+func selectVictims(candidates []admissionCandidate, deficit capacity) int {
+	var released capacity
+	for i, c := range candidates {
+		if released.covers(deficit) {
+			return i
+		}
+		released.MemoryMB += c.Capacity.MemoryMB
+		released.CpuMHz += c.Capacity.CpuMHz
+	}
+	return len(candidates)
+}
+
+// filterCandidates returns the candidates contained in refs preserving the order
+// of candidates
+func filterCandidates(candidates []admissionCandidate, refs []types.ManagedObjectReference) []admissionCandidate {
+	keep := make(map[types.ManagedObjectReference]struct{}, len(refs))
+	for _, ref := range refs {
+		keep[ref] = struct{}{}
+	}
+
+	var filtered []admissionCandidate
+	for _, c := range candidates {
+		if _, ok := keep[c.Ref]; ok {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// GetAdmissionPlan computes the capacity the target VM requires in its cluster
+// and returns the preemptible VMs in the same cluster, largest first
+func (c *Client) GetAdmissionPlan(ctx context.Context, query admissionQuery) (*admissionPlan, error) {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	if query.VCenter != "" {
+		if err := checkVCenter(query.VCenter); err != nil {
+			return nil, err
+		}
+	}
+
+	pc := property.DefaultCollector(c.vcclient)
+
+	var target mo.VirtualMachine
+	if err := pc.RetrieveOne(ctx, query.Target, []string{"summary.config", "runtime.powerState", "resourcePool"}, &target); err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve target vm %q", query.Target.Value), errVSphere, err)
+	}
+
+	if target.ResourcePool == nil {
+		msg := fmt.Sprintf("target vm %q is not assigned to a resource pool", query.Target.Value)
+		return nil, temporal.NewNonRetryableApplicationError(msg, errVSphere, nil)
+	}
+
+	var pool mo.ResourcePool
+	if err := pc.RetrieveOne(ctx, *target.ResourcePool, []string{"owner"}, &pool); err != nil {
+		return nil, temporal.NewApplicationError("retrieve resource pool of target vm", errVSphere, err)
+	}
+
+	if pool.Owner.Type != "ClusterComputeResource" {
+		msg := fmt.Sprintf("target vm %q is not running in a cluster", query.Target.Value)
+		return nil, temporal.NewNonRetryableApplicationError(msg, errInternal, nil)
+	}
+
+	var ccr mo.ClusterComputeResource
+	if err := pc.RetrieveOne(ctx, pool.Owner, []string{"name", "host"}, &ccr); err != nil {
+		return nil, temporal.NewApplicationError("retrieve cluster of target vm", errVSphere, err)
+	}
+
+	if query.Cluster != "" && query.Cluster != ccr.Name {
+		msg := fmt.Sprintf("target vm %q is not running in requested cluster %q", query.Target.Value, query.Cluster)
+		return nil, temporal.NewNonRetryableApplicationError(msg, errInternal, nil)
+	}
+
+	plan := admissionPlan{
+		Cluster:   ccr.Name,
+		PoweredOn: target.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn,
+	}
+	if plan.PoweredOn {
+		logger.Debug("target vm already powered on", "ref", query.Target.String())
+		return &plan, nil
+	}
+
+	var hosts []mo.HostSystem
+	if len(ccr.Host) > 0 {
+		if err := pc.Retrieve(ctx, ccr.Host, []string{"summary.hardware", "runtime", "vm"}, &hosts); err != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve hosts of cluster %q", ccr.Name), errVSphere, err)
+		}
+	}
+
+	var (
+		total  capacity
+		cores  int64
+		vmRefs []types.ManagedObjectReference
+	)
+	for _, h := range hosts {
+		if h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected || h.Runtime.InMaintenanceMode {
+			continue
+		}
+		hw := h.Summary.Hardware
+		if hw == nil {
+			continue
+		}
+
+		total.MemoryMB += hw.MemorySize / 1024 / 1024
+		total.CpuMHz += int64(hw.CpuMhz) * int64(hw.NumCpuCores)
+		cores += int64(hw.NumCpuCores)
+		vmRefs = append(vmRefs, h.Vm...)
+	}
+
+	if cores == 0 {
+		msg := fmt.Sprintf("no available hosts in cluster %q", ccr.Name)
+		return nil, temporal.NewNonRetryableApplicationError(msg, errInsufficientCapacity, nil)
+	}
+	mhzPerCPU := total.CpuMHz / cores
+
+	var vms []mo.VirtualMachine
+	if len(vmRefs) > 0 {
+		if err := pc.Retrieve(ctx, vmRefs, []string{"summary.config", "runtime.powerState"}, &vms); err != nil {
+			return nil, temporal.NewApplicationError("retrieve virtual machine properties", errVSphere, err)
+		}
+	}
+
+	var used capacity
+	poweredOn := make(map[types.ManagedObjectReference]capacity, len(vms))
+	for _, vm := range vms {
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			continue
+		}
+		vmCapacity := capacity{
+			MemoryMB: int64(vm.Summary.Config.MemorySizeMB),
+			CpuMHz:   int64(vm.Summary.Config.NumCpu) * mhzPerCPU,
+		}
+		used.MemoryMB += vmCapacity.MemoryMB
+		used.CpuMHz += vmCapacity.CpuMHz
+		poweredOn[vm.Reference()] = vmCapacity
+	}
+
+	plan.Required = capacity{
+		MemoryMB: int64(target.Summary.Config.MemorySizeMB),
+		CpuMHz:   int64(target.Summary.Config.NumCpu) * mhzPerCPU,
+	}
+	plan.Deficit = capacity{
+		MemoryMB: max64(0, plan.Required.MemoryMB-(total.MemoryMB-used.MemoryMB)),
+		CpuMHz:   max64(0, plan.Required.CpuMHz-(total.CpuMHz-used.CpuMHz)),
+	}
+	logger.Debug("target vm admission capacity", "cluster", ccr.Name, "total", total, "used", used, "required", plan.Required, "deficit", plan.Deficit)
+
+	tagRefs, err := c.tagManager.ListAttachedObjects(ctx, query.Tag)
+	if err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("get tag %q", query.Tag), errVSphere, err)
+	}
+
+	for _, ref := range tagRefs {
+		vm := ref.Reference()
+		if vm == query.Target {
+			continue
+		}
+		if vmCapacity, ok := poweredOn[vm]; ok {
+			plan.Candidates = append(plan.Candidates, admissionCandidate{Ref: vm, Capacity: vmCapacity})
+		}
+	}
+
+	// release capacity with as few VMs as possible
+	sort.SliceStable(plan.Candidates, func(i, j int) bool {
+		ci, cj := plan.Candidates[i].Capacity, plan.Candidates[j].Capacity
+		if ci.MemoryMB != cj.MemoryMB {
+			return ci.MemoryMB > cj.MemoryMB
+		}
+		return ci.CpuMHz > cj.CpuMHz
+	})
+
+	if len(plan.Candidates) > maxPreemptVms {
+		logger.Debug("maximum search count for preemptible vms reached", "maxPreemptVMs", maxPreemptVms)
+		plan.Candidates = plan.Candidates[:maxPreemptVms]
+	}
+
+	return &plan, nil
+}
+
+// PowerOnVM powers on the given VM. A non-retryable error of type
+// errInsufficientCapacity is returned if vSphere rejects the operation due to
+// insufficient resources.
+func (c *Client) PowerOnVM(ctx context.Context, ref types.ManagedObjectReference) error {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	vm := object.NewVirtualMachine(c.vcclient, ref)
+
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return temporal.NewApplicationError("get vm power state", errVSphere, err)
+	}
+
+	if state == types.VirtualMachinePowerStatePoweredOn {
+		logger.Debug("vm is already powered on", "ref", ref.String())
+		return nil
+	}
+
+	logger.Debug("powering on vm", "ref", ref.String())
+	t, err := vm.PowerOn(ctx)
+	if err != nil {
+		return temporal.NewApplicationError("power on vm", errVSphere, err)
+	}
+
+	if err = t.Wait(ctx); err != nil {
+		var taskErr task.Error
+		if errors.As(err, &taskErr) {
+			if _, ok := taskErr.Fault().(types.BaseInsufficientResourcesFault); ok {
+				return temporal.NewNonRetryableApplicationError("power on vm", errInsufficientCapacity, err)
+			}
+		}
+		return temporal.NewApplicationError("power on vm", errVSphere, err)
+	}
+
+	return nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
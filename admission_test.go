@@ -0,0 +1,52 @@
+package preemption
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func Test_selectVictims(t *testing.T) {
+	candidates := []admissionCandidate{
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}, Capacity: capacity{MemoryMB: 4096, CpuMHz: 2000}},
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}, Capacity: capacity{MemoryMB: 2048, CpuMHz: 4000}},
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-3"}, Capacity: capacity{MemoryMB: 1024, CpuMHz: 1000}},
+	}
+
+	tests := []struct {
+		name       string
+		candidates []admissionCandidate
+		deficit    capacity
+		want       int
+	}{
+		{name: "no deficit", candidates: candidates, deficit: capacity{}, want: 0},
+		{name: "no candidates", candidates: nil, deficit: capacity{MemoryMB: 1024}, want: 0},
+		{name: "first candidate covers deficit", candidates: candidates, deficit: capacity{MemoryMB: 4096, CpuMHz: 2000}, want: 1},
+		{name: "cpu deficit requires second candidate", candidates: candidates, deficit: capacity{MemoryMB: 1024, CpuMHz: 3000}, want: 2},
+		{name: "deficit exceeds candidates", candidates: candidates, deficit: capacity{MemoryMB: 16384}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, selectVictims(tt.candidates, tt.deficit), tt.want)
+		})
+	}
+}
+
+func Test_filterCandidates(t *testing.T) {
+	candidates := []admissionCandidate{
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}},
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}},
+		{Ref: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-3"}},
+	}
+
+	refs := []types.ManagedObjectReference{
+		{Type: "VirtualMachine", Value: "vm-3"},
+		{Type: "VirtualMachine", Value: "vm-1"},
+	}
+
+	got := filterCandidates(candidates, refs)
+	assert.Equal(t, len(got), 2)
+	assert.Equal(t, got[0].Ref.Value, "vm-1")
+	assert.Equal(t, got[1].Ref.Value, "vm-3")
+}
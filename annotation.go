@@ -0,0 +1,391 @@
+package preemption
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// VMAction is the action recorded for a VM in its annotation
+type VMAction string
+
+const (
+	VMActionPreempted VMAction = "PREEMPTED" // powered off or suspended
+	VMActionMigrated  VMAction = "MIGRATED"  // migrated to the overflow capacity
+	VMActionRestored  VMAction = "RESTORED"  // powered on by RequestTypeRestore
+
+	AnnotationVersion    = 1  // current version of the annotation format
+	MaxAnnotationRecords = 10 // records kept in the annotation history
+)
+
+// AnnotationFailurePolicy defines the outcome of a workflow run when VMs
+// cannot be annotated
+type AnnotationFailurePolicy string
+
+const (
+	AnnotationFailPartial AnnotationFailurePolicy = "PARTIAL" // run partially succeeded (default)
+	AnnotationFailRun     AnnotationFailurePolicy = "FAIL"    // run failed
+)
+
+// AnnotationResult is the outcome of annotating a VM
+type AnnotationResult struct {
+	VM        types.ManagedObjectReference `json:"vm"`
+	Action    VMAction                     `json:"action"`
+	Annotated bool                         `json:"annotated"`
+	Error     string                       `json:"error,omitempty"` // reason the annotation failed
+}
+
+// RequiredAnnotationFields are the record fields kept in the annotation
+// regardless of the field allowlist, the workflow depends on them
+var RequiredAnnotationFields = []string{"action", "preempted", "haRestart"}
+
+// Annotation is the value of the preemption custom field of a VM. It holds a
+// bounded history of preemption, migration and restore records, oldest first.
+type Annotation struct {
+	Version int                `json:"version"`
+	Records []AnnotationRecord `json:"records"`
+}
+
+// AnnotationRecord is a single preemption, migration or restore of a VM
+type AnnotationRecord struct {
+	Action          VMAction    `json:"action,omitempty"` // empty in records migrated from the unversioned format
+	Time            time.Time   `json:"time,omitempty"`   // time the record was added, zero in migrated records
+	Preempted       bool        `json:"preempted"`
+	Tag             string      `json:"tag"`
+	ForcedShutdown  bool        `json:"forcedShutdown" `
+	Criticality     Criticality `json:"criticality"`
+	WorkflowID      string      `json:"workflowID"`
+	WorkflowStarted time.Time   `json:"workflowStarted"`
+	Event           *ce.Event   `json:"event,omitempty"`      // event that triggered the workflow run
+	ApprovedBy      string      `json:"approvedBy,omitempty"` // approver identity (CriticalityMedium)
+	Suspended       bool        `json:"suspended,omitempty"`  // suspended instead of powered off (ActionSuspend)
+	MigratedTo      string      `json:"migratedTo,omitempty"` // overflow cluster (VMActionMigrated)
+
+	AdmittedVM *types.ManagedObjectReference `json:"admittedVM,omitempty"` // VM admitted by preempting this VM (RequestTypeAdmit)
+	HARestart  *HARestartSettings            `json:"haRestart,omitempty"`  // HA restart settings before preemption, set by DisableHARestart
+}
+
+// ParseAnnotation parses the value of the preemption custom field of a VM. An
+// empty value returns an empty annotation. Values written before the
+// annotation was versioned, i.e. a single record, are migrated to the current
+// version.
+func ParseAnnotation(value string) (Annotation, error) {
+	a := Annotation{Version: AnnotationVersion}
+	if value == "" {
+		return a, nil
+	}
+
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(value), &header); err != nil {
+		return Annotation{}, fmt.Errorf("unmarshal annotation: %w", err)
+	}
+
+	if header.Version == nil {
+		var r AnnotationRecord
+		if err := json.Unmarshal([]byte(value), &r); err != nil {
+			return Annotation{}, fmt.Errorf("unmarshal unversioned annotation: %w", err)
+		}
+		if r.Action == "" && r.Preempted {
+			r.Action = VMActionPreempted
+		}
+		a.Records = []AnnotationRecord{r}
+		return a, nil
+	}
+
+	if *header.Version > AnnotationVersion {
+		return Annotation{}, fmt.Errorf("unsupported annotation version %d (supported: %d)", *header.Version, AnnotationVersion)
+	}
+
+	if err := json.Unmarshal([]byte(value), &a); err != nil {
+		return Annotation{}, fmt.Errorf("unmarshal annotation: %w", err)
+	}
+	a.Version = AnnotationVersion
+	return a, nil
+}
+
+// Render returns the value of the preemption custom field for the annotation
+// keeping the latest MaxAnnotationRecords records. If fields are given, only
+// these (JSON) fields and the RequiredAnnotationFields of each record are kept.
+func (a Annotation) Render(fields ...string) (string, error) {
+	a.Version = AnnotationVersion
+	if len(a.Records) > MaxAnnotationRecords {
+		a.Records = a.Records[len(a.Records)-MaxAnnotationRecords:]
+	}
+
+	if len(fields) == 0 {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return "", fmt.Errorf("marshal annotation: %w", err)
+		}
+		return string(b), nil
+	}
+
+	keep := make(map[string]struct{}, len(fields)+len(RequiredAnnotationFields))
+	for _, f := range append(fields, RequiredAnnotationFields...) {
+		keep[f] = struct{}{}
+	}
+
+	records := make([]map[string]json.RawMessage, 0, len(a.Records))
+	for _, r := range a.Records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return "", fmt.Errorf("marshal annotation record: %w", err)
+		}
+
+		var m map[string]json.RawMessage
+		if err = json.Unmarshal(b, &m); err != nil {
+			return "", fmt.Errorf("unmarshal annotation record: %w", err)
+		}
+		for k := range m {
+			if _, ok := keep[k]; !ok {
+				delete(m, k)
+			}
+		}
+		records = append(records, m)
+	}
+
+	filtered := struct {
+		Version int                          `json:"version"`
+		Records []map[string]json.RawMessage `json:"records"`
+	}{
+		Version: a.Version,
+		Records: records,
+	}
+
+	b, err := json.Marshal(filtered)
+	if err != nil {
+		return "", fmt.Errorf("marshal annotation: %w", err)
+	}
+	return string(b), nil
+}
+
+// validateAnnotationFields returns an error if any of the given fields is not a
+// (JSON) field of AnnotationRecord
+func validateAnnotationFields(fields []string) error {
+	valid := make(map[string]struct{})
+	t := reflect.TypeOf(AnnotationRecord{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		valid[name] = struct{}{}
+	}
+
+	for _, f := range fields {
+		if _, ok := valid[f]; !ok {
+			return fmt.Errorf("invalid annotation field %q", f)
+		}
+	}
+	return nil
+}
+
+// Latest returns the latest record, nil if the annotation has no records
+func (a Annotation) Latest() *AnnotationRecord {
+	if len(a.Records) == 0 {
+		return nil
+	}
+	return &a.Records[len(a.Records)-1]
+}
+
+// Preempted returns true if the VM is preempted according to the latest record
+func (a Annotation) Preempted() bool {
+	r := a.Latest()
+	return r != nil && r.Preempted
+}
+
+// add appends the given record. HA restart settings of a preempted VM are
+// carried over, so the original settings survive repeated preemption.
+func (a *Annotation) add(r AnnotationRecord) {
+	if latest := a.Latest(); latest != nil && latest.Preempted && r.Preempted && r.HARestart == nil {
+		r.HARestart = latest.HARestart
+	}
+
+	a.Records = append(a.Records, r)
+	if len(a.Records) > MaxAnnotationRecords {
+		a.Records = a.Records[len(a.Records)-MaxAnnotationRecords:]
+	}
+}
+
+// findCustomField returns the key of the custom field holding the annotation
+// and false if the field does not exist, i.e. no VM was annotated yet
+func (c *Client) findCustomField(ctx context.Context, om *object.CustomFieldsManager) (int32, bool, error) {
+	key, err := om.FindKey(ctx, c.customField())
+	if err != nil {
+		if strings.Contains(err.Error(), "key name not found") {
+			return 0, false, nil
+		}
+		return 0, false, temporal.NewNonRetryableApplicationError("find custom field", errVSphere, err, "key", c.customField())
+	}
+	return key, true, nil
+}
+
+// vmAnnotation returns the annotation of the given VM, an annotation without
+// records if the VM is not annotated
+func vmAnnotation(vm mo.VirtualMachine, key int32) (Annotation, error) {
+	var value string
+	for _, v := range vm.CustomValue {
+		// last value wins, the vCenter simulator appends values on update
+		if sv, ok := v.(*types.CustomFieldStringValue); ok && sv.Key == key {
+			value = sv.Value
+		}
+	}
+	return ParseAnnotation(value)
+}
+
+func (c *Client) getAnnotation(ctx context.Context, key int32, ref types.ManagedObjectReference) (Annotation, error) {
+	var vm mo.VirtualMachine
+	if err := property.DefaultCollector(c.vcclient).RetrieveOne(ctx, ref, []string{"customValue"}, &vm); err != nil {
+		return Annotation{}, fmt.Errorf("retrieve custom values: %w", err)
+	}
+	return vmAnnotation(vm, key)
+}
+
+// setAnnotation renders and stores the annotation of the given VM keeping the
+// configured annotation fields
+func (c *Client) setAnnotation(ctx context.Context, om *object.CustomFieldsManager, key int32, ref types.ManagedObjectReference, a Annotation) error {
+	value, err := a.Render(c.annotationFields...)
+	if err != nil {
+		return err
+	}
+	return om.Set(ctx, ref, key, value)
+}
+
+// GetPreemptedVMs returns all VMs matching the given query which are annotated
+// as preempted
+func (c *Client) GetPreemptedVMs(ctx context.Context, query candidateQuery) ([]types.ManagedObjectReference, error) {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	om, err := object.GetCustomFieldsManager(c.vcclient)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
+	}
+
+	key, found, err := c.findCustomField(ctx, om)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	candidates, err := c.findCandidates(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	preempted, err := c.filterVMs(ctx, candidates, []string{"customValue"}, func(vm mo.VirtualMachine) bool {
+		a, err := vmAnnotation(vm, key)
+		if err != nil {
+			logger.Warn("invalid annotation", "error", err, "ref", vm.Reference().String())
+			return false
+		}
+		return a.Preempted()
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("preempted vms", "refs", preempted)
+
+	return preempted, nil
+}
+
+// RestoreVMs restores the HA restart priority of the given preempted VMs, powers
+// them on, detaches the PreemptedTag tag of the given marker category if set
+// and adds the given restore record to their annotation. It returns the restored
+// VMs.
+func (c *Client) RestoreVMs(ctx context.Context, refs []types.ManagedObjectReference, record AnnotationRecord, markerCategory string) ([]types.ManagedObjectReference, error) {
+	logger := activity.GetLogger(ctx)
+
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	om, err := object.GetCustomFieldsManager(c.vcclient)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
+	}
+
+	key, found, err := c.findCustomField(ctx, om)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	var tagID string
+	if markerCategory != "" {
+		if tagID, err = c.preemptedTag(ctx, markerCategory); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.forEachVM(ctx, refs, func(ctx context.Context, ref types.ManagedObjectReference) bool {
+		if err := c.restoreVm(ctx, om, key, ref, record, tagID); err != nil {
+			logger.Warn("failed to restore vm", "error", err, "ref", ref.String())
+			return false
+		}
+		return true
+	})
+}
+
+func (c *Client) restoreVm(ctx context.Context, om *object.CustomFieldsManager, key int32, ref types.ManagedObjectReference, record AnnotationRecord, tagID string) error {
+	a, err := c.getAnnotation(ctx, key, ref)
+	if err != nil {
+		return err
+	}
+	if !a.Preempted() {
+		return errors.New("vm is not annotated as preempted")
+	}
+
+	if settings := a.Latest().HARestart; settings != nil {
+		if err = c.setDasVmSettings(ctx, settings.Cluster, ref, settings.Previous); err != nil {
+			return fmt.Errorf("restore ha restart settings: %w", err)
+		}
+	}
+
+	vm := object.NewVirtualMachine(c.vcclient, ref)
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return fmt.Errorf("get vm power state: %w", err)
+	}
+
+	if state != types.VirtualMachinePowerStatePoweredOn {
+		t, err := vm.PowerOn(ctx)
+		if err != nil {
+			return fmt.Errorf("power on vm: %w", err)
+		}
+		if err = t.Wait(ctx); err != nil {
+			return fmt.Errorf("power on vm: %w", err)
+		}
+	}
+
+	if tagID != "" {
+		if err = c.tagManager.DetachTag(ctx, tagID, ref); err != nil {
+			return fmt.Errorf("detach tag %q: %w", PreemptedTag, err)
+		}
+	}
+
+	// the vm is kept preempted until it is powered on to retry restoring the
+	// ha restart settings
+	record.Action = VMActionRestored
+	record.Time = c.clock.Now().UTC()
+	record.Preempted = false
+	record.HARestart = nil
+	a.add(record)
+	if err = c.setAnnotation(ctx, om, key, ref, a); err != nil {
+		return fmt.Errorf("add restore record: %w", err)
+	}
+	return nil
+}
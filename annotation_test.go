@@ -0,0 +1,170 @@
+package preemption
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseAnnotation(t *testing.T) {
+	t.Run("returns empty annotation for empty value", func(t *testing.T) {
+		a, err := ParseAnnotation("")
+		assert.NilError(t, err)
+		assert.Equal(t, a.Version, AnnotationVersion)
+		assert.Assert(t, a.Latest() == nil)
+	})
+
+	t.Run("migrates unversioned annotation", func(t *testing.T) {
+		a, err := ParseAnnotation(`{"preempted":true,"tag":"preemptible","haRestart":{"cluster":{"type":"ClusterComputeResource","value":"domain-c1"}}}`)
+		assert.NilError(t, err)
+		assert.Equal(t, a.Version, AnnotationVersion)
+		assert.Equal(t, len(a.Records), 1)
+
+		r := a.Latest()
+		assert.Equal(t, r.Action, VMActionPreempted)
+		assert.Equal(t, r.Tag, "preemptible")
+		assert.Assert(t, r.HARestart != nil)
+		assert.Assert(t, a.Preempted())
+	})
+
+	t.Run("parses versioned annotation", func(t *testing.T) {
+		a, err := ParseAnnotation(`{"version":1,"records":[{"action":"PREEMPTED","preempted":true},{"action":"RESTORED","preempted":false}]}`)
+		assert.NilError(t, err)
+		assert.Equal(t, len(a.Records), 2)
+		assert.Equal(t, a.Latest().Action, VMActionRestored)
+		assert.Assert(t, !a.Preempted())
+	})
+
+	t.Run("fails on unsupported version", func(t *testing.T) {
+		_, err := ParseAnnotation(`{"version":2,"records":[]}`)
+		assert.ErrorContains(t, err, "unsupported annotation version 2")
+	})
+
+	t.Run("fails on invalid value", func(t *testing.T) {
+		_, err := ParseAnnotation("not json")
+		assert.ErrorContains(t, err, "unmarshal annotation")
+	})
+}
+
+func TestAnnotation_Render(t *testing.T) {
+	t.Run("keeps latest records", func(t *testing.T) {
+		var a Annotation
+		for i := 0; i < MaxAnnotationRecords+2; i++ {
+			e := newTestEvent("https://vcenter.test/sdk", fmt.Sprint(i))
+			a.Records = append(a.Records, AnnotationRecord{Action: VMActionPreempted, WorkflowID: fmt.Sprintf("wf-%d", i), Event: &e})
+		}
+
+		value, err := a.Render()
+		assert.NilError(t, err)
+
+		parsed, err := ParseAnnotation(value)
+		assert.NilError(t, err)
+		assert.Equal(t, len(parsed.Records), MaxAnnotationRecords)
+		assert.Equal(t, parsed.Records[0].WorkflowID, "wf-2")
+		assert.Equal(t, parsed.Latest().WorkflowID, fmt.Sprintf("wf-%d", MaxAnnotationRecords+1))
+	})
+}
+
+func TestAnnotation_Render_fields(t *testing.T) {
+	e := newTestEvent("https://vcenter.test/sdk", "1")
+	a := Annotation{Records: []AnnotationRecord{{
+		Action:     VMActionPreempted,
+		Preempted:  true,
+		Tag:        "preemptible",
+		WorkflowID: "wf-1",
+		Event:      &e,
+	}}}
+
+	t.Run("keeps allowed and required fields", func(t *testing.T) {
+		value, err := a.Render("workflowID")
+		assert.NilError(t, err)
+		assert.Equal(t, value, `{"version":1,"records":[{"action":"PREEMPTED","preempted":true,"workflowID":"wf-1"}]}`)
+
+		parsed, err := ParseAnnotation(value)
+		assert.NilError(t, err)
+		r := parsed.Latest()
+		assert.Equal(t, r.WorkflowID, "wf-1")
+		assert.Equal(t, r.Tag, "")
+		assert.Assert(t, r.Event == nil)
+		assert.Assert(t, parsed.Preempted())
+
+		// history without event can be rendered again
+		parsed.add(AnnotationRecord{Action: VMActionRestored})
+		_, err = parsed.Render()
+		assert.NilError(t, err)
+	})
+
+	t.Run("validates fields", func(t *testing.T) {
+		assert.NilError(t, validateAnnotationFields([]string{"time", "workflowID", "criticality"}))
+		assert.ErrorContains(t, validateAnnotationFields([]string{"time", "cloudevent"}), `invalid annotation field "cloudevent"`)
+	})
+}
+
+func TestAnnotation_add(t *testing.T) {
+	settings := &HARestartSettings{Cluster: types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-c1"}}
+
+	t.Run("carries over ha restart settings of preempted vm", func(t *testing.T) {
+		a := Annotation{Records: []AnnotationRecord{{Action: VMActionPreempted, Preempted: true, HARestart: settings}}}
+		a.add(AnnotationRecord{Action: VMActionPreempted, Preempted: true})
+		assert.Equal(t, len(a.Records), 2)
+		assert.Equal(t, a.Latest().HARestart, settings)
+	})
+
+	t.Run("does not carry over ha restart settings of restored vm", func(t *testing.T) {
+		a := Annotation{Records: []AnnotationRecord{{Action: VMActionRestored, HARestart: settings}}}
+		a.add(AnnotationRecord{Action: VMActionPreempted, Preempted: true})
+		assert.Assert(t, a.Latest().HARestart == nil)
+	})
+}
+
+func Test_vmAnnotation(t *testing.T) {
+	value := func(key int32, v string) types.BaseCustomFieldValue {
+		return &types.CustomFieldStringValue{CustomFieldValue: types.CustomFieldValue{Key: key}, Value: v}
+	}
+
+	t.Run("returns empty annotation if vm is not annotated", func(t *testing.T) {
+		vm := mo.VirtualMachine{}
+		vm.CustomValue = []types.BaseCustomFieldValue{value(2, `{"preempted":true}`)}
+
+		a, err := vmAnnotation(vm, 1)
+		assert.NilError(t, err)
+		assert.Assert(t, a.Latest() == nil)
+		assert.Assert(t, !a.Preempted())
+	})
+
+	t.Run("returns last value of custom field", func(t *testing.T) {
+		vm := mo.VirtualMachine{}
+		vm.CustomValue = []types.BaseCustomFieldValue{
+			value(1, `{"version":1,"records":[{"preempted":true}]}`),
+			value(1, `{"version":1,"records":[{"preempted":true,"haRestart":{}}]}`),
+		}
+
+		a, err := vmAnnotation(vm, 1)
+		assert.NilError(t, err)
+		assert.Assert(t, a.Preempted())
+		assert.Assert(t, a.Latest().HARestart != nil)
+	})
+
+	t.Run("returns empty annotation if annotation was removed", func(t *testing.T) {
+		vm := mo.VirtualMachine{}
+		vm.CustomValue = []types.BaseCustomFieldValue{
+			value(1, `{"preempted":true}`),
+			value(1, ""),
+		}
+
+		a, err := vmAnnotation(vm, 1)
+		assert.NilError(t, err)
+		assert.Assert(t, a.Latest() == nil)
+	})
+
+	t.Run("fails on invalid annotation", func(t *testing.T) {
+		vm := mo.VirtualMachine{}
+		vm.CustomValue = []types.BaseCustomFieldValue{value(1, "not json")}
+
+		_, err := vmAnnotation(vm, 1)
+		assert.ErrorContains(t, err, "unmarshal annotation")
+	})
+}
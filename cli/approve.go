@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	preemption "github.com/embano1/vsphere-preemption"
+)
+
+type approveConfig struct {
+	*wfConfig
+	scopeConfig
+	runID    string
+	approver string
+	reason   string
+	reject   bool
+}
+
+func NewApproveCommand(wfConfig *wfConfig) *cobra.Command {
+	cfg := &approveConfig{
+		wfConfig: wfConfig,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "approve",
+		Short: "Approve or reject a pending preemption",
+		Long: `Send an approval decision to a preemption workflow waiting for approval.
+Preemption requests with criticality MEDIUM require approval by a person other than the requester.
+
+The approver and requester identities are not verified, so this two-person rule is not an access
+control: anyone who can signal the workflow can approve under any name. Restrict who can signal
+the workflow with the authorization of the Temporal deployment.`,
+		Example: `# approve the pending preemption of the current workflow run
+preemptctl workflow approve --server temporal01.prod.corp.local:7233 --run-id 5d438391-281c-47d3-9e04-562c128195db
+
+# approve the pending preemption of the workflow for the specified cluster
+preemptctl workflow approve --server temporal01.prod.corp.local:7233 --cluster cluster01
+
+# reject the pending preemption and provide a reason
+preemptctl workflow approve --server temporal01.prod.corp.local:7233 --run-id 5d438391-281c-47d3-9e04-562c128195db --reject --reason "batch jobs must finish"
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validateApproveFlags(cfg)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return approvePreemption(cmd, cfg)
+		},
+	}
+
+	flags := cmd.PersistentFlags()
+	addScopeFlags(flags, &cfg.scopeConfig)
+	addWorkflowIDFlag(flags, &cfg.scopeConfig)
+	flags.StringVarP(&cfg.runID, "run-id", "r", "", "send decision to specified workflow run id (empty for current run)")
+	flags.StringVar(&cfg.approver, "approver", currentUser(), "identity of the approver recorded in the virtual machine annotation (not verified)")
+	flags.StringVar(&cfg.reason, "reason", "", "reason for the decision (optional)")
+	flags.BoolVar(&cfg.reject, "reject", false, "reject instead of approve the pending preemption")
+
+	return cmd
+}
+
+func validateApproveFlags(cfg *approveConfig) error {
+	return checkNotEmpty("approver", cfg.approver)
+}
+
+func approvePreemption(cmd *cobra.Command, cfg *approveConfig) error {
+	ctx, cancel := context.WithTimeout(cmd.Context(), rpcTimeout)
+	defer cancel()
+
+	logger, err := getLogger(cmd)
+	if err != nil {
+		return fmt.Errorf("create logger: %w", err)
+	}
+
+	logger = logger.With(
+		zap.String("address", cfg.address),
+		zap.String("namespace", cfg.namespace),
+		zap.String("queue", cfg.queue),
+	)
+
+	logger.Debug("creating temporal client")
+	tc, err := newTemporalClient(ctx, cfg.address, cfg.namespace, logger)
+	if err != nil {
+		return fmt.Errorf("create temporal client: %w", err)
+	}
+
+	decision := preemption.ApprovalResponse{
+		Decision: preemption.DecisionApprove,
+		Approver: cfg.approver,
+		Reason:   cfg.reason,
+	}
+	if cfg.reject {
+		decision.Decision = preemption.DecisionReject
+	}
+
+	wfID := cfg.id()
+	logger = logger.With(
+		zap.String("workflow", preemption.WorkflowName),
+		zap.String("workflowID", wfID),
+		zap.String("runID", cfg.runID),
+		zap.String("decision", string(decision.Decision)),
+		zap.String("approver", decision.Approver),
+	)
+
+	logger.Debug("sending approval decision")
+	err = tc.SignalWorkflow(ctx, wfID, cfg.runID, preemption.ApprovalSignalChannel, decision)
+	if err != nil {
+		return fmt.Errorf("signal workflow: %w", err)
+	}
+
+	logger.Info("successfully sent approval decision")
+	return nil
+}
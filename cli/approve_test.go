@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"io"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_NewApproveCommand(t *testing.T) {
+	t.Run("validate basic metadata", func(t *testing.T) {
+		cmd := NewApproveCommand(&wfConfig{})
+		cmd.SetOut(io.Discard)
+
+		// usage
+		assert.Equal(t, cmd.Name(), "approve")
+		assert.Check(t, len(cmd.Short) > 0, "command should have a nonempty short description")
+		assert.Check(t, len(cmd.Long) > 0, "command should have a nonempty long description")
+		assert.Check(t, len(cmd.Example) > 0, "command should have a nonempty example")
+
+		// flags
+		flags := []string{"tag", "vcenter", "cluster", "workflow-id", "run-id", "approver", "reason", "reject"}
+		checkFlag(t, cmd, flags)
+	})
+
+	t.Run("fails if approver is empty", func(t *testing.T) {
+		cmd := NewApproveCommand(&wfConfig{})
+		cmd.SetOut(io.Discard)
+
+		cmd.SetArgs([]string{"--approver", ""})
+		err := cmd.Execute()
+		assert.ErrorContains(t, err, "\"approver\" must not be empty")
+	})
+}
@@ -12,6 +12,7 @@ import (
 
 type cancelConfig struct {
 	*wfConfig
+	scopeConfig
 	runID string
 }
 
@@ -23,10 +24,16 @@ func NewCancelCommand(wfConfig *wfConfig) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "cancel",
 		Short: "Cancel preemption workflow",
-		Long:  `Cancel a running preemption workflow. Can be used with --runID to cancel a specific workflow run`,
-		Example: `# cancel the currently running preemption workflow (if any)
+		Long:  `Cancel a running preemption workflow. Can be used with --run-id to cancel a specific workflow run`,
+		Example: `# cancel the currently running preemption workflow of the default scope (if any)
 preemptctl workflow cancel --server temporal01.prod.corp.local:7233
 
+# cancel the preemption workflow of the specified vCenter, cluster and tag
+preemptctl workflow cancel --server temporal01.prod.corp.local:7233 --vcenter vcenter01.prod.corp.local --cluster cluster01 --tag preemptible
+
+# cancel the preemption workflow with the specified workflow id
+preemptctl workflow cancel --server temporal01.prod.corp.local:7233 --workflow-id "preemption/*/cluster01/preemptible"
+
 # cancel the specified preemption workflow run id
 preemptctl workflow cancel --server temporal01.prod.corp.local:7233 --run-id 5d438391-281c-47d3-9e04-562c128195db
 `,
@@ -36,6 +43,8 @@ preemptctl workflow cancel --server temporal01.prod.corp.local:7233 --run-id 5d4
 	}
 
 	flags := cmd.PersistentFlags()
+	addScopeFlags(flags, &cfg.scopeConfig)
+	addWorkflowIDFlag(flags, &cfg.scopeConfig)
 	flags.StringVarP(&cfg.runID, "run-id", "r", "", "cancel preemption for specified workflow run id (empty for current run)")
 
 	return cmd
@@ -62,6 +71,7 @@ func cancelPreemption(cmd *cobra.Command, cfg *cancelConfig) error {
 		return fmt.Errorf("create temporal client: %w", err)
 	}
 
+	wfID := cfg.id()
 	logger = logger.With(
 		zap.String("workflow", preemption.WorkflowName),
 		zap.String("workflowID", wfID),
@@ -19,7 +19,7 @@ func Test_NewCancelCommand(t *testing.T) {
 		assert.Check(t, len(cmd.Example) > 0, "command should have a nonempty example")
 
 		// flags
-		flags := []string{"run-id"}
+		flags := []string{"tag", "vcenter", "cluster", "workflow-id", "run-id"}
 		checkFlag(t, cmd, flags)
 
 		err := cmd.Execute()
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	preemption "github.com/embano1/vsphere-preemption"
+)
+
+type eventsConfig struct {
+	*wfConfig
+	scopeConfig
+	runID     string
+	pending   bool
+	redeliver bool
+	ids       []string
+}
+
+func NewEventsCommand(wfConfig *wfConfig) *cobra.Command {
+	cfg := &eventsConfig{
+		wfConfig: wfConfig,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "events",
+		Short: "Inspect and redeliver events of a preemption workflow",
+		Long: `Retrieve the event delivery status of the last workflow run, list events which could not be delivered to a sink or redeliver them.
+Undelivered events are kept in the workflow and redelivered with an increasing interval until they are delivered or expire.`,
+		Example: `# retrieve the event delivery status of the last run of the workflow for the specified cluster
+preemptctl workflow events --cluster cluster01
+
+# list events waiting for redelivery
+preemptctl workflow events --cluster cluster01 --pending
+
+# redeliver all pending events immediately
+preemptctl workflow events --cluster cluster01 --redeliver
+
+# redeliver the specified pending events immediately
+preemptctl workflow events --cluster cluster01 --redeliver --id 1 --id 3
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validateEventsFlags(cfg)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return getEvents(cmd, cfg)
+		},
+	}
+
+	flags := cmd.PersistentFlags()
+	addScopeFlags(flags, &cfg.scopeConfig)
+	addWorkflowIDFlag(flags, &cfg.scopeConfig)
+	flags.StringVarP(&cfg.runID, "run-id", "r", "", "use specified workflow run id (empty for current run)")
+	flags.BoolVar(&cfg.pending, "pending", false, "list undelivered events waiting for redelivery")
+	flags.BoolVar(&cfg.redeliver, "redeliver", false, "redeliver pending events immediately")
+	flags.StringSliceVar(&cfg.ids, "id", nil, "pending event id to redeliver (all pending events if not set)")
+
+	return cmd
+}
+
+func validateEventsFlags(cfg *eventsConfig) error {
+	if cfg.pending && cfg.redeliver {
+		return fmt.Errorf("flags \"pending\" and \"redeliver\" are mutually exclusive")
+	}
+
+	if len(cfg.ids) > 0 && !cfg.redeliver {
+		return fmt.Errorf("flag \"id\" requires flag \"redeliver\"")
+	}
+
+	return nil
+}
+
+func getEvents(cmd *cobra.Command, cfg *eventsConfig) error {
+	ctx, cancel := context.WithTimeout(cmd.Context(), rpcTimeout)
+	defer cancel()
+
+	logger, err := getLogger(cmd)
+	if err != nil {
+		return fmt.Errorf("create logger: %w", err)
+	}
+
+	logger = logger.With(
+		zap.String("address", cfg.address),
+		zap.String("namespace", cfg.namespace),
+		zap.String("queue", cfg.queue),
+	)
+
+	logger.Debug("creating temporal client")
+	tc, err := newTemporalClient(ctx, cfg.address, cfg.namespace, logger)
+	if err != nil {
+		return fmt.Errorf("create temporal client: %w", err)
+	}
+
+	wfID := cfg.id()
+	logger = logger.With(
+		zap.String("workflow", preemption.WorkflowName),
+		zap.String("workflowID", wfID),
+		zap.String("runID", cfg.runID),
+	)
+
+	switch {
+	case cfg.redeliver:
+		logger.Debug("sending redelivery request", zap.Strings("ids", cfg.ids))
+		req := preemption.RedeliverRequest{IDs: cfg.ids}
+		if err = tc.SignalWorkflow(ctx, wfID, cfg.runID, preemption.RedeliverSignalChannel, req); err != nil {
+			return fmt.Errorf("signal workflow: %w", err)
+		}
+		logger.Info("successfully sent redelivery request")
+
+	case cfg.pending:
+		logger.Debug("sending pending events query", zap.String("queryType", preemption.PendingEventsQueryType))
+		res, err := tc.QueryWorkflow(ctx, wfID, cfg.runID, preemption.PendingEventsQueryType)
+		if err != nil {
+			return fmt.Errorf("query workflow: %w", err)
+		}
+
+		var events []preemption.PendingEvent
+		if err = res.Get(&events); err != nil {
+			return fmt.Errorf("decode query result: %w", err)
+		}
+		logger.Info("retrieved pending events", zap.Int("count", len(events)), zap.Any("events", events))
+
+	default:
+		logger.Debug("sending workflow status query", zap.String("queryType", preemption.WorkFlowQueryType))
+		res, err := tc.QueryWorkflow(ctx, wfID, cfg.runID, preemption.WorkFlowQueryType)
+		if err != nil {
+			return fmt.Errorf("query workflow: %w", err)
+		}
+
+		var state string
+		if err = res.Get(&state); err != nil {
+			return fmt.Errorf("decode query result: %w", err)
+		}
+
+		var status preemption.WorkflowResponse
+		if err = json.Unmarshal([]byte(state), &status); err != nil {
+			return fmt.Errorf("decode workflow status: %w", err)
+		}
+		logger.Info("retrieved event deliveries",
+			zap.Any("deliveries", status.Deliveries),
+			zap.Int("pendingEvents", status.PendingEvents),
+			zap.Int("droppedEvents", status.DroppedEvents),
+		)
+	}
+
+	return nil
+}
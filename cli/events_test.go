@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"io"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_NewEventsCommand(t *testing.T) {
+	t.Run("validate basic metadata", func(t *testing.T) {
+		cmd := NewEventsCommand(&wfConfig{})
+		cmd.SetOut(io.Discard)
+
+		// usage
+		assert.Equal(t, cmd.Name(), "events")
+		assert.Check(t, len(cmd.Short) > 0, "command should have a nonempty short description")
+		assert.Check(t, len(cmd.Long) > 0, "command should have a nonempty long description")
+		assert.Check(t, len(cmd.Example) > 0, "command should have a nonempty example")
+
+		// flags
+		flags := []string{"tag", "vcenter", "cluster", "workflow-id", "run-id", "pending", "redeliver", "id"}
+		checkFlag(t, cmd, flags)
+	})
+
+	t.Run("fails for invalid flag combinations", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			args    []string
+			wantErr string
+		}{
+			{name: "pending and redeliver", args: []string{"--pending", "--redeliver"}, wantErr: "mutually exclusive"},
+			{name: "id without redeliver", args: []string{"--id", "1"}, wantErr: "requires flag \"redeliver\""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				cmd := NewEventsCommand(&wfConfig{})
+				cmd.SetOut(io.Discard)
+
+				cmd.SetArgs(tt.args)
+				err := cmd.Execute()
+				assert.ErrorContains(t, err, tt.wantErr)
+			})
+		}
+	})
+}
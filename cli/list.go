@@ -0,0 +1,112 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.temporal.io/api/filter/v1"
+	"go.temporal.io/api/workflowservice/v1"
+	"go.uber.org/zap"
+
+	preemption "github.com/embano1/vsphere-preemption"
+)
+
+type listConfig struct {
+	*wfConfig
+}
+
+func NewListCommand(wfConfig *wfConfig) *cobra.Command {
+	cfg := &listConfig{
+		wfConfig: wfConfig,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List running preemption workflows",
+		Long: `List running preemption workflows and their scope (vCenter, cluster and tag).
+Workflows started by earlier releases with the fixed workflow id "preempctl-run"
+are flagged and must be cancelled with --workflow-id preempctl-run.`,
+		Example: `# list running preemption workflows
+preemptctl workflow list --server temporal01.prod.corp.local:7233
+`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listWorkflows(cmd, cfg)
+		},
+	}
+
+	return cmd
+}
+
+func listWorkflows(cmd *cobra.Command, cfg *listConfig) error {
+	ctx, cancel := context.WithTimeout(cmd.Context(), rpcTimeout)
+	defer cancel()
+
+	logger, err := getLogger(cmd)
+	if err != nil {
+		return fmt.Errorf("create logger: %w", err)
+	}
+
+	logger = logger.With(
+		zap.String("address", cfg.address),
+		zap.String("namespace", cfg.namespace),
+		zap.String("queue", cfg.queue),
+	)
+
+	logger.Debug("creating temporal client")
+	tc, err := newTemporalClient(ctx, cfg.address, cfg.namespace, logger)
+	if err != nil {
+		return fmt.Errorf("create temporal client: %w", err)
+	}
+
+	logger = logger.With(zap.String("workflow", preemption.WorkflowName))
+
+	req := workflowservice.ListOpenWorkflowExecutionsRequest{
+		Namespace: cfg.namespace,
+		Filters: &workflowservice.ListOpenWorkflowExecutionsRequest_TypeFilter{
+			TypeFilter: &filter.WorkflowTypeFilter{Name: preemption.WorkflowName},
+		},
+	}
+
+	logger.Debug("listing open workflows")
+	for {
+		res, err := tc.ListOpenWorkflow(ctx, &req)
+		if err != nil {
+			return fmt.Errorf("list workflows: %w", err)
+		}
+
+		for _, wf := range res.GetExecutions() {
+			fields := []zap.Field{
+				zap.String("workflowID", wf.GetExecution().GetWorkflowId()),
+				zap.String("runID", wf.GetExecution().GetRunId()),
+			}
+
+			if start := wf.GetStartTime(); start != nil {
+				fields = append(fields, zap.Time("started", *start))
+			}
+
+			if wf.GetExecution().GetWorkflowId() == legacyWorkflowID {
+				logger.Warn("running workflow started by earlier release: cancel with --workflow-id "+legacyWorkflowID, fields...)
+				continue
+			}
+
+			// workflows started with other ids, e.g. by external actors, have no scope
+			if scope, err := preemption.ParseScope(wf.GetExecution().GetWorkflowId()); err == nil {
+				fields = append(fields,
+					zap.String("vcenter", scope.VCenter),
+					zap.String("cluster", scope.Cluster),
+					zap.String("tag", scope.Tag),
+				)
+			}
+
+			logger.Info("running workflow", fields...)
+		}
+
+		if len(res.GetNextPageToken()) == 0 {
+			break
+		}
+		req.NextPageToken = res.GetNextPageToken()
+	}
+
+	return nil
+}
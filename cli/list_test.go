@@ -0,0 +1,21 @@
+package cli
+
+import (
+	"io"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_NewListCommand(t *testing.T) {
+	t.Run("validate basic metadata", func(t *testing.T) {
+		cmd := NewListCommand(&wfConfig{})
+		cmd.SetOut(io.Discard)
+
+		// usage
+		assert.Equal(t, cmd.Name(), "list")
+		assert.Check(t, len(cmd.Short) > 0, "command should have a nonempty short description")
+		assert.Check(t, len(cmd.Long) > 0, "command should have a nonempty long description")
+		assert.Check(t, len(cmd.Example) > 0, "command should have a nonempty example")
+	})
+}
@@ -9,6 +9,7 @@ import (
 	ce "github.com/cloudevents/sdk-go/v2"
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
+	"github.com/vmware/govmomi/vim25/types"
 	sdk "go.temporal.io/sdk/client"
 	"go.uber.org/zap"
 
@@ -16,17 +17,45 @@ import (
 )
 
 const (
-	wfID               = "preempctl-run"
-	eventType          = "PreempctlRunEvent"
-	wfExecutionTimeout = time.Minute * 5
+	eventSource = "preemptctl"
+	eventType   = "PreempctlRunEvent"
 )
 
 type runConfig struct {
 	*wfConfig
-	tag         string
-	criticality string
-	replyTo     string
-	event       string
+	scopeConfig
+	criticality     string
+	replyTo         string
+	sinks           []string
+	eventExpiry     time.Duration
+	event           string
+	requestedBy     string
+	traceParent     string
+	traceState      string
+	approvalTimeout time.Duration
+	execTimeout     time.Duration
+	approvalDefault string
+	vetoHook        string
+	vetoPolicy      string
+	searchAttrs     bool
+	admit           string
+	admissionBudget int
+	evacuate        string
+	maintenanceMode bool
+	datastore       string
+	action          string
+	disableHA       bool
+	restore         bool
+	enforce         string
+	rebalance       string
+	migrateCluster  string
+	migrateGroup    string
+	migrateTimeout  time.Duration
+	drainCommand    string
+	drainTimeout    time.Duration
+	drainPolicy     string
+	markerCategory  string
+	annotatePolicy  string
 }
 
 func NewRunCommand(wfConfig *wfConfig) *cobra.Command {
@@ -38,14 +67,54 @@ func NewRunCommand(wfConfig *wfConfig) *cobra.Command {
 		Use:   "run",
 		Short: "Run preemption workflow",
 		Long: `Send a signal to a preemption worker to trigger a preemption workflow. 
-If the workflow is not running, it will be started.`,
+If the workflow is not running, it will be started. 
+Each scope (vCenter, cluster and tag) is served by its own workflow.`,
 		Example: `# trigger preemption on a custom Temporal server with run default workflow values
 preemptctl workflow run --server temporal01.prod.corp.local:7233
 
+# trigger preemption only for virtual machines in the specified vCenter and cluster
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --vcenter vcenter01.prod.corp.local --cluster cluster01
+
 # trigger preemption with a custom cloudevent provided to the workflow and request a reply to a specified broker
 preemptctl workflow run --server temporal01.prod.corp.local:7233 --event \
 '{"data":{"threshold":70,"current":87},"datacontenttype":"application/json","id":"757098cc-b275-41b6-ab52-f2966f9d714c","source":"preemptctl","specversion":"1.0","time":"2021-11-24T20:26:00.98041Z","type":"ThresholdExceededEvent"}' \
 --reply-to https://broker.corp.local
+
+# trigger preemption requiring approval which is rejected if not approved within 30 minutes
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality MEDIUM --approval-timeout 30m --approval-default REJECT
+
+# trigger preemption and fail the run if a veto hook cannot be reached
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --veto-hook https://veto.corp.local --veto-failure-policy CLOSED
+
+# preempt just enough virtual machines in the cluster of virtual machine vm-42 to power it on, preempting at most 5 virtual machines
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --admit vm-42 --admission-budget 5
+
+# preempt all preemptible virtual machines on host esx01.prod.corp.local and put the host into maintenance mode
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --evacuate esx01.prod.corp.local --maintenance-mode
+
+# suspend preemptible virtual machines with files on datastore ds01, largest snapshot and swap files first
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --datastore ds01 --action SUSPEND
+
+# preempt virtual machines and prevent vSphere HA from restarting them until restored
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --disable-ha-restart
+
+# preempt virtual machines and power them off again when they are powered on until the workflow is cancelled or restored
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --enforce REPREEMPT
+
+# preempt virtual machines and apply DRS recommendations for the affected clusters afterwards
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --rebalance APPLY
+
+# migrate preemptible virtual machines to an overflow cluster and only preempt those which cannot be migrated
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality HIGH --migrate-cluster overflow-cluster-01
+
+# run a drain script in preemptible virtual machines before shutting them down gracefully
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --criticality LOW --drain-command app-drain --drain-failure-policy FORCE
+
+# power on preempted virtual machines and restore their vSphere HA restart priority
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --restore
+
+# trigger preemption and index the workflow with custom search attributes
+preemptctl workflow run --server temporal01.prod.corp.local:7233 --search-attributes
 `,
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			return validateRunFlags(cfg)
@@ -56,10 +125,39 @@ preemptctl workflow run --server temporal01.prod.corp.local:7233 --event \
 	}
 
 	flags := cmd.PersistentFlags()
-	flags.StringVarP(&cfg.tag, "tag", "t", "preemptible", "vSphere tag to use to identify preemptible virtual machines")
+	addScopeFlags(flags, &cfg.scopeConfig)
 	flags.StringVarP(&cfg.criticality, "criticality", "c", string(preemption.CriticalityLow), "criticality of the workflow request (LOW, MEDIUM, HIGH)")
 	flags.StringVarP(&cfg.event, "event", "e", "", "custom CloudEvent JSON string provided in workflow request (optional)")
 	flags.StringVar(&cfg.replyTo, "reply-to", "", "send preemption event to this address after workflow completion (optional)")
+	flags.StringArrayVar(&cfg.sinks, "sink", nil, "send workflow events to this sink URL or JSON sink configuration in addition to --reply-to, e.g. https://broker.local, file:///var/log/preemption.jsonl, stdout:// or '{\"url\":\"https://broker.local\",\"auth\":{\"bearerTokenFile\":\"token\"}}' (optional, repeatable)")
+	flags.StringVar(&cfg.requestedBy, "requested-by", currentUser(), "identity of the requester (must not approve its own MEDIUM criticality request, not verified)")
+	flags.StringVar(&cfg.traceParent, "traceparent", "", "W3C traceparent continued by the events of the workflow run, defaults to the traceparent extension of --event (optional)")
+	flags.StringVar(&cfg.traceState, "tracestate", "", "W3C tracestate sent with --traceparent (optional)")
+	flags.DurationVar(&cfg.eventExpiry, "event-expiry", preemption.DefaultEventExpiry, "time to keep redelivering events which could not be delivered to a sink")
+	flags.DurationVar(&cfg.approvalTimeout, "approval-timeout", preemption.DefaultApprovalTimeout, "time to wait for approval of MEDIUM criticality requests")
+	flags.DurationVar(&cfg.execTimeout, "execution-timeout", 0, "terminate a newly started workflow after this time, must be longer than --approval-timeout (default 0 runs until cancelled)")
+	flags.StringVar(&cfg.approvalDefault, "approval-default", string(preemption.DefaultApprovalDecision), "decision applied when approval times out (APPROVE, REJECT)")
+	flags.StringVar(&cfg.vetoHook, "veto-hook", "", "CloudEvents endpoint called before preemption in addition to the hook configured on the worker (optional)")
+	flags.BoolVar(&cfg.searchAttrs, "search-attributes", false, "set custom search attributes on the workflow (must be registered in the Temporal cluster)")
+	flags.StringVar(&cfg.vetoPolicy, "veto-failure-policy", string(preemption.VetoFailOpen), "continue (OPEN) or fail (CLOSED) the run without preemption if a veto hook fails")
+	flags.StringVar(&cfg.admit, "admit", "", "managed object ID of a virtual machine to power on by preempting virtual machines in its cluster, e.g. vm-42 (optional)")
+	flags.IntVar(&cfg.admissionBudget, "admission-budget", preemption.DefaultAdmissionBudget, "maximum number of virtual machines to preempt for admission")
+	flags.StringVar(&cfg.evacuate, "evacuate", "", "name of a host to evacuate by preempting the virtual machines running on it (optional)")
+	flags.BoolVar(&cfg.maintenanceMode, "maintenance-mode", false, "put the evacuated host into maintenance mode after preemption")
+	flags.StringVar(&cfg.datastore, "datastore", "", "only preempt virtual machines with files on this datastore, defaults to the datastore of an alarm event (optional)")
+	flags.BoolVar(&cfg.disableHA, "disable-ha-restart", false, "disable vSphere HA restart of preempted virtual machines until restored")
+	flags.BoolVar(&cfg.restore, "restore", false, "power on preempted virtual machines and restore their vSphere HA restart priority")
+	flags.StringVar(&cfg.enforce, "enforce", "", "preempt again (REPREEMPT) or only record (LOG) power on of preempted virtual machines until cancelled or restored (optional)")
+	flags.StringVar(&cfg.rebalance, "rebalance", "", "apply (APPLY) or only record (RECORD) DRS recommendations for the clusters of the preempted virtual machines (optional)")
+	flags.StringVar(&cfg.migrateCluster, "migrate-cluster", "", "migrate preemptible virtual machines to this overflow cluster and only preempt those which cannot be migrated (optional)")
+	flags.StringVar(&cfg.migrateGroup, "migrate-host-group", "", "only migrate to hosts in this DRS host group of the overflow cluster (optional)")
+	flags.DurationVar(&cfg.migrateTimeout, "migration-timeout", preemption.DefaultMigrationTimeout, "time to wait for the migration of a virtual machine before preempting it")
+	flags.StringVar(&cfg.drainCommand, "drain-command", "", "name of a command configured on the worker, run in preemptible virtual machines before graceful shutdown (optional)")
+	flags.DurationVar(&cfg.drainTimeout, "drain-timeout", preemption.DefaultDrainTimeout, "time to wait for the drain command to exit")
+	flags.StringVar(&cfg.drainPolicy, "drain-failure-policy", string(preemption.DrainFailSkip), "do not preempt (SKIP) or preempt (FORCE) virtual machines if the drain command fails")
+	flags.StringVar(&cfg.annotatePolicy, "annotation-failure-policy", string(preemption.AnnotationFailPartial), "report the run as partially succeeded (PARTIAL) or failed (FAIL) if virtual machines cannot be annotated")
+	flags.StringVar(&cfg.markerCategory, "marker-category", "", "tag category of the \""+preemption.PreemptedTag+"\" tag attached to preempted virtual machines until restored (optional)")
+	flags.StringVar(&cfg.action, "action", string(preemption.ActionPowerOff), "stop preemptible virtual machines by powering them off or suspending them (POWER_OFF, SUSPEND)")
 
 	return cmd
 }
@@ -86,6 +184,118 @@ func validateRunFlags(cfg *runConfig) error {
 	}
 	cfg.criticality = critUpper
 
+	if cfg.approvalTimeout <= 0 {
+		return fmt.Errorf("approval timeout %q invalid (must be greater than 0)", cfg.approvalTimeout)
+	}
+
+	if cfg.execTimeout < 0 {
+		return fmt.Errorf("execution timeout %q invalid (must not be negative)", cfg.execTimeout)
+	}
+
+	if cfg.execTimeout > 0 && cfg.approvalTimeout >= cfg.execTimeout {
+		return fmt.Errorf("approval timeout %q invalid (must be shorter than execution timeout %q)", cfg.approvalTimeout, cfg.execTimeout)
+	}
+
+	if cfg.eventExpiry <= 0 {
+		return fmt.Errorf("event expiry %q invalid (must be greater than 0)", cfg.eventExpiry)
+	}
+
+	decision := preemption.Decision(strings.ToUpper(cfg.approvalDefault))
+	if decision != preemption.DecisionApprove && decision != preemption.DecisionReject {
+		return fmt.Errorf("approval default %q invalid (valid: APPROVE, REJECT)", cfg.approvalDefault)
+	}
+	cfg.approvalDefault = string(decision)
+
+	policy := preemption.VetoFailurePolicy(strings.ToUpper(cfg.vetoPolicy))
+	if policy != preemption.VetoFailOpen && policy != preemption.VetoFailClosed {
+		return fmt.Errorf("veto failure policy %q invalid (valid: OPEN, CLOSED)", cfg.vetoPolicy)
+	}
+	cfg.vetoPolicy = string(policy)
+
+	if cfg.admissionBudget <= 0 {
+		return fmt.Errorf("admission budget %d invalid (must be greater than 0)", cfg.admissionBudget)
+	}
+
+	if cfg.admit != "" && cfg.evacuate != "" {
+		return fmt.Errorf("flags \"admit\" and \"evacuate\" are mutually exclusive")
+	}
+
+	if cfg.restore && (cfg.admit != "" || cfg.evacuate != "") {
+		return fmt.Errorf("flag \"restore\" cannot be combined with flags \"admit\" or \"evacuate\"")
+	}
+
+	if cfg.maintenanceMode && cfg.evacuate == "" {
+		return fmt.Errorf("flag \"maintenance-mode\" requires flag \"evacuate\"")
+	}
+
+	action := preemption.PreemptAction(strings.ToUpper(cfg.action))
+	if action != preemption.ActionPowerOff && action != preemption.ActionSuspend {
+		return fmt.Errorf("action %q invalid (valid: POWER_OFF, SUSPEND)", cfg.action)
+	}
+	cfg.action = string(action)
+
+	if cfg.enforce != "" {
+		mode := preemption.EnforcementMode(strings.ToUpper(cfg.enforce))
+		if mode != preemption.EnforcementRepreempt && mode != preemption.EnforcementLog {
+			return fmt.Errorf("enforcement mode %q invalid (valid: REPREEMPT, LOG)", cfg.enforce)
+		}
+		cfg.enforce = string(mode)
+	}
+
+	if cfg.rebalance != "" {
+		mode := preemption.RebalanceMode(strings.ToUpper(cfg.rebalance))
+		if mode != preemption.RebalanceApply && mode != preemption.RebalanceRecord {
+			return fmt.Errorf("rebalance mode %q invalid (valid: APPLY, RECORD)", cfg.rebalance)
+		}
+		cfg.rebalance = string(mode)
+	}
+
+	if cfg.migrateCluster != "" && (cfg.admit != "" || cfg.restore) {
+		return fmt.Errorf("flag \"migrate-cluster\" cannot be combined with flags \"admit\" or \"restore\"")
+	}
+
+	if cfg.traceState != "" && cfg.traceParent == "" {
+		return fmt.Errorf("flag \"tracestate\" requires flag \"traceparent\"")
+	}
+
+	if cfg.migrateGroup != "" && cfg.migrateCluster == "" {
+		return fmt.Errorf("flag \"migrate-host-group\" requires flag \"migrate-cluster\"")
+	}
+
+	if cfg.migrateTimeout <= 0 {
+		return fmt.Errorf("migration timeout %q invalid (must be greater than 0)", cfg.migrateTimeout)
+	}
+
+	if cfg.drainCommand != "" && (cfg.admit != "" || cfg.restore) {
+		return fmt.Errorf("flag \"drain-command\" cannot be combined with flags \"admit\" or \"restore\"")
+	}
+
+	if strings.ContainsAny(cfg.drainCommand, "/\\ ") {
+		return fmt.Errorf("drain command %q invalid (must be the name of a command configured on the worker)", cfg.drainCommand)
+	}
+
+	if cfg.drainTimeout <= 0 {
+		return fmt.Errorf("drain timeout %q invalid (must be greater than 0)", cfg.drainTimeout)
+	}
+
+	drainPolicy := preemption.DrainFailurePolicy(strings.ToUpper(cfg.drainPolicy))
+	if drainPolicy != preemption.DrainFailSkip && drainPolicy != preemption.DrainFailForce {
+		return fmt.Errorf("drain failure policy %q invalid (valid: SKIP, FORCE)", cfg.drainPolicy)
+	}
+	cfg.drainPolicy = string(drainPolicy)
+
+	annotatePolicy := preemption.AnnotationFailurePolicy(strings.ToUpper(cfg.annotatePolicy))
+	if annotatePolicy != preemption.AnnotationFailPartial && annotatePolicy != preemption.AnnotationFailRun {
+		return fmt.Errorf("annotation failure policy %q invalid (valid: PARTIAL, FAIL)", cfg.annotatePolicy)
+	}
+	cfg.annotatePolicy = string(annotatePolicy)
+
+	for _, sink := range cfg.sinks {
+		if _, err := parseSink(sink); err != nil {
+			return err
+		}
+	}
+
 	if cfg.event != "" {
 		_, err := parseJsonEvent(cfg.event)
 		if err != nil {
@@ -117,6 +327,7 @@ func runPreemption(cmd *cobra.Command, cfg *runConfig) error {
 		return fmt.Errorf("create temporal client: %w", err)
 	}
 
+	wfID := cfg.id()
 	logger = logger.With(
 		zap.String("workflow", preemption.WorkflowName),
 		zap.String("workflowID", wfID),
@@ -131,7 +342,7 @@ func runPreemption(cmd *cobra.Command, cfg *runConfig) error {
 	} else {
 		logger.Debug("no input event specified, creating default cloudevent")
 		e = ce.NewEvent()
-		e.SetSource(wfID)
+		e.SetSource(eventSource)
 		e.SetID(uuid.New().String())
 		e.SetType(eventType)
 		e.SetTime(cfg.clock.Now().UTC())
@@ -139,27 +350,115 @@ func runPreemption(cmd *cobra.Command, cfg *runConfig) error {
 
 	req := preemption.WorkflowRequest{
 		Tag:         cfg.tag,
+		VCenter:     cfg.vcenter,
+		Cluster:     cfg.cluster,
+		Datastore:   cfg.datastore,
 		Event:       e,
 		Criticality: preemption.Criticality(cfg.criticality),
+		Action:      preemption.PreemptAction(cfg.action),
 		ReplyTo:     cfg.replyTo,
+		RequestedBy: cfg.requestedBy,
+		TraceParent: cfg.traceParent,
+		TraceState:  cfg.traceState,
+		EventExpiry: cfg.eventExpiry,
+
+		ApprovalTimeout: cfg.approvalTimeout,
+		ApprovalDefault: preemption.Decision(cfg.approvalDefault),
+
+		VetoHook:          cfg.vetoHook,
+		VetoFailurePolicy: preemption.VetoFailurePolicy(cfg.vetoPolicy),
+
+		AnnotationFailurePolicy: preemption.AnnotationFailurePolicy(cfg.annotatePolicy),
+		MarkerCategory:          cfg.markerCategory,
+		DisableHARestart:        cfg.disableHA,
+		Enforcement:             preemption.EnforcementMode(cfg.enforce),
+		Rebalance:               preemption.RebalanceMode(cfg.rebalance),
 	}
 
+	for _, sink := range cfg.sinks {
+		s, err := parseSink(sink)
+		if err != nil {
+			return err
+		}
+		req.Sinks = append(req.Sinks, s)
+	}
+
+	if cfg.migrateCluster != "" {
+		req.Migrate = &preemption.MigrationTarget{
+			Cluster:   cfg.migrateCluster,
+			HostGroup: cfg.migrateGroup,
+			Timeout:   cfg.migrateTimeout,
+		}
+	}
+
+	if cfg.drainCommand != "" {
+		req.Drain = &preemption.DrainSettings{
+			Command:       cfg.drainCommand,
+			Timeout:       cfg.drainTimeout,
+			FailurePolicy: preemption.DrainFailurePolicy(cfg.drainPolicy),
+		}
+	}
+
+	if cfg.admit != "" {
+		req.Type = preemption.RequestTypeAdmit
+		req.Target = &types.ManagedObjectReference{Type: "VirtualMachine", Value: cfg.admit}
+		req.AdmissionBudget = cfg.admissionBudget
+	}
+
+	if cfg.evacuate != "" {
+		req.Type = preemption.RequestTypeEvacuate
+		req.Host = cfg.evacuate
+		req.MaintenanceMode = cfg.maintenanceMode
+	}
+
+	if cfg.restore {
+		req.Type = preemption.RequestTypeRestore
+	}
+
+	// the workflow handles signals until cancelled, i.e. no execution timeout
+	// unless requested, which would end pending approvals, enforcement and
+	// event redelivery
 	options := sdk.StartWorkflowOptions{
 		ID:                       wfID,
 		TaskQueue:                cfg.queue,
-		WorkflowExecutionTimeout: wfExecutionTimeout,
+		WorkflowExecutionTimeout: cfg.execTimeout,
 		// WorkflowIDReusePolicy:
 		// enums.WORKFLOW_ID_REUSE_POLICY_REJECT_DUPLICATE, // multiple
 		// executions handled in workflow
 		WorkflowExecutionErrorWhenAlreadyStarted: false,
+		Memo: map[string]interface{}{
+			preemption.MemoScope: cfg.scope(),
+		},
+	}
+
+	if cfg.searchAttrs {
+		// only used when the workflow is started, updated by the workflow after each run
+		options.SearchAttributes = map[string]interface{}{
+			preemption.SearchAttributeTag:            cfg.tag,
+			preemption.SearchAttributeCriticality:    cfg.criticality,
+			preemption.SearchAttributeVCenter:        cfg.vcenter,
+			preemption.SearchAttributePreemptedCount: 0,
+		}
 	}
 
 	// fire and forget
 	logger.Info(
 		"executing workflow",
 		zap.String("tag", cfg.tag),
+		zap.String("vcenter", cfg.vcenter),
+		zap.String("cluster", cfg.cluster),
 		zap.String("criticality", cfg.criticality),
 		zap.String("replyto", cfg.replyTo),
+		zap.String("admit", cfg.admit),
+		zap.String("evacuate", cfg.evacuate),
+		zap.String("datastore", cfg.datastore),
+		zap.String("action", cfg.action),
+		zap.Bool("restore", cfg.restore),
+		zap.String("enforce", cfg.enforce),
+		zap.String("rebalance", cfg.rebalance),
+		zap.String("migrateCluster", cfg.migrateCluster),
+		zap.String("drainCommand", cfg.drainCommand),
+		zap.String("markerCategory", cfg.markerCategory),
 	)
 
 	// wfID is used as the workflow name in the signal and a new workflow is started
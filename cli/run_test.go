@@ -24,7 +24,7 @@ func Test_NewRunCommand(t *testing.T) {
 		assert.Check(t, len(cmd.Example) > 0, "command should have a nonempty example")
 
 		// flags
-		flags := []string{"tag", "criticality", "event", "reply-to"}
+		flags := []string{"tag", "vcenter", "cluster", "criticality", "event", "reply-to", "requested-by", "approval-timeout", "approval-default", "veto-hook", "veto-failure-policy", "search-attributes", "admit", "admission-budget", "evacuate", "maintenance-mode", "datastore", "action", "disable-ha-restart", "restore", "enforce", "rebalance", "migrate-cluster", "migrate-host-group", "migration-timeout", "drain-command", "drain-timeout", "drain-failure-policy", "marker-category", "annotation-failure-policy", "sink", "event-expiry", "traceparent", "tracestate", "execution-timeout"}
 		checkFlag(t, cmd, flags)
 
 		err := cmd.Execute()
@@ -49,6 +49,111 @@ func Test_NewRunCommand(t *testing.T) {
 		cmd.SetArgs([]string{"--criticality", "notvalid"})
 		err = cmd.Execute()
 		assert.ErrorContains(t, err, "criticality \"notvalid\" invalid")
+
+		// approval timeout not shorter than execution timeout
+		cmd.SetArgs([]string{"--criticality", "MEDIUM", "--execution-timeout", "10m"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "must be shorter than execution timeout")
+
+		// invalid approval default
+		cmd.SetArgs([]string{"--execution-timeout", "0s", "--approval-default", "maybe"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "approval default \"maybe\" invalid")
+
+		// invalid veto failure policy
+		cmd.SetArgs([]string{"--approval-default", "REJECT", "--veto-failure-policy", "ajar"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "veto failure policy \"ajar\" invalid")
+
+		// invalid admission budget
+		cmd.SetArgs([]string{"--veto-failure-policy", "OPEN", "--admit", "vm-42", "--admission-budget", "0"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "admission budget 0 invalid")
+
+		// admission and evacuation
+		cmd.SetArgs([]string{"--admission-budget", "1", "--evacuate", "esx01"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "mutually exclusive")
+
+		// restore and evacuation
+		cmd.SetArgs([]string{"--admit", "", "--restore"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "flag \"restore\" cannot be combined")
+
+		// maintenance mode without evacuation
+		cmd.SetArgs([]string{"--admit", "", "--evacuate", "", "--restore=false", "--maintenance-mode"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "requires flag \"evacuate\"")
+
+		// invalid action
+		cmd.SetArgs([]string{"--maintenance-mode=false", "--action", "hibernate"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "action \"hibernate\" invalid")
+
+		// invalid enforcement mode
+		cmd.SetArgs([]string{"--action", "SUSPEND", "--enforce", "always"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "enforcement mode \"always\" invalid")
+
+		// invalid rebalance mode
+		cmd.SetArgs([]string{"--enforce", "LOG", "--rebalance", "now"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "rebalance mode \"now\" invalid")
+
+		// migration and admission
+		cmd.SetArgs([]string{"--rebalance", "APPLY", "--admit", "vm-42", "--migrate-cluster", "overflow"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "flag \"migrate-cluster\" cannot be combined")
+
+		// host group without migration cluster
+		cmd.SetArgs([]string{"--admit", "", "--migrate-cluster", "", "--migrate-host-group", "overflow-hosts"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "requires flag \"migrate-cluster\"")
+
+		// invalid migration timeout
+		cmd.SetArgs([]string{"--migrate-host-group", "", "--migration-timeout", "0s"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "migration timeout \"0s\" invalid")
+
+		// drain and restore
+		cmd.SetArgs([]string{"--migration-timeout", "1m", "--restore", "--drain-command", "app-drain"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "flag \"drain-command\" cannot be combined")
+
+		// drain command path instead of name
+		cmd.SetArgs([]string{"--restore=false", "--drain-command", "/opt/drain.sh"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "drain command \"/opt/drain.sh\" invalid")
+
+		// invalid drain timeout
+		cmd.SetArgs([]string{"--drain-command", "app-drain", "--drain-timeout", "0s"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "drain timeout \"0s\" invalid")
+
+		// invalid drain failure policy
+		cmd.SetArgs([]string{"--drain-timeout", "1m", "--drain-failure-policy", "retry"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "drain failure policy \"retry\" invalid")
+
+		// invalid annotation failure policy
+		cmd.SetArgs([]string{"--drain-failure-policy", "FORCE", "--annotation-failure-policy", "ignore"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "annotation failure policy \"ignore\" invalid")
+
+		// invalid sink
+		cmd.SetArgs([]string{"--annotation-failure-policy", "PARTIAL", "--sink", "broker.local"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "sink \"broker.local\" invalid")
+
+		// invalid event expiry
+		cmd.SetArgs([]string{"--event-expiry", "0s"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "event expiry \"0s\" invalid")
+
+		// tracestate without traceparent
+		cmd.SetArgs([]string{"--event-expiry", "24h", "--tracestate", "vendor=value"})
+		err = cmd.Execute()
+		assert.ErrorContains(t, err, "flag \"tracestate\" requires flag \"traceparent\"")
 	})
 
 	t.Run("fails if specified event is invalid", func(t *testing.T) {
@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"github.com/spf13/pflag"
+
+	preemption "github.com/embano1/vsphere-preemption"
+)
+
+const (
+	defaultTag = "preemptible"
+	// fixed workflow id used by releases before per scope workflows, running
+	// workflows with this id must be cancelled with --workflow-id
+	legacyWorkflowID = "preempctl-run"
+)
+
+// scope of the targeted preemption workflow
+type scopeConfig struct {
+	vcenter    string
+	cluster    string
+	tag        string
+	workflowID string
+}
+
+// addScopeFlags adds the flags to select the scope of a preemption workflow
+func addScopeFlags(flags *pflag.FlagSet, cfg *scopeConfig) {
+	flags.StringVarP(&cfg.tag, "tag", "t", defaultTag, "vSphere tag to use to identify preemptible virtual machines")
+	flags.StringVar(&cfg.vcenter, "vcenter", "", "vCenter (hostname) of the preemption scope (empty for any)")
+	flags.StringVar(&cfg.cluster, "cluster", "", "vSphere cluster of the preemption scope (empty for any)")
+}
+
+// addWorkflowIDFlag adds the flag to select a preemption workflow by its id
+func addWorkflowIDFlag(flags *pflag.FlagSet, cfg *scopeConfig) {
+	flags.StringVar(&cfg.workflowID, "workflow-id", "", "target the specified workflow id instead of the workflow derived from --tag, --vcenter and --cluster")
+}
+
+func (s *scopeConfig) scope() preemption.Scope {
+	return preemption.Scope{
+		VCenter: s.vcenter,
+		Cluster: s.cluster,
+		Tag:     s.tag,
+	}
+}
+
+// id returns the workflow id of the scope
+func (s *scopeConfig) id() string {
+	if s.workflowID != "" {
+		return s.workflowID
+	}
+	return s.scope().WorkflowID()
+}
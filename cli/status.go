@@ -12,6 +12,7 @@ import (
 
 type statusConfig struct {
 	*wfConfig
+	scopeConfig
 	runID string
 }
 
@@ -24,9 +25,12 @@ func NewStatusCommand(wfConfig *wfConfig) *cobra.Command {
 		Use:   "status",
 		Short: "Retrieve status information of a preemption workflow run",
 		// TODO: add run-id
-		Example: `# retrieve status for the active preemption workflow
+		Example: `# retrieve status for the active preemption workflow of the default scope (tag "preemptible")
 preemptctl workflow status
 
+# retrieve status for the active preemption workflow of the specified cluster and tag
+preemptctl workflow status --cluster cluster01 --tag preemptible
+
 # retrieve status for the specified preemption workflow run id
 preemptctl workflow status --run-id 5d438391-281c-47d3-9e04-562c128195db`,
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -35,6 +39,8 @@ preemptctl workflow status --run-id 5d438391-281c-47d3-9e04-562c128195db`,
 	}
 
 	flags := cmd.PersistentFlags()
+	addScopeFlags(flags, &cfg.scopeConfig)
+	addWorkflowIDFlag(flags, &cfg.scopeConfig)
 	flags.StringVarP(&cfg.runID, "run-id", "r", "", "retrieve preemption status for specified workflow run id (empty for current run)")
 
 	return cmd
@@ -61,6 +67,7 @@ func getStatus(cmd *cobra.Command, cfg *statusConfig) error {
 		return fmt.Errorf("create temporal client: %w", err)
 	}
 
+	wfID := cfg.id()
 	logger = logger.With(
 		zap.String("workflow", preemption.WorkflowName),
 		zap.String("workflowID", wfID),
@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
 
 	ce "github.com/cloudevents/sdk-go/v2"
 	"github.com/spf13/cobra"
@@ -26,6 +30,32 @@ func parseJsonEvent(event string) (ce.Event, error) {
 	return e, nil
 }
 
+// parseSink parses a sink URL or a JSON sink configuration
+func parseSink(sink string) (preemption.SinkConfig, error) {
+	cfg := preemption.SinkConfig{URL: sink}
+	if strings.HasPrefix(strings.TrimSpace(sink), "{") {
+		if err := json.Unmarshal([]byte(sink), &cfg); err != nil {
+			return cfg, fmt.Errorf("read sink configuration: %w", err)
+		}
+	}
+
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Scheme == "" {
+		return cfg, fmt.Errorf("sink %q invalid (must be a URL, e.g. https://broker.local or stdout://, or a JSON sink configuration)", sink)
+	}
+	return cfg, nil
+}
+
+// currentUser returns the name of the user running the CLI or an empty string
+// if it cannot be determined
+func currentUser() string {
+	u, err := user.Current()
+	if err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
 func checkNotEmpty(name, value string) error {
 	if value == "" {
 		return fmt.Errorf("flag %q must not be empty", name)
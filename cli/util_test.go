@@ -5,6 +5,8 @@ import (
 
 	ce "github.com/cloudevents/sdk-go/v2"
 	"gotest.tools/assert"
+
+	preemption "github.com/embano1/vsphere-preemption"
 )
 
 func Test_checkNotEmpty(t *testing.T) {
@@ -70,3 +72,32 @@ func Test_parseJsonEvent(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseSink(t *testing.T) {
+	tests := []struct {
+		name    string
+		sink    string
+		want    preemption.SinkConfig
+		wantErr string
+	}{
+		{name: "sink URL", sink: "stdout://", want: preemption.SinkConfig{URL: "stdout://"}},
+		{
+			name: "JSON sink configuration",
+			sink: `{"url":"https://broker.local","auth":{"bearerTokenFile":"token"},"signingKeyFile":"key"}`,
+			want: preemption.SinkConfig{URL: "https://broker.local", Auth: &preemption.SinkAuth{BearerTokenFile: "token"}, SigningKeyFile: "key"},
+		},
+		{name: "missing scheme", sink: "broker.local", wantErr: "invalid"},
+		{name: "invalid JSON", sink: `{"url":}`, wantErr: "read sink configuration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSink(tt.sink)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
@@ -40,6 +40,9 @@ func NewWorkflowCommand(clock clock.Clock) *cobra.Command {
 	cmd.AddCommand(NewRunCommand(cfg))
 	cmd.AddCommand(NewStatusCommand(cfg))
 	cmd.AddCommand(NewCancelCommand(cfg))
+	cmd.AddCommand(NewApproveCommand(cfg))
+	cmd.AddCommand(NewListCommand(cfg))
+	cmd.AddCommand(NewEventsCommand(cfg))
 
 	return cmd
 }
@@ -21,7 +21,7 @@ func Test_NewWorkflowCommand(t *testing.T) {
 		checkFlag(t, cmd, flags)
 
 		// subcommands
-		subcommands := []string{"run", "status", "cancel"}
+		subcommands := []string{"run", "status", "cancel", "approve", "list"}
 		hasSubcommand(t, cmd, subcommands)
 
 		// invalid server specified
@@ -0,0 +1,137 @@
+package preemption
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VM swap files (.vswp) deleted when the VM is powered off or suspended, the
+// only datastore space released by preemption
+var swapFileTypes = map[string]struct{}{
+	string(types.VirtualMachineFileLayoutExFileTypeSwap):   {},
+	string(types.VirtualMachineFileLayoutExFileTypeUwswap): {},
+}
+
+// VM snapshot files, kept on preemption and only used to order VMs with swap
+// files of equal size
+var snapshotFileTypes = map[string]struct{}{
+	string(types.VirtualMachineFileLayoutExFileTypeSnapshotData):   {},
+	string(types.VirtualMachineFileLayoutExFileTypeSnapshotMemory): {},
+}
+
+// datastoreUsage is the size of the swap and snapshot files of a VM on a
+// datastore
+type datastoreUsage struct {
+	swap     int64
+	snapshot int64
+}
+
+// newDatastoreUsage returns the usage of the given files with the prefix of
+// the datastore
+func newDatastoreUsage(files []types.VirtualMachineFileLayoutExFileInfo, prefix string) datastoreUsage {
+	var u datastoreUsage
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+		if _, ok := swapFileTypes[f.Type]; ok {
+			u.swap += f.Size
+		}
+		if _, ok := snapshotFileTypes[f.Type]; ok {
+			u.snapshot += f.Size
+		}
+	}
+	return u
+}
+
+// releasesMore returns true if preempting the VM with usage u releases more
+// space than preempting the VM with usage o, i.e. u has larger swap files or
+// larger snapshot files if the swap files are of equal size
+func (u datastoreUsage) releasesMore(o datastoreUsage) bool {
+	if u.swap != o.swap {
+		return u.swap > o.swap
+	}
+	return u.snapshot > o.snapshot
+}
+
+// alarmEventData is the subset of a vSphere AlarmStatusChangedEvent used to
+// identify the alarm entity
+type alarmEventData struct {
+	Entity *struct {
+		Name   string                        `json:"Name"`
+		Entity *types.ManagedObjectReference `json:"Entity"`
+	} `json:"Entity"`
+}
+
+// alarmDatastore returns the name of the datastore if the given event is an
+// alarm event for a datastore entity
+func alarmDatastore(e ce.Event) string {
+	if len(e.Data()) == 0 {
+		return ""
+	}
+
+	var data alarmEventData
+	if err := e.DataAs(&data); err != nil {
+		return ""
+	}
+
+	if data.Entity == nil || data.Entity.Entity == nil || data.Entity.Entity.Type != "Datastore" {
+		return ""
+	}
+	return data.Entity.Name
+}
+
+// findDatastore returns the datastore with the given name
+func (c *Client) findDatastore(ctx context.Context, name string) (*object.Datastore, error) {
+	ref, err := c.findObject(ctx, "Datastore", "datastore", name)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewDatastore(c.vcclient, ref), nil
+}
+
+// filterDatastore returns the VMs in refs with files on the given datastore,
+// ordered by the size of their swap files on this datastore, largest first.
+// The size of their snapshot files breaks ties.
+func (c *Client) filterDatastore(ctx context.Context, datastore string, refs []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	ds, err := c.findDatastore(ctx, datastore)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := "[" + datastore + "] "
+	usage := make(map[types.ManagedObjectReference]datastoreUsage)
+
+	filtered, err := c.filterVMs(ctx, refs, []string{"datastore", "layoutEx.file"}, func(vm mo.VirtualMachine) bool {
+		var found bool
+		for _, ref := range vm.Datastore {
+			if ref == ds.Reference() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+
+		if vm.LayoutEx != nil {
+			usage[vm.Reference()] = newDatastoreUsage(vm.LayoutEx.File, prefix)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return usage[filtered[i]].releasesMore(usage[filtered[j]])
+	})
+
+	return filtered, nil
+}
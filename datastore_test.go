@@ -0,0 +1,77 @@
+package preemption
+
+import (
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func Test_alarmDatastore(t *testing.T) {
+	newEvent := func(data interface{}) ce.Event {
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+		if data != nil {
+			assert.NilError(t, e.SetData(ce.ApplicationJSON, data))
+		}
+		return e
+	}
+
+	entity := func(name, kind string) map[string]interface{} {
+		return map[string]interface{}{
+			"Entity": map[string]interface{}{
+				"Name":   name,
+				"Entity": types.ManagedObjectReference{Type: kind, Value: "obj-1"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		event ce.Event
+		want  string
+	}{
+		{name: "no data", event: newEvent(nil), want: ""},
+		{name: "no entity", event: newEvent(map[string]string{"key": "value"}), want: ""},
+		{name: "non-datastore entity", event: newEvent(entity("DC0_C0", "ClusterComputeResource")), want: ""},
+		{name: "datastore entity", event: newEvent(entity("ds01", "Datastore")), want: "ds01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, alarmDatastore(tt.event), tt.want)
+		})
+	}
+}
+
+func Test_datastoreUsage(t *testing.T) {
+	file := func(name string, kind types.VirtualMachineFileLayoutExFileType, size int64) types.VirtualMachineFileLayoutExFileInfo {
+		return types.VirtualMachineFileLayoutExFileInfo{Name: name, Type: string(kind), Size: size}
+	}
+
+	t.Run("sums swap and snapshot files on datastore", func(t *testing.T) {
+		files := []types.VirtualMachineFileLayoutExFileInfo{
+			file("[ds01] vm-1/vm-1.vswp", types.VirtualMachineFileLayoutExFileTypeSwap, 4096),
+			file("[ds01] vm-1/vmx-vm-1.vswp", types.VirtualMachineFileLayoutExFileTypeUwswap, 128),
+			file("[ds01] vm-1/vm-1-000001-delta.vmdk", types.VirtualMachineFileLayoutExFileTypeSnapshotData, 2048),
+			file("[ds01] vm-1/vm-1-Snapshot1.vmsn", types.VirtualMachineFileLayoutExFileTypeSnapshotMemory, 512),
+			file("[ds01] vm-1/vm-1-flat.vmdk", types.VirtualMachineFileLayoutExFileTypeDiskExtent, 10240),
+			file("[ds02] vm-1/vm-1.vswp", types.VirtualMachineFileLayoutExFileTypeSwap, 8192),
+		}
+		assert.Equal(t, newDatastoreUsage(files, "[ds01] "), datastoreUsage{swap: 4224, snapshot: 2560})
+	})
+
+	t.Run("ranks by swap size and breaks ties by snapshot size", func(t *testing.T) {
+		largeSwap := datastoreUsage{swap: 4096}
+		largeSnapshot := datastoreUsage{swap: 1024, snapshot: 1 << 30}
+		equalSwap := datastoreUsage{swap: 1024, snapshot: 512}
+
+		assert.Check(t, largeSwap.releasesMore(largeSnapshot))
+		assert.Check(t, !largeSnapshot.releasesMore(largeSwap))
+		assert.Check(t, largeSnapshot.releasesMore(equalSwap))
+		assert.Check(t, !equalSwap.releasesMore(equalSwap))
+	})
+}
@@ -0,0 +1,67 @@
+package preemption
+
+import (
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+const maxSeenEvents = 256 // number of request event IDs remembered for duplicate detection
+
+// eventKey uniquely identifies a CloudEvent
+type eventKey struct {
+	Source string `json:"source"`
+	ID     string `json:"id"`
+}
+
+// seenEvents is a bounded set of recently seen request events. When full, the
+// oldest event is evicted.
+type seenEvents struct {
+	size  int
+	keys  []eventKey // insertion order
+	index map[eventKey]struct{}
+}
+
+func newSeenEvents(size int) *seenEvents {
+	return &seenEvents{
+		size:  size,
+		index: make(map[eventKey]struct{}, size),
+	}
+}
+
+// has returns true if the given event was already seen
+func (s *seenEvents) has(e ce.Event) bool {
+	if e.ID() == "" {
+		return false
+	}
+	_, ok := s.index[eventKey{Source: e.Source(), ID: e.ID()}]
+	return ok
+}
+
+// add records the given event and returns false if it was already seen. Events
+// without ID are never considered duplicates.
+func (s *seenEvents) add(e ce.Event) bool {
+	if e.ID() == "" {
+		return true
+	}
+	return s.addKey(eventKey{Source: e.Source(), ID: e.ID()})
+}
+
+// addKey records the given event key and returns false if it was already seen
+func (s *seenEvents) addKey(key eventKey) bool {
+	if _, ok := s.index[key]; ok {
+		return false
+	}
+
+	if len(s.keys) == s.size {
+		delete(s.index, s.keys[0])
+		s.keys = s.keys[1:]
+	}
+
+	s.keys = append(s.keys, key)
+	s.index[key] = struct{}{}
+	return true
+}
+
+// events returns the seen events in insertion order
+func (s *seenEvents) events() []eventKey {
+	return append([]eventKey(nil), s.keys...)
+}
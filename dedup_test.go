@@ -0,0 +1,63 @@
+package preemption
+
+import (
+	"fmt"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+func newTestEvent(source, id string) ce.Event {
+	e := ce.NewEvent()
+	e.SetSource(source)
+	e.SetID(id)
+	return e
+}
+
+func Test_seenEvents(t *testing.T) {
+	t.Run("detects duplicate events by source and id", func(t *testing.T) {
+		s := newSeenEvents(10)
+		assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", "1")))
+		assert.Assert(t, s.add(newTestEvent("https://vc02/sdk", "1")))
+		assert.Assert(t, !s.add(newTestEvent("https://vc01/sdk", "1")))
+	})
+
+	t.Run("reports seen events without recording them", func(t *testing.T) {
+		s := newSeenEvents(10)
+		e := newTestEvent("https://vc01/sdk", "1")
+		assert.Assert(t, !s.has(e))
+		assert.Assert(t, !s.has(e))
+		assert.Assert(t, s.add(e))
+		assert.Assert(t, s.has(e))
+	})
+
+	t.Run("never treats events without id as duplicates", func(t *testing.T) {
+		s := newSeenEvents(10)
+		assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", "")))
+		assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", "")))
+	})
+
+	t.Run("evicts oldest events when full", func(t *testing.T) {
+		s := newSeenEvents(3)
+		for i := 0; i < 4; i++ {
+			assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", fmt.Sprint(i))))
+		}
+		assert.Equal(t, len(s.keys), 3)
+		assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", "0")))
+		assert.Assert(t, !s.add(newTestEvent("https://vc01/sdk", "3")))
+	})
+	t.Run("restores seen events in insertion order", func(t *testing.T) {
+		s := newSeenEvents(10)
+		for i := 0; i < 3; i++ {
+			assert.Assert(t, s.add(newTestEvent("https://vc01/sdk", fmt.Sprint(i))))
+		}
+
+		restored := newSeenEvents(2)
+		for _, key := range s.events() {
+			restored.addKey(key)
+		}
+		assert.DeepEqual(t, restored.events(), []eventKey{{Source: "https://vc01/sdk", ID: "1"}, {Source: "https://vc01/sdk", ID: "2"}})
+		assert.Assert(t, restored.has(newTestEvent("https://vc01/sdk", "2")))
+	})
+}
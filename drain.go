@@ -0,0 +1,187 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// DrainFailurePolicy defines the workflow behavior for a VM when the drain
+// command fails, exits with a non-zero exit code or times out
+type DrainFailurePolicy string
+
+const (
+	DrainFailSkip  DrainFailurePolicy = "SKIP"  // do not preempt the VM (default)
+	DrainFailForce DrainFailurePolicy = "FORCE" // preempt the VM anyway
+
+	DefaultDrainTimeout = time.Minute * 5 // used when drain settings do not specify a timeout
+
+	// keys of the guest credentials in the worker secret
+	GuestUsernameKey = "guest-username"
+	GuestPasswordKey = "guest-password"
+
+	drainPollInterval = time.Second // interval to check for drain command exit
+)
+
+// DrainSettings configure the in-guest command run before preemptible VMs are
+// shut down. The command runs with the guest credentials of the worker, so
+// requests can only select a command configured on the worker by name.
+type DrainSettings struct {
+	Command       string             `json:"command"`                 // name of a drain command configured on the worker (DRAIN_COMMANDS)
+	Timeout       time.Duration      `json:"timeout,omitempty"`       // per VM, defaults to DefaultDrainTimeout
+	FailurePolicy DrainFailurePolicy `json:"failurePolicy,omitempty"` // defaults to DrainFailSkip
+}
+
+func (d DrainSettings) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return d.Timeout
+}
+
+func (d DrainSettings) failurePolicy() DrainFailurePolicy {
+	if d.FailurePolicy == "" {
+		return DrainFailSkip
+	}
+	return d.FailurePolicy
+}
+
+// DrainResult is the outcome of the drain command in a VM
+type DrainResult struct {
+	VM       types.ManagedObjectReference `json:"vm"`
+	Drained  bool                         `json:"drained"`            // command exited with exit code 0
+	ExitCode int32                        `json:"exitCode,omitempty"` // exit code of the command
+	Error    string                       `json:"error,omitempty"`    // reason the drain failed
+}
+
+// DrainVMs runs the drain command in the given VMs using VMware Tools guest
+// operations and waits for the command to exit. Guest credentials are read
+// from the worker secret. A result is returned for every VM.
+func (c *Client) DrainVMs(ctx context.Context, refs []types.ManagedObjectReference, settings DrainSettings) ([]DrainResult, error) {
+	logger := activity.GetLogger(ctx)
+
+	spec, err := c.drainCommand(settings.Command)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("resolve drain command", errInternal, err)
+	}
+
+	username, err := ReadKey(GuestUsernameKey)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("read guest username from secret", errInternal, err)
+	}
+	password, err := ReadKey(GuestPasswordKey)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("read guest password from secret", errInternal, err)
+	}
+
+	auth := &types.NamePasswordAuthentication{
+		Username: username,
+		Password: password,
+	}
+
+	var (
+		mu      sync.Mutex
+		results = make(map[types.ManagedObjectReference]DrainResult, len(refs))
+	)
+
+	_, err = c.forEachVM(ctx, refs, func(ctx context.Context, ref types.ManagedObjectReference) bool {
+		res := DrainResult{VM: ref}
+
+		code, err := c.drainVm(ctx, ref, auth, *spec, settings.timeout())
+		switch {
+		case err != nil:
+			logger.Warn("failed to drain vm", "error", err, "ref", ref.String())
+			res.Error = err.Error()
+		case code != 0:
+			logger.Warn("drain command failed", "exitCode", code, "ref", ref.String())
+			res.ExitCode = code
+			res.Error = fmt.Sprintf("drain command exited with exit code %d", code)
+		default:
+			res.Drained = true
+		}
+
+		mu.Lock()
+		results[ref] = res
+		mu.Unlock()
+		return res.Drained
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	drained := make([]DrainResult, 0, len(refs))
+	for _, ref := range refs {
+		drained = append(drained, results[ref])
+	}
+	return drained, nil
+}
+
+// drainCommand returns the program of the named drain command configured on
+// the worker, i.e. the path of the program in the guest and its arguments
+// separated by a space
+func (c *Client) drainCommand(name string) (*types.GuestProgramSpec, error) {
+	cmd, ok := c.drainCommands[name]
+	if !ok || strings.TrimSpace(cmd) == "" {
+		return nil, fmt.Errorf("drain command %q not configured on worker (DRAIN_COMMANDS)", name)
+	}
+
+	path, args := strings.TrimSpace(cmd), ""
+	if i := strings.IndexByte(path, ' '); i >= 0 {
+		path, args = path[:i], strings.TrimSpace(path[i+1:])
+	}
+	return &types.GuestProgramSpec{ProgramPath: path, Arguments: args}, nil
+}
+
+// drainVm starts the drain command in the VM and returns its exit code. The
+// command is terminated if it does not exit within timeout.
+func (c *Client) drainVm(ctx context.Context, ref types.ManagedObjectReference, auth types.BaseGuestAuthentication, spec types.GuestProgramSpec, timeout time.Duration) (int32, error) {
+	logger := activity.GetLogger(ctx)
+
+	ops := guest.NewOperationsManager(c.vcclient, ref)
+	pm, err := ops.ProcessManager(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get guest process manager: %w", err)
+	}
+
+	pid, err := pm.StartProgram(ctx, auth, &spec)
+	if err != nil {
+		return 0, fmt.Errorf("start drain command: %w", err)
+	}
+	logger.Debug("started drain command", "ref", ref.String(), "pid", pid)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		procs, err := pm.ListProcesses(ctx, auth, []int64{pid})
+		if err != nil && ctx.Err() == nil {
+			return 0, fmt.Errorf("get drain command status: %w", err)
+		}
+
+		if len(procs) > 0 && procs[0].EndTime != nil {
+			return procs[0].ExitCode, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			// parent context might be cancelled, too
+			termCtx, termCancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer termCancel()
+			if err := pm.TerminateProcess(termCtx, auth, pid); err != nil {
+				logger.Warn("failed to terminate drain command", "error", err, "ref", ref.String(), "pid", pid)
+			}
+			return 0, fmt.Errorf("drain command did not exit within %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package preemption
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func TestDrainCommand(t *testing.T) {
+	c := Client{drainCommands: map[string]string{
+		"app-drain": "/opt/app/drain.sh --graceful --timeout 60",
+		"stop":      "/usr/bin/systemctl-stop",
+		"empty":     " ",
+	}}
+
+	t.Run("splits configured command into path and arguments", func(t *testing.T) {
+		spec, err := c.drainCommand("app-drain")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, spec, &types.GuestProgramSpec{ProgramPath: "/opt/app/drain.sh", Arguments: "--graceful --timeout 60"})
+	})
+
+	t.Run("returns command without arguments", func(t *testing.T) {
+		spec, err := c.drainCommand("stop")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, spec, &types.GuestProgramSpec{ProgramPath: "/usr/bin/systemctl-stop"})
+	})
+
+	t.Run("fails for command not configured on worker", func(t *testing.T) {
+		_, err := c.drainCommand("/bin/rm -rf /")
+		assert.ErrorContains(t, err, "not configured on worker")
+
+		_, err = c.drainCommand("empty")
+		assert.ErrorContains(t, err, "not configured on worker")
+	})
+}
@@ -0,0 +1,126 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// RebalanceMode defines how DRS recommendations for the clusters of the
+// preempted VMs are handled after preemption
+type RebalanceMode string
+
+const (
+	RebalanceApply  RebalanceMode = "APPLY"  // apply DRS recommendations
+	RebalanceRecord RebalanceMode = "RECORD" // record DRS recommendations in the workflow state only
+)
+
+// DRSRecommendation is a DRS recommendation for a cluster affected by
+// preemption
+type DRSRecommendation struct {
+	Cluster string   `json:"cluster"`
+	Key     string   `json:"key"`
+	Rating  int32    `json:"rating"` // 1 (lowest) to 5 (highest)
+	Reason  string   `json:"reason"`
+	Actions []string `json:"actions"` // e.g. "migrate vm-1 from host-1 to host-2"
+	Applied bool     `json:"applied"`
+}
+
+// newDRSRecommendation converts a vSphere cluster recommendation
+func newDRSRecommendation(cluster string, rec types.ClusterRecommendation) DRSRecommendation {
+	r := DRSRecommendation{
+		Cluster: cluster,
+		Key:     rec.Key,
+		Rating:  rec.Rating,
+		Reason:  rec.ReasonText,
+		Actions: make([]string, 0, len(rec.Action)),
+	}
+	if r.Reason == "" {
+		r.Reason = rec.Reason
+	}
+
+	for _, a := range rec.Action {
+		switch action := a.(type) {
+		case *types.ClusterMigrationAction:
+			if m := action.DrsMigration; m != nil {
+				r.Actions = append(r.Actions, fmt.Sprintf("migrate %s from %s to %s", m.Vm.Value, m.Source.Value, m.Destination.Value))
+				continue
+			}
+			r.Actions = append(r.Actions, describeClusterAction(action.ClusterAction))
+		default:
+			r.Actions = append(r.Actions, describeClusterAction(*a.GetClusterAction()))
+		}
+	}
+	return r
+}
+
+func describeClusterAction(a types.ClusterAction) string {
+	if a.Target == nil {
+		return a.Type
+	}
+	return fmt.Sprintf("%s %s", a.Type, a.Target.Value)
+}
+
+// RebalanceClusters refreshes the DRS recommendations for the clusters of the
+// given preempted VMs and applies them if apply is true. Recommendations which
+// cannot be applied are returned as not applied.
+func (c *Client) RebalanceClusters(ctx context.Context, refs []types.ManagedObjectReference, apply bool) ([]DRSRecommendation, error) {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	var (
+		clusters []types.ManagedObjectReference
+		seen     = make(map[types.ManagedObjectReference]struct{})
+	)
+	for _, ref := range refs {
+		cluster, err := c.vmCluster(ctx, ref)
+		if err != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("get cluster of vm %q", ref.Value), errVSphere, err)
+		}
+		if cluster == nil {
+			continue
+		}
+		if _, ok := seen[*cluster]; !ok {
+			seen[*cluster] = struct{}{}
+			clusters = append(clusters, *cluster)
+		}
+	}
+
+	var recommendations []DRSRecommendation
+	pc := property.DefaultCollector(c.vcclient)
+	for _, cluster := range clusters {
+		if _, err := methods.RefreshRecommendation(ctx, c.vcclient, &types.RefreshRecommendation{This: cluster}); err != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("refresh drs recommendations for cluster %q", cluster.Value), errVSphere, err)
+		}
+
+		var ccr mo.ClusterComputeResource
+		if err := pc.RetrieveOne(ctx, cluster, []string{"name", "recommendation"}, &ccr); err != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve drs recommendations for cluster %q", cluster.Value), errVSphere, err)
+		}
+		logger.Debug("drs recommendations", "cluster", ccr.Name, "count", len(ccr.Recommendation))
+
+		for _, rec := range ccr.Recommendation {
+			r := newDRSRecommendation(ccr.Name, rec)
+			if apply {
+				if _, err := methods.ApplyRecommendation(ctx, c.vcclient, &types.ApplyRecommendation{This: cluster, Key: rec.Key}); err != nil {
+					logger.Warn("failed to apply drs recommendation", "error", err, "cluster", ccr.Name, "key", rec.Key)
+				} else {
+					r.Applied = true
+				}
+			}
+			recommendations = append(recommendations, r)
+		}
+	}
+
+	return recommendations, nil
+}
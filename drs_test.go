@@ -0,0 +1,55 @@
+package preemption
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func Test_newDRSRecommendation(t *testing.T) {
+	host := func(v string) types.ManagedObjectReference {
+		return types.ManagedObjectReference{Type: "HostSystem", Value: v}
+	}
+
+	t.Run("describes migration and generic actions", func(t *testing.T) {
+		rec := types.ClusterRecommendation{
+			Key:        "1",
+			Rating:     4,
+			Reason:     string(types.RecommendationReasonCodeFairnessCpuAvg),
+			ReasonText: "Balance average CPU loads.",
+			Action: []types.BaseClusterAction{
+				&types.ClusterMigrationAction{
+					DrsMigration: &types.ClusterDrsMigration{
+						Vm:          types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+						Source:      host("host-1"),
+						Destination: host("host-2"),
+					},
+				},
+				&types.ClusterAction{Type: "PowerOn"},
+			},
+		}
+
+		want := DRSRecommendation{
+			Cluster: "DC0_C0",
+			Key:     "1",
+			Rating:  4,
+			Reason:  "Balance average CPU loads.",
+			Actions: []string{"migrate vm-1 from host-1 to host-2", "PowerOn"},
+		}
+		assert.DeepEqual(t, newDRSRecommendation("DC0_C0", rec), want)
+	})
+
+	t.Run("falls back to reason code", func(t *testing.T) {
+		target := host("host-1")
+		rec := types.ClusterRecommendation{
+			Key:    "2",
+			Reason: string(types.RecommendationReasonCodeHostMaint),
+			Action: []types.BaseClusterAction{&types.ClusterAction{Type: "HostMaintenance", Target: &target}},
+		}
+
+		got := newDRSRecommendation("DC0_C0", rec)
+		assert.Equal(t, got.Reason, string(types.RecommendationReasonCodeHostMaint))
+		assert.DeepEqual(t, got.Actions, []string{"HostMaintenance host-1"})
+	})
+}
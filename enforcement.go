@@ -0,0 +1,327 @@
+package preemption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// EnforcementMode defines how a power on of a preempted VM is handled while the
+// preemption is enforced
+type EnforcementMode string
+
+const (
+	EnforcementRepreempt EnforcementMode = "REPREEMPT" // preempt VMs again
+	EnforcementLog       EnforcementMode = "LOG"       // record violations only
+
+	enforcementInterval = time.Hour        // maximum duration of a single power on watch
+	shutdownGracePeriod = time.Minute * 10 // graceful shutdown of a preempted VM may still be in progress
+	maxViolations       = 50               // number of violations kept in the workflow state
+
+	guestStateShuttingDown = "shuttingDown" // guest.guestState of a VM during guest shutdown
+)
+
+// Violation is the power on of a preempted VM while the preemption is enforced
+type Violation struct {
+	VM          types.ManagedObjectReference `json:"vm"`
+	Time        time.Time                    `json:"time"`
+	Repreempted bool                         `json:"repreempted"`
+	Error       string                       `json:"error,omitempty"` // re-preemption failure (EnforcementRepreempt)
+}
+
+// WaitForPowerOn blocks until any of the given preempted VMs is powered on and
+// returns the powered on VMs which are still annotated as preempted. VMs
+// already powered on when the watch starts are returned immediately, unless
+// they are still shutting down gracefully or are in reported, i.e. powered on
+// VMs which were already reported and not stopped (EnforcementLog). No VMs are
+// returned after enforcementInterval.
+func (c *Client) WaitForPowerOn(ctx context.Context, refs []types.ManagedObjectReference, reported []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithTimeout(ctx, enforcementInterval)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	om, err := object.GetCustomFieldsManager(c.vcclient)
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
+	}
+
+	key, found, err := c.findCustomField(ctx, om)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(c.vcclient)
+
+	// powered on before the watch started, e.g. while the watch was restarted
+	// or after a failed re-preemption
+	var vms []mo.VirtualMachine
+	if err = pc.Retrieve(ctx, refs, []string{"runtime.powerState", "guest.guestState"}, &vms); err != nil {
+		return nil, temporal.NewApplicationError("retrieve vm power state", errVSphere, err)
+	}
+
+	var poweredOn []types.ManagedObjectReference
+	for _, vm := range vms {
+		if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+			continue
+		}
+		if vm.Guest != nil && vm.Guest.GuestState == guestStateShuttingDown {
+			continue
+		}
+		if containsRef(reported, vm.Self) {
+			continue
+		}
+		poweredOn = append(poweredOn, vm.Self)
+	}
+
+	preempted, err := c.stillPreempted(ctx, key, found, poweredOn, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(preempted) > 0 {
+		logger.Debug("preempted vms powered on before watch", "refs", preempted)
+		return preempted, nil
+	}
+
+	filter := new(property.WaitFilter)
+	for _, ref := range refs {
+		filter.Add(ref, ref.Type, []string{"runtime.powerState"})
+	}
+
+	initial := true
+	poweredOn = nil
+
+	logger.Debug("watching preempted vms for power on", "refs", refs)
+	err = property.WaitForUpdates(ctx, pc, filter, func(updates []types.ObjectUpdate) bool {
+		// first update contains the current state which was checked above
+		if initial {
+			initial = false
+			return false
+		}
+
+		for _, update := range updates {
+			for _, change := range update.ChangeSet {
+				if state, ok := change.Val.(types.VirtualMachinePowerState); ok && state == types.VirtualMachinePowerStatePoweredOn {
+					poweredOn = append(poweredOn, update.Obj)
+				}
+			}
+		}
+		return len(poweredOn) > 0
+	})
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Debug("no power on of preempted vms within interval", "interval", enforcementInterval.String())
+			return nil, nil
+		}
+		return nil, temporal.NewApplicationError("wait for vm power on", errVSphere, err)
+	}
+
+	preempted, err = c.stillPreempted(ctx, key, found, poweredOn, false)
+	if err != nil {
+		return nil, err
+	}
+	logger.Debug("preempted vms powered on", "refs", preempted)
+
+	return preempted, nil
+}
+
+// stillPreempted returns the given VMs which are still annotated as preempted,
+// e.g. not restored in the meantime by a workflow with an overlapping scope.
+// With settling set, VMs shut down gracefully within shutdownGracePeriod are
+// skipped as their shutdown may still be in progress, and all VMs are skipped
+// if the annotation custom field does not exist.
+func (c *Client) stillPreempted(ctx context.Context, key int32, found bool, refs []types.ManagedObjectReference, settling bool) ([]types.ManagedObjectReference, error) {
+	if !found {
+		if settling {
+			return nil, nil
+		}
+		return refs, nil
+	}
+
+	var preempted []types.ManagedObjectReference
+	for _, ref := range refs {
+		a, err := c.getAnnotation(ctx, key, ref)
+		if err != nil {
+			return nil, temporal.NewApplicationError(fmt.Sprintf("get annotation of vm %q", ref.Value), errVSphere, err)
+		}
+		if !a.Preempted() {
+			continue
+		}
+		if r := a.Latest(); settling && !r.ForcedShutdown && !r.Suspended && c.clock.Now().Sub(r.Time) < shutdownGracePeriod {
+			continue
+		}
+		preempted = append(preempted, ref)
+	}
+	return preempted, nil
+}
+
+// enforcement watches preempted VMs for power on and handles violations
+// according to the enforcement mode
+type enforcement struct {
+	mode   EnforcementMode
+	action PreemptAction
+	vms    []types.ManagedObjectReference // watched VMs
+	logged []types.ManagedObjectReference // violations which were not stopped (EnforcementLog)
+
+	watch  workflow.Future // pending watch, nil if not enforcing
+	cancel workflow.CancelFunc
+}
+
+// enforce adds the given VMs to the watched VMs and restarts the watch
+func (e *enforcement) enforce(ctx workflow.Context, mode EnforcementMode, action PreemptAction, refs []types.ManagedObjectReference) {
+	e.mode = mode
+	e.action = action
+
+	watched := make(map[types.ManagedObjectReference]struct{}, len(e.vms))
+	for _, ref := range e.vms {
+		watched[ref] = struct{}{}
+	}
+	for _, ref := range refs {
+		if _, ok := watched[ref]; !ok {
+			e.vms = append(e.vms, ref)
+		}
+	}
+
+	e.start(ctx)
+}
+
+// start (re)starts watching the VMs
+func (e *enforcement) start(ctx workflow.Context) {
+	var vc *Client // vcenter client will be injected
+
+	if e.cancel != nil {
+		e.cancel()
+	}
+
+	options := workflow.ActivityOptions{
+		StartToCloseTimeout: enforcementInterval + time.Minute*5,
+		HeartbeatTimeout:    time.Second * 5,
+		WaitForCancellation: false,
+		RetryPolicy:         &defaultRetryPolicy,
+	}
+
+	watchCtx, cancel := workflow.WithCancel(workflow.WithActivityOptions(ctx, options))
+	e.watch = workflow.ExecuteActivity(watchCtx, vc.WaitForPowerOn, e.vms, e.logged)
+	e.cancel = cancel
+}
+
+// stop stops enforcing the preemption
+func (e *enforcement) stop() {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.vms = nil
+	e.logged = nil
+	e.watch = nil
+	e.cancel = nil
+}
+
+// handle records and, depending on the enforcement mode, preempts the VMs
+// returned by the finished watch and restarts the watch. It returns the
+// violations.
+func (e *enforcement) handle(ctx workflow.Context, f workflow.Future) []Violation {
+	var (
+		vc        *Client // vcenter client will be injected
+		poweredOn []types.ManagedObjectReference
+	)
+
+	logger := workflow.GetLogger(ctx)
+
+	if err := f.Get(ctx, &poweredOn); err != nil {
+		logger.Error("watch preempted vms: stopping enforcement", "error", err)
+		e.stop()
+		return nil
+	}
+
+	violations := make([]Violation, 0, len(poweredOn))
+	for _, ref := range poweredOn {
+		violations = append(violations, Violation{VM: ref, Time: workflow.Now(ctx).UTC()})
+	}
+
+	if len(poweredOn) > 0 {
+		logger.Warn("preempted virtual machines powered on", "refs", poweredOn, "mode", e.mode)
+	}
+
+	if e.mode == EnforcementLog {
+		for _, ref := range poweredOn {
+			if !containsRef(e.logged, ref) {
+				e.logged = append(e.logged, ref)
+			}
+		}
+	}
+
+	if e.mode == EnforcementRepreempt && len(poweredOn) > 0 {
+		options := workflow.ActivityOptions{
+			StartToCloseTimeout: time.Minute * 5,
+			HeartbeatTimeout:    time.Second * 5,
+			WaitForCancellation: false,
+			RetryPolicy:         &defaultRetryPolicy,
+		}
+		actCtx := workflow.WithActivityOptions(ctx, options)
+
+		var (
+			stopped []types.ManagedObjectReference
+			err     error
+		)
+		if e.action == ActionSuspend {
+			err = workflow.ExecuteActivity(actCtx, vc.SuspendVMs, poweredOn).Get(ctx, &stopped)
+		} else {
+			err = workflow.ExecuteActivity(actCtx, vc.PowerOffVMs, poweredOn, true).Get(ctx, &stopped)
+		}
+		if err != nil {
+			logger.Error("preempt powered on virtual machines", "error", err)
+		}
+
+		repreempted := make(map[types.ManagedObjectReference]struct{}, len(stopped))
+		for _, ref := range stopped {
+			repreempted[ref] = struct{}{}
+		}
+		for i := range violations {
+			_, violations[i].Repreempted = repreempted[violations[i].VM]
+			switch {
+			case err != nil:
+				violations[i].Error = err.Error()
+			case !violations[i].Repreempted:
+				violations[i].Error = "virtual machine not stopped"
+			}
+		}
+	}
+
+	e.start(ctx)
+	return violations
+}
+
+// containsRef returns true if refs contains ref
+func containsRef(refs []types.ManagedObjectReference, ref types.ManagedObjectReference) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// appendViolations appends the given violations keeping the latest
+// maxViolations
+func appendViolations(violations []Violation, more ...Violation) []Violation {
+	violations = append(violations, more...)
+	if len(violations) > maxViolations {
+		violations = violations[len(violations)-maxViolations:]
+	}
+	return violations
+}
@@ -0,0 +1,199 @@
+package preemption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// HARestartSettings is the vSphere HA restart configuration of a VM before
+// preemption
+type HARestartSettings struct {
+	Cluster  types.ManagedObjectReference `json:"cluster"`
+	Previous *types.ClusterDasVmSettings  `json:"previous,omitempty"` // VM override, nil if the cluster default applied
+}
+
+// vmCluster returns the cluster the given VM is running in, nil if the VM is
+// not running in a cluster
+func (c *Client) vmCluster(ctx context.Context, ref types.ManagedObjectReference) (*types.ManagedObjectReference, error) {
+	pc := property.DefaultCollector(c.vcclient)
+
+	var vm mo.VirtualMachine
+	if err := pc.RetrieveOne(ctx, ref, []string{"resourcePool"}, &vm); err != nil {
+		return nil, fmt.Errorf("retrieve resource pool: %w", err)
+	}
+	if vm.ResourcePool == nil {
+		return nil, nil
+	}
+
+	var pool mo.ResourcePool
+	if err := pc.RetrieveOne(ctx, *vm.ResourcePool, []string{"owner"}, &pool); err != nil {
+		return nil, fmt.Errorf("retrieve resource pool owner: %w", err)
+	}
+	if pool.Owner.Type != "ClusterComputeResource" {
+		return nil, nil
+	}
+	return &pool.Owner, nil
+}
+
+// dasVmSettings returns the HA override of the given VM in the cluster, nil if
+// the cluster default applies
+func (c *Client) dasVmSettings(ctx context.Context, cluster, vm types.ManagedObjectReference) (*types.ClusterDasVmSettings, error) {
+	var ccr mo.ClusterComputeResource
+	if err := property.DefaultCollector(c.vcclient).RetrieveOne(ctx, cluster, []string{"configurationEx"}, &ccr); err != nil {
+		return nil, fmt.Errorf("retrieve cluster configuration: %w", err)
+	}
+
+	cfg, ok := ccr.ConfigurationEx.(*types.ClusterConfigInfoEx)
+	if !ok {
+		return nil, nil
+	}
+
+	for _, vmCfg := range cfg.DasVmConfig {
+		if vmCfg.Key != vm {
+			continue
+		}
+		if vmCfg.DasSettings != nil {
+			settings := *vmCfg.DasSettings
+			return &settings, nil
+		}
+		// deprecated per-VM restart priority
+		return &types.ClusterDasVmSettings{RestartPriority: string(vmCfg.RestartPriority)}, nil
+	}
+	return nil, nil
+}
+
+// setDasVmSettings sets the HA override of the given VM in the cluster. The
+// override is removed if settings is nil.
+func (c *Client) setDasVmSettings(ctx context.Context, cluster, vm types.ManagedObjectReference, settings *types.ClusterDasVmSettings) error {
+	current, err := c.dasVmSettings(ctx, cluster, vm)
+	if err != nil {
+		return err
+	}
+
+	var spec types.ClusterDasVmConfigSpec
+	switch {
+	case settings == nil && current == nil:
+		return nil
+	case settings == nil:
+		spec.Operation = types.ArrayUpdateOperationRemove
+		spec.RemoveKey = vm
+	case current == nil:
+		spec.Operation = types.ArrayUpdateOperationAdd
+		spec.Info = &types.ClusterDasVmConfigInfo{Key: vm, DasSettings: settings}
+	default:
+		spec.Operation = types.ArrayUpdateOperationEdit
+		spec.Info = &types.ClusterDasVmConfigInfo{Key: vm, DasSettings: settings}
+	}
+
+	ccr := object.NewClusterComputeResource(c.vcclient, cluster)
+	t, err := ccr.Reconfigure(ctx, &types.ClusterConfigSpecEx{DasVmConfigSpec: []types.ClusterDasVmConfigSpec{spec}}, true)
+	if err != nil {
+		return fmt.Errorf("reconfigure cluster: %w", err)
+	}
+	return t.Wait(ctx)
+}
+
+// DisableHARestart disables the vSphere HA restart priority of the given
+// preempted VMs in their cluster. The previous settings are stored in the
+// annotation of each VM before the cluster is reconfigured, so VMs without
+// annotation fail. The returned error lists the VMs for which HA restart was
+// not disabled.
+func (c *Client) DisableHARestart(ctx context.Context, refs []types.ManagedObjectReference) error {
+	logger := activity.GetLogger(ctx)
+
+	if len(refs) == 0 {
+		return nil
+	}
+
+	om, err := object.GetCustomFieldsManager(c.vcclient)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("retrieve custom fields manager", errVSphere, err)
+	}
+
+	key, found, err := c.findCustomField(ctx, om)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return temporal.NewNonRetryableApplicationError("custom field not found", errInternal, nil, "key", c.customField())
+	}
+
+	disabled, err := c.forEachVM(ctx, refs, func(ctx context.Context, ref types.ManagedObjectReference) bool {
+		if err := c.disableHARestart(ctx, om, key, ref); err != nil {
+			logger.Warn("failed to disable ha restart", "error", err, "ref", ref.String())
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	logger.Debug("disabled ha restart", "refs", disabled)
+
+	if len(disabled) < len(refs) {
+		var failed []types.ManagedObjectReference
+		for _, ref := range refs {
+			if !containsRef(disabled, ref) {
+				failed = append(failed, ref)
+			}
+		}
+		msg := fmt.Sprintf("disable ha restart for %d of %d vms failed", len(failed), len(refs))
+		return temporal.NewApplicationError(msg, errVSphere, failed)
+	}
+	return nil
+}
+
+func (c *Client) disableHARestart(ctx context.Context, om *object.CustomFieldsManager, key int32, ref types.ManagedObjectReference) error {
+	a, err := c.getAnnotation(ctx, key, ref)
+	if err != nil {
+		return err
+	}
+	latest := a.Latest()
+	if latest == nil || !latest.Preempted {
+		return errors.New("vm is not annotated as preempted")
+	}
+
+	var original HARestartSettings
+	if latest.HARestart != nil {
+		// stored by a previous preemption or attempt, the current settings
+		// are not the original settings
+		original = *latest.HARestart
+	} else {
+		cluster, err := c.vmCluster(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if cluster == nil {
+			activity.GetLogger(ctx).Debug("vm is not running in a cluster", "ref", ref.String())
+			return nil
+		}
+
+		previous, err := c.dasVmSettings(ctx, *cluster, ref)
+		if err != nil {
+			return err
+		}
+		original = HARestartSettings{Cluster: *cluster, Previous: previous}
+
+		// never lose the original settings
+		latest.HARestart = &original
+		if err = c.setAnnotation(ctx, om, key, ref, a); err != nil {
+			return fmt.Errorf("store ha restart settings: %w", err)
+		}
+	}
+
+	settings := types.ClusterDasVmSettings{}
+	if original.Previous != nil {
+		settings = *original.Previous
+	}
+	settings.RestartPriority = string(types.ClusterDasVmSettingsRestartPriorityDisabled)
+
+	return c.setDasVmSettings(ctx, original.Cluster, ref, &settings)
+}
@@ -0,0 +1,168 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/temporal"
+)
+
+// checkVCenter returns a non-retryable error if the given vCenter does not
+// match the vCenter the worker is connected to
+func checkVCenter(vcenter string) error {
+	var env EnvConfig
+	if err := envconfig.Process("", &env); err != nil {
+		return err
+	}
+
+	u, err := soap.ParseURL(env.VCAddress)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError("parse vcenter url", errInternal, err)
+	}
+
+	if !strings.EqualFold(vcenter, u.Hostname()) && !strings.EqualFold(vcenter, env.VCAddress) {
+		msg := fmt.Sprintf("requested vcenter %q does not match worker vcenter %q", vcenter, u.Hostname())
+		return temporal.NewNonRetryableApplicationError(msg, errInternal, nil)
+	}
+	return nil
+}
+
+// findCluster returns the cluster with the given name
+func (c *Client) findCluster(ctx context.Context, name string) (*object.ClusterComputeResource, error) {
+	ref, err := c.findObject(ctx, "ClusterComputeResource", "cluster", name)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewClusterComputeResource(c.vcclient, ref), nil
+}
+
+// findHost returns the host with the given name
+func (c *Client) findHost(ctx context.Context, name string) (*object.HostSystem, error) {
+	ref, err := c.findObject(ctx, "HostSystem", "host", name)
+	if err != nil {
+		return nil, err
+	}
+	return object.NewHostSystem(c.vcclient, ref), nil
+}
+
+// findObject returns the first managed object of the given kind with the given
+// name. Noun is used in error messages.
+func (c *Client) findObject(ctx context.Context, kind, noun, name string) (types.ManagedObjectReference, error) {
+	kinds := []string{kind}
+
+	m := view.NewManager(c.vcclient)
+	v, err := m.CreateContainerView(ctx, c.vcclient.ServiceContent.RootFolder, kinds, true)
+	if err != nil {
+		return types.ManagedObjectReference{}, temporal.NewApplicationError("create container view", errVSphere, err)
+	}
+	defer func() {
+		_ = v.Destroy(ctx)
+	}()
+
+	refs, err := v.Find(ctx, kinds, property.Filter{"name": name})
+	if err != nil {
+		return types.ManagedObjectReference{}, temporal.NewApplicationError(fmt.Sprintf("find %s %q", noun, name), errVSphere, err)
+	}
+
+	if len(refs) == 0 {
+		return types.ManagedObjectReference{}, temporal.NewNonRetryableApplicationError(fmt.Sprintf("%s %q not found", noun, name), errVSphere, nil)
+	}
+
+	return refs[0], nil
+}
+
+// filterCluster returns the VMs in refs running on a host of the given cluster
+// preserving the order of refs
+func (c *Client) filterCluster(ctx context.Context, cluster string, refs []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	cl, err := c.findCluster(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := property.DefaultCollector(c.vcclient)
+
+	var ccr mo.ClusterComputeResource
+	if err = pc.RetrieveOne(ctx, cl.Reference(), []string{"host"}, &ccr); err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve hosts of cluster %q", cluster), errVSphere, err)
+	}
+
+	hosts := make(map[types.ManagedObjectReference]struct{}, len(ccr.Host))
+	for _, h := range ccr.Host {
+		hosts[h] = struct{}{}
+	}
+
+	return c.filterVMs(ctx, refs, []string{"runtime.host"}, func(vm mo.VirtualMachine) bool {
+		if vm.Runtime.Host == nil {
+			return false
+		}
+		_, ok := hosts[*vm.Runtime.Host]
+		return ok
+	})
+}
+
+// filterHost returns the VMs in refs running on the given host preserving the
+// order of refs
+func (c *Client) filterHost(ctx context.Context, host string, refs []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	h, err := c.findHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.filterVMs(ctx, refs, []string{"runtime.host"}, func(vm mo.VirtualMachine) bool {
+		return vm.Runtime.Host != nil && *vm.Runtime.Host == h.Reference()
+	})
+}
+
+// filterPoweredOn returns the powered on VMs of refs, i.e. VMs which are
+// already powered off or suspended, e.g. preempted in an earlier run, are not
+// preempted again
+func (c *Client) filterPoweredOn(ctx context.Context, refs []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	return c.filterVMs(ctx, refs, []string{"runtime.powerState"}, func(vm mo.VirtualMachine) bool {
+		return vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+	})
+}
+
+// filterVMs retrieves the given properties of the VMs in refs and returns the
+// VMs matching fn preserving the order of refs. Non-VM objects are ignored.
+func (c *Client) filterVMs(ctx context.Context, refs []types.ManagedObjectReference, props []string, fn func(vm mo.VirtualMachine) bool) ([]types.ManagedObjectReference, error) {
+	var vmRefs []types.ManagedObjectReference
+	for _, ref := range refs {
+		if ref.Type == "VirtualMachine" {
+			vmRefs = append(vmRefs, ref)
+		}
+	}
+
+	if len(vmRefs) == 0 {
+		return nil, nil
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(c.vcclient)
+	if err := pc.Retrieve(ctx, vmRefs, props, &vms); err != nil {
+		return nil, temporal.NewApplicationError("retrieve virtual machine properties", errVSphere, err)
+	}
+
+	matches := make(map[types.ManagedObjectReference]struct{}, len(vms))
+	for _, vm := range vms {
+		if fn(vm) {
+			matches[vm.Reference()] = struct{}{}
+		}
+	}
+
+	var filtered []types.ManagedObjectReference
+	for _, ref := range vmRefs {
+		if _, ok := matches[ref]; ok {
+			filtered = append(filtered, ref)
+		}
+	}
+
+	return filtered, nil
+}
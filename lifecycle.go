@@ -0,0 +1,243 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/workflow"
+)
+
+// SkipCode is a stable code for the reason a workflow run was skipped
+type SkipCode string
+
+const (
+	startedEventType   = "com.vmware.workflows.vsphere.PreemptionStartedEvent.v0"   // sent before preempting candidates
+	skippedEventType   = "com.vmware.workflows.vsphere.PreemptionSkippedEvent.v0"   // sent when a run is skipped
+	vmFailedEventType  = "com.vmware.workflows.vsphere.VmPreemptionFailedEvent.v0"  // sent per VM which was not preempted
+	completedEventType = "com.vmware.workflows.vsphere.PreemptionCompletedEvent.v0" // sent when a run (partially) succeeded
+	restoredEventType  = "com.vmware.workflows.vsphere.VmRestoredEvent.v0"          // sent when preempted VMs were restored
+
+	SkipCodeDebounce  SkipCode = "DEBOUNCE"
+	SkipCodeDuplicate SkipCode = "DUPLICATE"
+	SkipCodeVetoed    SkipCode = "VETOED"
+	SkipCodeRejected  SkipCode = "REJECTED"
+)
+
+var skipCodes = map[string]SkipCode{
+	skipReasonDebounce:  SkipCodeDebounce,
+	skipReasonDuplicate: SkipCodeDuplicate,
+	skipReasonVetoed:    SkipCodeVetoed,
+	skipReasonRejected:  SkipCodeRejected,
+}
+
+// runEventData holds the fields common to all lifecycle events
+type runEventData struct {
+	Tag         string      `json:"tag"`
+	Criticality Criticality `json:"criticality"`
+	WorkflowID  string      `json:"workflowID"`
+	RunID       string      `json:"workflowRunID"`
+	Type        RequestType `json:"type,omitempty"`
+	Event       ce.Event    `json:"event"` // event that triggered the run
+}
+
+type startedEventData struct {
+	runEventData
+	Candidates []types.ManagedObjectReference `json:"candidates"`
+}
+
+type skippedEventData struct {
+	runEventData
+	Code   SkipCode `json:"code"`
+	Reason string   `json:"reason"`
+}
+
+type vmFailedEventData struct {
+	runEventData
+	VirtualMachine types.ManagedObjectReference `json:"virtualMachine"`
+	Action         PreemptAction                `json:"action"` // requested action
+	Error          string                       `json:"error"`
+}
+
+type completedEventData struct {
+	runEventData
+	Status          RunStatus                      `json:"status"`
+	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"` // preempted VMs
+	Migrated        []Migration                    `json:"migrated,omitempty"`
+	Error           *RunError                      `json:"error,omitempty"` // first error of a partially succeeded run
+}
+
+type restoredEventData struct {
+	runEventData
+	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"` // restored VMs
+}
+
+func (c *Client) SendStartedEvent(ctx context.Context, wfID string, sink SinkConfig, data startedEventData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-started", wfID, data.Event.ID()) // format: wfID-vcEventID-started
+	return c.sendEvent(ctx, startedEventType, id, sink, meta, data)
+}
+
+func (c *Client) SendSkippedEvent(ctx context.Context, wfID string, sink SinkConfig, data skippedEventData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-skipped", wfID, data.Event.ID()) // format: wfID-vcEventID-skipped
+	return c.sendEvent(ctx, skippedEventType, id, sink, meta, data)
+}
+
+// SendVMFailedEvents sends one event per VM which was not preempted with the
+// VM as subject
+func (c *Client) SendVMFailedEvents(ctx context.Context, wfID string, sink SinkConfig, data []vmFailedEventData, meta EventMeta) error {
+	for _, d := range data {
+		id := fmt.Sprintf("%s-%s-failed-%s", wfID, d.Event.ID(), d.VirtualMachine.Value) // format: wfID-vcEventID-failed-vmID
+		m := meta
+		m.Subject = d.VirtualMachine.Value
+		if err := c.sendEvent(ctx, vmFailedEventType, id, sink, m, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) SendCompletedEvent(ctx context.Context, wfID string, sink SinkConfig, data completedEventData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-completed", wfID, data.Event.ID()) // format: wfID-vcEventID-completed
+	return c.sendEvent(ctx, completedEventType, id, sink, c.withSubject(ctx, meta, data.VirtualMachines), data)
+}
+
+// SendRestoredEvent sends the restored event, one event per restored VM if the
+// sink is configured for per VM events
+func (c *Client) SendRestoredEvent(ctx context.Context, wfID string, sink SinkConfig, data restoredEventData, meta EventMeta) error {
+	id := fmt.Sprintf("%s-%s-restored", wfID, data.Event.ID()) // format: wfID-vcEventID-restored
+	if !sink.PerVM || len(data.VirtualMachines) == 0 {
+		return c.sendEvent(ctx, restoredEventType, id, sink, c.withSubject(ctx, meta, data.VirtualMachines), data)
+	}
+
+	for _, vm := range data.VirtualMachines {
+		d := data
+		d.VirtualMachines = []types.ManagedObjectReference{vm}
+
+		m := meta
+		m.Subject = vm.Value
+		if err := c.sendEvent(ctx, restoredEventType, id+"-"+vm.Value, sink, m, d); err != nil { // format: wfID-vcEventID-restored-vmID
+			return err
+		}
+	}
+	return nil
+}
+
+// lifecycleEvents returns true if lifecycle events are sent for the request
+func lifecycleEvents(ctx workflow.Context, req WorkflowRequest) bool {
+	if len(req.sinks()) == 0 {
+		return false
+	}
+	return workflow.GetVersion(ctx, changeLifecycleEvents, workflow.DefaultVersion, 1) >= 1
+}
+
+func newRunEventData(ctx workflow.Context, req WorkflowRequest) runEventData {
+	info := workflow.GetInfo(ctx)
+	return runEventData{
+		Tag:         req.Tag,
+		Criticality: req.Criticality,
+		WorkflowID:  info.WorkflowExecution.ID,
+		RunID:       info.WorkflowExecution.RunID,
+		Type:        req.Type,
+		Event:       req.Event,
+	}
+}
+
+// sendStarted sends the started event with the preemption candidates. Failures
+// are logged only.
+func sendStarted(ctx workflow.Context, req WorkflowRequest, r *run, candidates []types.ManagedObjectReference) {
+	if len(candidates) == 0 || !lifecycleEvents(ctx, req) {
+		return
+	}
+
+	logger := workflow.GetLogger(ctx)
+	data := startedEventData{
+		runEventData: newRunEventData(ctx, req),
+		Candidates:   candidates,
+	}
+
+	logger.Debug("sending started cloudevent", "candidates", len(candidates))
+	_ = deliver(ctx, req, r, startedEventType, data)
+}
+
+// sendVMFailed sends a failed event for each of the given VMs which is not
+// in stopped. err is the error of the stop activity, if any. Failures are
+// logged only.
+func sendVMFailed(ctx workflow.Context, req WorkflowRequest, r *run, refs, stopped []types.ManagedObjectReference, err error) {
+	if len(stopped) == len(refs) || !lifecycleEvents(ctx, req) {
+		return
+	}
+
+	done := make(map[types.ManagedObjectReference]struct{}, len(stopped))
+	for _, ref := range stopped {
+		done[ref] = struct{}{}
+	}
+
+	msg := "virtual machine was not stopped"
+	if err != nil {
+		msg = err.Error()
+	}
+
+	base := newRunEventData(ctx, req)
+	action := req.Action
+	if action == "" {
+		action = ActionPowerOff
+	}
+
+	var data []vmFailedEventData
+	for _, ref := range refs {
+		if _, ok := done[ref]; ok {
+			continue
+		}
+		data = append(data, vmFailedEventData{
+			runEventData:   base,
+			VirtualMachine: ref,
+			Action:         action,
+			Error:          msg,
+		})
+	}
+
+	logger := workflow.GetLogger(ctx)
+	logger.Debug("sending vm failed cloudevents", "count", len(data))
+	_ = deliver(ctx, req, r, vmFailedEventType, data)
+}
+
+// sendOutcome sends the skipped, completed or restored event depending on the
+// outcome of the run. Failed runs are covered by the failure event. Failures
+// are logged only.
+func sendOutcome(ctx workflow.Context, req WorkflowRequest, r *run) {
+	if r.status == RunStatusFailed || r.status == "" || !lifecycleEvents(ctx, req) {
+		return
+	}
+
+	logger := workflow.GetLogger(ctx)
+	base := newRunEventData(ctx, req)
+
+	switch {
+	case r.status == RunStatusSkipped:
+		data := skippedEventData{
+			runEventData: base,
+			Code:         skipCodes[r.skipReason],
+			Reason:       r.skipReason,
+		}
+		logger.Debug("sending skipped cloudevent", "code", data.Code)
+		_ = deliver(ctx, req, r, skippedEventType, data)
+	case req.Type == RequestTypeRestore:
+		data := restoredEventData{
+			runEventData:    base,
+			VirtualMachines: r.restored,
+		}
+		logger.Debug("sending restored cloudevent", "count", len(r.restored))
+		_ = deliver(ctx, req, r, restoredEventType, data)
+	default:
+		data := completedEventData{
+			runEventData:    base,
+			Status:          r.status,
+			VirtualMachines: r.preempted,
+			Migrated:        r.migrated,
+			Error:           r.err,
+		}
+		logger.Debug("sending completed cloudevent", "status", r.status)
+		_ = deliver(ctx, req, r, completedEventType, data)
+	}
+}
@@ -0,0 +1,54 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+const maintenanceModeTimeout = time.Minute * 30 // vSphere timeout to enter maintenance mode
+
+// EnterMaintenanceMode puts the host with the given name into maintenance mode.
+// Powered on VMs must be evacuated by DRS, otherwise the operation fails.
+func (c *Client) EnterMaintenanceMode(ctx context.Context, host string) error {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	h, err := c.findHost(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	var hs mo.HostSystem
+	pc := property.DefaultCollector(c.vcclient)
+	if err = pc.RetrieveOne(ctx, h.Reference(), []string{"runtime.inMaintenanceMode"}, &hs); err != nil {
+		return temporal.NewApplicationError(fmt.Sprintf("retrieve runtime of host %q", host), errVSphere, err)
+	}
+
+	if hs.Runtime.InMaintenanceMode {
+		logger.Debug("host already in maintenance mode", "host", host)
+		return nil
+	}
+
+	logger.Debug("entering maintenance mode", "host", host, "timeout", maintenanceModeTimeout.String())
+	t, err := h.EnterMaintenanceMode(ctx, int32(maintenanceModeTimeout.Seconds()), false, nil)
+	if err != nil {
+		return temporal.NewApplicationError(fmt.Sprintf("enter maintenance mode on host %q", host), errVSphere, err)
+	}
+
+	// failures, e.g. VMs which cannot be evacuated, are not resolved by retries
+	if err = t.Wait(ctx); err != nil {
+		return temporal.NewNonRetryableApplicationError(fmt.Sprintf("enter maintenance mode on host %q", host), errVSphere, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// PreemptedTag is the name of the tag marking preempted VMs in the marker
+// category of a workflow request
+const PreemptedTag = "preempted"
+
+// preemptedTag returns the ID of the PreemptedTag tag in the given category.
+// The tag is created if it does not exist.
+func (c *Client) preemptedTag(ctx context.Context, category string) (string, error) {
+	logger := activity.GetLogger(ctx)
+
+	cat, err := c.tagManager.GetCategory(ctx, category)
+	if err != nil {
+		return "", temporal.NewApplicationError(fmt.Sprintf("get tag category %q", category), errVSphere, err)
+	}
+
+	tag, err := c.tagManager.GetTagForCategory(ctx, PreemptedTag, cat.ID)
+	if err == nil {
+		return tag.ID, nil
+	}
+	if !strings.Contains(err.Error(), "not found in category") {
+		return "", temporal.NewApplicationError(fmt.Sprintf("get tag %q in category %q", PreemptedTag, category), errVSphere, err)
+	}
+
+	logger.Debug("preempted tag not found, creating tag", "tag", PreemptedTag, "category", category)
+	id, err := c.tagManager.CreateTag(ctx, &tags.Tag{
+		Name:        PreemptedTag,
+		Description: "virtual machine preempted by vsphere-preemption",
+		CategoryID:  cat.ID,
+	})
+	if err != nil {
+		return "", temporal.NewApplicationError(fmt.Sprintf("create tag %q in category %q", PreemptedTag, category), errVSphere, err)
+	}
+	return id, nil
+}
+
+// markPreempted attaches the PreemptedTag tag of the given category to the
+// given VMs
+func (c *Client) markPreempted(ctx context.Context, category string, refs []types.ManagedObjectReference) error {
+	id, err := c.preemptedTag(ctx, category)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]mo.Reference, 0, len(refs))
+	for _, ref := range refs {
+		objs = append(objs, ref)
+	}
+
+	if err = c.tagManager.AttachTagToMultipleObjects(ctx, id, objs); err != nil {
+		return temporal.NewApplicationError(fmt.Sprintf("attach tag %q", PreemptedTag), errVSphere, err)
+	}
+	return nil
+}
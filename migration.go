@@ -0,0 +1,363 @@
+package preemption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+const DefaultMigrationTimeout = time.Minute * 10 // used when migration target does not specify a timeout
+
+// MigrationTarget is the overflow capacity preemptible VMs are migrated to
+// instead of being preempted
+type MigrationTarget struct {
+	Cluster   string        `json:"cluster"`             // overflow cluster
+	HostGroup string        `json:"hostGroup,omitempty"` // only use hosts in this DRS host group of the overflow cluster if set
+	Timeout   time.Duration `json:"timeout,omitempty"`   // per VM, defaults to DefaultMigrationTimeout
+}
+
+func (t MigrationTarget) timeout() time.Duration {
+	if t.Timeout <= 0 {
+		return DefaultMigrationTimeout
+	}
+	return t.Timeout
+}
+
+// Migration is a preemptible VM migrated to the overflow capacity
+type Migration struct {
+	VM      types.ManagedObjectReference `json:"vm"`
+	Cluster string                       `json:"cluster"`
+	Host    string                       `json:"host,omitempty"` // unknown if the activity failed after migrating the VM
+}
+
+// overflowHost is a host of the migration target and its unreserved capacity
+type overflowHost struct {
+	ref      types.ManagedObjectReference
+	name     string
+	cpuMhz   int64
+	memoryMB int64
+}
+
+// vmDemand is the capacity required by a VM on the overflow host
+type vmDemand struct {
+	cpuMhz   int64
+	memoryMB int64
+}
+
+// MigrateVMs migrates the given VMs to the host of the migration target with
+// the most free memory. VMs which do not fit on any host or fail to migrate
+// within the migration timeout are not returned and must be preempted.
+// Migrated VMs are recorded as heartbeat details and skipped when the activity
+// is retried. If the activity fails after VMs were migrated, the migrated VMs
+// are returned as error details.
+func (c *Client) MigrateVMs(ctx context.Context, refs []types.ManagedObjectReference, target MigrationTarget) ([]Migration, error) {
+	logger := activity.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(refs) == 0 {
+		logger.Debug("empty list of virtual machines")
+		return nil, nil
+	}
+
+	var p progress
+	if activity.HasHeartbeatDetails(ctx) {
+		if err := activity.GetHeartbeatDetails(ctx, &p.done); err != nil {
+			logger.Warn("get heartbeat details, migrating all vms", "error", err)
+			p.done = nil
+		}
+	}
+
+	// send heartbeats
+	go p.heartbeat(ctx)
+
+	pending := make([]types.ManagedObjectReference, 0, len(refs))
+	for _, ref := range refs {
+		if !p.contains(ref) {
+			pending = append(pending, ref)
+		}
+	}
+	if len(pending) < len(refs) {
+		logger.Debug("skipping vms migrated in previous attempt", "count", len(refs)-len(pending))
+	}
+
+	cl, err := c.findCluster(ctx, target.Cluster)
+	if err != nil {
+		return nil, migrationError(err, p.done)
+	}
+
+	pool, err := cl.ResourcePool(ctx)
+	if err != nil {
+		err = temporal.NewApplicationError(fmt.Sprintf("get resource pool of cluster %q", target.Cluster), errVSphere, err)
+		return nil, migrationError(err, p.done)
+	}
+
+	hosts, err := c.overflowHosts(ctx, cl, target.HostGroup)
+	if err != nil {
+		return nil, migrationError(err, p.done)
+	}
+	if len(hosts) == 0 {
+		logger.Warn("no usable hosts in migration target", "cluster", target.Cluster, "hostGroup", target.HostGroup)
+		pending = nil
+	}
+
+	var demands map[types.ManagedObjectReference]vmDemand
+	if len(pending) > 0 {
+		if demands, err = c.vmDemands(ctx, pending); err != nil {
+			return nil, migrationError(err, p.done)
+		}
+	}
+
+	var (
+		mu    sync.Mutex
+		moved = make(map[types.ManagedObjectReference]string, len(refs))
+	)
+
+	logger.Debug("migrating vms", "refs", pending)
+	lim := newLimiter(concurrentVCenterCalls) // limit concurrent vc calls
+	wg := sync.WaitGroup{}
+	for i := range pending {
+		ref := pending[i]
+		lim.acquire()
+		wg.Add(1)
+		go func() {
+			defer func() {
+				lim.release()
+				wg.Done()
+			}()
+
+			demand := demands[ref]
+
+			mu.Lock()
+			host := reserveHost(hosts, demand)
+			mu.Unlock()
+
+			if host == nil {
+				logger.Info("no overflow host with sufficient capacity", "ref", ref.String(), "cpuMhz", demand.cpuMhz, "memoryMB", demand.memoryMB)
+				return
+			}
+
+			if err := c.migrateVm(ctx, ref, pool.Reference(), host.ref, target.timeout()); err != nil {
+				logger.Warn("failed to migrate vm", "error", err, "ref", ref.String(), "host", host.name)
+
+				mu.Lock()
+				host.cpuMhz += demand.cpuMhz
+				host.memoryMB += demand.memoryMB
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			moved[ref] = host.name
+			mu.Unlock()
+			p.add(ctx, ref)
+		}()
+	}
+
+	logger.Debug("waiting for operations to finish")
+	wg.Wait()
+
+	if len(pending) < len(refs) {
+		// hosts of vms migrated in previous attempt
+		c.migratedHosts(ctx, refs, hosts, moved)
+	}
+
+	migrations := make([]Migration, 0, len(refs))
+	for _, ref := range refs {
+		if p.contains(ref) {
+			migrations = append(migrations, Migration{VM: ref, Cluster: target.Cluster, Host: moved[ref]})
+		}
+	}
+	logger.Debug("migrated vms", "count", len(migrations))
+
+	return migrations, nil
+}
+
+// migrationError adds the given migrated VMs as details to err so they are
+// not preempted by the workflow
+func migrationError(err error, migrated []types.ManagedObjectReference) error {
+	if len(migrated) == 0 {
+		return err
+	}
+
+	errType, nonRetryable := errVSphere, false
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		errType, nonRetryable = appErr.Type(), appErr.NonRetryable()
+	}
+
+	if nonRetryable {
+		return temporal.NewNonRetryableApplicationError(err.Error(), errType, err, migrated)
+	}
+	return temporal.NewApplicationError(err.Error(), errType, err, migrated)
+}
+
+// migratedHosts adds the names of the overflow hosts of the given VMs not in
+// moved to moved. Failures are logged only, the host of a migration is
+// informational.
+func (c *Client) migratedHosts(ctx context.Context, refs []types.ManagedObjectReference, hosts []*overflowHost, moved map[types.ManagedObjectReference]string) {
+	pc := property.DefaultCollector(c.vcclient)
+
+	var vms []mo.VirtualMachine
+	if err := pc.Retrieve(ctx, refs, []string{"runtime.host"}, &vms); err != nil {
+		activity.GetLogger(ctx).Warn("retrieve hosts of migrated vms", "error", err)
+		return
+	}
+
+	for _, vm := range vms {
+		if _, ok := moved[vm.Reference()]; ok || vm.Runtime.Host == nil {
+			continue
+		}
+		for _, h := range hosts {
+			if h.ref == *vm.Runtime.Host {
+				moved[vm.Reference()] = h.name
+				break
+			}
+		}
+	}
+}
+
+// overflowHosts returns the connected hosts of the given cluster not in
+// maintenance mode, restricted to the members of the given DRS host group if
+// set
+func (c *Client) overflowHosts(ctx context.Context, cl *object.ClusterComputeResource, group string) ([]*overflowHost, error) {
+	pc := property.DefaultCollector(c.vcclient)
+
+	var ccr mo.ClusterComputeResource
+	if err := pc.RetrieveOne(ctx, cl.Reference(), []string{"name", "host", "configurationEx"}, &ccr); err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve hosts of cluster %q", cl.Reference().Value), errVSphere, err)
+	}
+
+	members := ccr.Host
+	if group != "" {
+		members = nil
+
+		var found bool
+		if cfg, ok := ccr.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+			for _, g := range cfg.Group {
+				if hg, ok := g.(*types.ClusterHostGroup); ok && hg.Name == group {
+					members = hg.Host
+					found = true
+					break
+				}
+			}
+		}
+
+		if !found {
+			msg := fmt.Sprintf("host group %q not found in cluster %q", group, ccr.Name)
+			return nil, temporal.NewNonRetryableApplicationError(msg, errVSphere, nil)
+		}
+	}
+
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	var hs []mo.HostSystem
+	if err := pc.Retrieve(ctx, members, []string{"name", "runtime", "summary.hardware", "summary.quickStats"}, &hs); err != nil {
+		return nil, temporal.NewApplicationError(fmt.Sprintf("retrieve hosts of cluster %q", ccr.Name), errVSphere, err)
+	}
+
+	hosts := make([]*overflowHost, 0, len(hs))
+	for _, h := range hs {
+		if h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected || h.Runtime.InMaintenanceMode {
+			continue
+		}
+
+		hw := h.Summary.Hardware
+		if hw == nil {
+			continue
+		}
+
+		stats := h.Summary.QuickStats
+		hosts = append(hosts, &overflowHost{
+			ref:      h.Reference(),
+			name:     h.Name,
+			cpuMhz:   int64(hw.CpuMhz)*int64(hw.NumCpuCores) - int64(stats.OverallCpuUsage),
+			memoryMB: hw.MemorySize/(1024*1024) - int64(stats.OverallMemoryUsage),
+		})
+	}
+
+	return hosts, nil
+}
+
+// vmDemands returns the configured memory and current CPU usage of the given
+// VMs
+func (c *Client) vmDemands(ctx context.Context, refs []types.ManagedObjectReference) (map[types.ManagedObjectReference]vmDemand, error) {
+	pc := property.DefaultCollector(c.vcclient)
+
+	var vms []mo.VirtualMachine
+	if err := pc.Retrieve(ctx, refs, []string{"summary.config.memorySizeMB", "summary.quickStats.overallCpuUsage"}, &vms); err != nil {
+		return nil, temporal.NewApplicationError("retrieve vm resource demand", errVSphere, err)
+	}
+
+	demands := make(map[types.ManagedObjectReference]vmDemand, len(vms))
+	for _, vm := range vms {
+		demands[vm.Reference()] = vmDemand{
+			cpuMhz:   int64(vm.Summary.QuickStats.OverallCpuUsage),
+			memoryMB: int64(vm.Summary.Config.MemorySizeMB),
+		}
+	}
+	return demands, nil
+}
+
+// reserveHost returns the host with the most free memory which fits the given
+// demand and reserves the demand on this host. Nil is returned if no host has
+// sufficient capacity.
+func reserveHost(hosts []*overflowHost, demand vmDemand) *overflowHost {
+	var best *overflowHost
+	for _, h := range hosts {
+		if h.cpuMhz < demand.cpuMhz || h.memoryMB < demand.memoryMB {
+			continue
+		}
+		if best == nil || h.memoryMB > best.memoryMB {
+			best = h
+		}
+	}
+
+	if best != nil {
+		best.cpuMhz -= demand.cpuMhz
+		best.memoryMB -= demand.memoryMB
+	}
+	return best
+}
+
+// migrateVm migrates the VM to the given resource pool and host. The migration
+// task is cancelled if it does not complete within timeout.
+func (c *Client) migrateVm(ctx context.Context, ref, pool, host types.ManagedObjectReference, timeout time.Duration) error {
+	o := object.NewVirtualMachine(c.vcclient, ref)
+
+	spec := types.VirtualMachineRelocateSpec{
+		Pool: &pool,
+		Host: &host,
+	}
+
+	task, err := o.Relocate(ctx, spec, types.VirtualMachineMovePriorityDefaultPriority)
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err = task.Wait(waitCtx); err != nil {
+		if waitCtx.Err() != nil {
+			// do not leave a long-running migration behind
+			if cErr := task.Cancel(ctx); cErr != nil {
+				activity.GetLogger(ctx).Warn("failed to cancel migration task", "error", cErr, "ref", ref.String())
+			}
+			return fmt.Errorf("migration did not complete within %s: %w", timeout, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package preemption
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_reserveHost(t *testing.T) {
+	newHosts := func() []*overflowHost {
+		return []*overflowHost{
+			{name: "esx-1", cpuMhz: 4000, memoryMB: 2048},
+			{name: "esx-2", cpuMhz: 1000, memoryMB: 8192},
+		}
+	}
+
+	t.Run("selects host with most free memory", func(t *testing.T) {
+		hosts := newHosts()
+		h := reserveHost(hosts, vmDemand{cpuMhz: 500, memoryMB: 1024})
+		assert.Assert(t, h != nil)
+		assert.Equal(t, h.name, "esx-2")
+		assert.Equal(t, h.cpuMhz, int64(500))
+		assert.Equal(t, h.memoryMB, int64(7168))
+	})
+
+	t.Run("skips host with insufficient cpu", func(t *testing.T) {
+		hosts := newHosts()
+		h := reserveHost(hosts, vmDemand{cpuMhz: 2000, memoryMB: 1024})
+		assert.Assert(t, h != nil)
+		assert.Equal(t, h.name, "esx-1")
+	})
+
+	t.Run("returns nil if no host fits", func(t *testing.T) {
+		hosts := newHosts()
+		h := reserveHost(hosts, vmDemand{cpuMhz: 2000, memoryMB: 4096})
+		assert.Assert(t, h == nil)
+		for i, want := range newHosts() {
+			assert.Equal(t, *hosts[i], *want)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package preemption
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+const (
+	RedeliverSignalChannel = "PreemptVMsRedeliverChan"
+	PendingEventsQueryType = "pending_events"
+
+	DefaultEventExpiry = time.Hour * 24 // used when request does not specify event expiry
+
+	outboxInitialInterval = time.Minute * 5 // first redelivery attempt after failed delivery
+	outboxMaxInterval     = time.Hour
+	maxPendingEvents      = 100 // oldest pending events are dropped when full
+)
+
+// sendActivities maps event types to the name of their send activity
+var sendActivities = map[string]string{
+	eventType:          "SendPreemptedEvent",
+	approvalEventType:  "SendApprovalRequestEvent",
+	failedEventType:    "SendFailedEvent",
+	startedEventType:   "SendStartedEvent",
+	skippedEventType:   "SendSkippedEvent",
+	vmFailedEventType:  "SendVMFailedEvents",
+	completedEventType: "SendCompletedEvent",
+	restoredEventType:  "SendRestoredEvent",
+}
+
+// PendingEvent is an event which could not be delivered to a sink. Pending
+// events are kept in the workflow and redelivered with an increasing interval
+// until they are delivered or expire.
+type PendingEvent struct {
+	ID          string          `json:"id"` // sequence number within the workflow
+	EventType   string          `json:"eventType"`
+	Sink        SinkConfig      `json:"sink"`
+	Data        json.RawMessage `json:"data"`
+	Meta        EventMeta       `json:"meta"`
+	Created     time.Time       `json:"created"`
+	Expires     time.Time       `json:"expires"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	Attempts    int             `json:"attempts"` // redelivery attempts
+	LastError   string          `json:"lastError,omitempty"`
+}
+
+// RedeliverRequest is sent as a signal to RedeliverSignalChannel to redeliver
+// pending events immediately
+type RedeliverRequest struct {
+	IDs []string `json:"ids,omitempty"` // all pending events if empty
+}
+
+// outbox holds the pending events of the workflow and schedules their
+// redelivery
+type outbox struct {
+	events  []PendingEvent
+	seq     int
+	dropped int // expired or dropped when full
+
+	timer  workflow.Future // pending redelivery timer, nil if no events are pending
+	due    time.Time       // fire time of timer
+	cancel workflow.CancelFunc
+}
+
+// add adds the given events to the outbox, dropping the oldest events if the
+// outbox is full
+func (o *outbox) add(ctx workflow.Context, events ...PendingEvent) {
+	logger := workflow.GetLogger(ctx)
+
+	for _, e := range events {
+		o.seq++
+		e.ID = strconv.Itoa(o.seq)
+		o.events = append(o.events, e)
+		logger.Info("keeping undelivered event for redelivery", "id", e.ID, "type", e.EventType, "sink", e.Sink.URL, "nextAttempt", e.NextAttempt.UTC().String())
+	}
+
+	if n := len(o.events) - maxPendingEvents; n > 0 {
+		logger.Warn("outbox full, dropping oldest pending events", "count", n)
+		o.events = o.events[n:]
+		o.dropped += n
+	}
+}
+
+// schedule starts a timer for the next due redelivery, replacing a pending
+// timer which fires later
+func (o *outbox) schedule(ctx workflow.Context) {
+	if len(o.events) == 0 {
+		return
+	}
+
+	next := o.events[0].NextAttempt
+	for _, e := range o.events[1:] {
+		if e.NextAttempt.Before(next) {
+			next = e.NextAttempt
+		}
+	}
+
+	if o.timer != nil {
+		if !o.due.After(next) {
+			return
+		}
+		o.cancel()
+	}
+
+	d := next.Sub(workflow.Now(ctx))
+	if d < time.Second {
+		d = time.Second
+	}
+
+	timerCtx, cancel := workflow.WithCancel(ctx)
+	o.timer = workflow.NewTimer(timerCtx, d)
+	o.due = next
+	o.cancel = cancel
+}
+
+// redeliver drops expired events and redelivers the due events or, if ids are
+// given, the events with these ids
+func (o *outbox) redeliver(ctx workflow.Context, ids []string) {
+	logger := workflow.GetLogger(ctx)
+	info := workflow.GetInfo(ctx)
+	now := workflow.Now(ctx)
+
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	options := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute * 5,
+		HeartbeatTimeout:    time.Second * 5,
+		RetryPolicy:         &temporal.RetryPolicy{MaximumAttempts: 1}, // retried by the outbox
+	}
+	ctx = workflow.WithActivityOptions(ctx, options)
+
+	// o.events is served by the pending events query while redelivery blocks
+	// on activities, so it is replaced only after filtering
+	pending := make([]PendingEvent, 0, len(o.events))
+	for _, e := range o.events {
+		if !now.Before(e.Expires) {
+			logger.Warn("dropping expired pending event", "id", e.ID, "type", e.EventType, "sink", e.Sink.URL, "attempts", e.Attempts)
+			o.dropped++
+			continue
+		}
+
+		if (len(ids) > 0 && !selected[e.ID]) || (len(ids) == 0 && now.Before(e.NextAttempt)) {
+			pending = append(pending, e)
+			continue
+		}
+
+		logger.Debug("redelivering pending event", "id", e.ID, "type", e.EventType, "sink", e.Sink.URL)
+		err := workflow.ExecuteActivity(ctx, sendActivities[e.EventType], info.WorkflowExecution.ID, e.Sink, e.Data, e.Meta).Get(ctx, nil)
+		if err == nil {
+			logger.Info("redelivered pending event", "id", e.ID, "type", e.EventType, "sink", e.Sink.URL)
+			continue
+		}
+
+		e.Attempts++
+		e.LastError = err.Error()
+		e.NextAttempt = workflow.Now(ctx).Add(outboxBackoff(e.Attempts))
+		logger.Warn("redeliver pending event", "id", e.ID, "type", e.EventType, "sink", e.Sink.URL, "attempts", e.Attempts, "error", err)
+		pending = append(pending, e)
+	}
+	o.events = pending
+}
+
+// expedite makes the events with the given ids, or all events if no ids are
+// given, due for redelivery
+func (o *outbox) expedite(ctx workflow.Context, ids []string) {
+	now := workflow.Now(ctx)
+
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	events := make([]PendingEvent, 0, len(o.events))
+	for _, e := range o.events {
+		if len(ids) == 0 || selected[e.ID] {
+			e.NextAttempt = now
+		}
+		events = append(events, e)
+	}
+	o.events = events
+}
+
+// outboxBackoff returns the interval until the next redelivery after the
+// given number of failed redelivery attempts
+func outboxBackoff(attempts int) time.Duration {
+	d := outboxInitialInterval
+	for i := 0; i < attempts && d < outboxMaxInterval; i++ {
+		d *= 2
+	}
+	if d > outboxMaxInterval {
+		d = outboxMaxInterval
+	}
+	return d
+}
+
+// newPendingEvent returns the pending event for the failed delivery of data to
+// the given sink
+func newPendingEvent(ctx workflow.Context, req WorkflowRequest, eventType string, sink SinkConfig, data interface{}, meta EventMeta, err error) (PendingEvent, error) {
+	b, mErr := json.Marshal(data)
+	if mErr != nil {
+		return PendingEvent{}, mErr
+	}
+
+	expiry := req.EventExpiry
+	if expiry <= 0 {
+		expiry = DefaultEventExpiry
+	}
+
+	now := workflow.Now(ctx)
+	return PendingEvent{
+		EventType:   eventType,
+		Sink:        sink,
+		Data:        b,
+		Meta:        meta,
+		Created:     now,
+		Expires:     now.Add(expiry),
+		NextAttempt: now.Add(outboxInitialInterval),
+		LastError:   err.Error(),
+	}, nil
+}
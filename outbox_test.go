@@ -0,0 +1,24 @@
+package preemption
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_outboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: time.Minute * 5},
+		{attempts: 1, want: time.Minute * 10},
+		{attempts: 3, want: time.Minute * 40},
+		{attempts: 4, want: time.Hour},
+		{attempts: 100, want: time.Hour},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, outboxBackoff(tt.attempts), tt.want)
+	}
+}
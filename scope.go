@@ -0,0 +1,75 @@
+package preemption
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	WorkflowIDPrefix = "preemption" // prefix of all scoped workflow IDs
+	ScopeAny         = "*"          // matches any vCenter or cluster in a scope
+)
+
+// Scope identifies the virtual machines a preemption workflow is responsible
+// for. Each scope is served by its own workflow instance, i.e. requests for
+// different scopes are debounced and preempted independently.
+type Scope struct {
+	VCenter string `json:"vcenter,omitempty"` // empty for any vCenter
+	Cluster string `json:"cluster,omitempty"` // empty for any cluster
+	Tag     string `json:"tag"`
+}
+
+// WorkflowID returns the workflow ID for the scope in the format
+// preemption/<vcenter>/<cluster>/<tag>. Empty vCenter and cluster values are
+// replaced with ScopeAny.
+func (s Scope) WorkflowID() string {
+	parts := []string{
+		WorkflowIDPrefix,
+		escapeScope(s.VCenter),
+		escapeScope(s.Cluster),
+		url.PathEscape(s.Tag),
+	}
+	return strings.Join(parts, "/")
+}
+
+// ParseScope returns the scope encoded in the given workflow ID
+func ParseScope(workflowID string) (Scope, error) {
+	parts := strings.Split(workflowID, "/")
+	if len(parts) != 4 || parts[0] != WorkflowIDPrefix {
+		return Scope{}, fmt.Errorf("workflow id %q is not a scoped preemption workflow id", workflowID)
+	}
+
+	var (
+		s   Scope
+		err error
+	)
+
+	if s.VCenter, err = unescapeScope(parts[1]); err != nil {
+		return Scope{}, fmt.Errorf("parse vcenter in workflow id %q: %w", workflowID, err)
+	}
+
+	if s.Cluster, err = unescapeScope(parts[2]); err != nil {
+		return Scope{}, fmt.Errorf("parse cluster in workflow id %q: %w", workflowID, err)
+	}
+
+	if s.Tag, err = url.PathUnescape(parts[3]); err != nil {
+		return Scope{}, fmt.Errorf("parse tag in workflow id %q: %w", workflowID, err)
+	}
+
+	return s, nil
+}
+
+func escapeScope(value string) string {
+	if value == "" {
+		return ScopeAny
+	}
+	return url.PathEscape(value)
+}
+
+func unescapeScope(value string) (string, error) {
+	if value == ScopeAny {
+		return "", nil
+	}
+	return url.PathUnescape(value)
+}
@@ -0,0 +1,48 @@
+package preemption
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestScope_WorkflowID(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope Scope
+		want  string
+	}{
+		{name: "tag only", scope: Scope{Tag: "preemptible"}, want: "preemption/*/*/preemptible"},
+		{name: "cluster and tag", scope: Scope{Cluster: "cluster01", Tag: "preemptible"}, want: "preemption/*/cluster01/preemptible"},
+		{name: "full scope", scope: Scope{VCenter: "vc01.corp.local", Cluster: "cluster01", Tag: "preemptible"}, want: "preemption/vc01.corp.local/cluster01/preemptible"},
+		{name: "escapes slashes", scope: Scope{Cluster: "dc/cluster01", Tag: "low/prio"}, want: "preemption/*/dc%2Fcluster01/low%2Fprio"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.scope.WorkflowID()
+			assert.Equal(t, got, tt.want)
+
+			parsed, err := ParseScope(got)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, parsed, tt.scope)
+		})
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		name       string
+		workflowID string
+		wantErr    string
+	}{
+		{name: "legacy workflow id", workflowID: "preempctl-run", wantErr: "not a scoped preemption workflow id"},
+		{name: "wrong prefix", workflowID: "other/*/*/preemptible", wantErr: "not a scoped preemption workflow id"},
+		{name: "invalid escaping", workflowID: "preemption/*/%zz/preemptible", wantErr: "parse cluster"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseScope(tt.workflowID)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package preemption
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+func newSignedEvent(t *testing.T, key []byte) ce.Event {
+	t.Helper()
+
+	e := newTestEvent("https://temporal.test.local/default", "wf-1-completed")
+	e.SetType(completedEventType)
+	e.SetTime(time.Date(2021, 11, 24, 20, 26, 0, 980410000, time.UTC))
+	e.SetSubject("cluster-1")
+	assert.NilError(t, e.SetData(ce.ApplicationJSON, map[string]string{"status": "SUCCEEDED"}))
+	SignEvent(&e, key)
+	return e
+}
+
+func TestVerifyEvent(t *testing.T) {
+	key := []byte("signing-secret")
+
+	t.Run("verifies signed event after JSON round trip", func(t *testing.T) {
+		b, err := json.Marshal(newSignedEvent(t, key))
+		assert.NilError(t, err)
+
+		var e ce.Event
+		assert.NilError(t, json.Unmarshal(b, &e))
+		assert.NilError(t, VerifyEvent(e, key))
+	})
+
+	t.Run("fails for different key", func(t *testing.T) {
+		e := newSignedEvent(t, key)
+		assert.ErrorContains(t, VerifyEvent(e, []byte("other-secret")), "signature mismatch")
+	})
+
+	t.Run("fails for modified data", func(t *testing.T) {
+		e := newSignedEvent(t, key)
+		assert.NilError(t, e.SetData(ce.ApplicationJSON, map[string]string{"status": "FAILED"}))
+		assert.ErrorContains(t, VerifyEvent(e, key), "signature mismatch")
+	})
+
+	t.Run("fails for modified subject or content type", func(t *testing.T) {
+		e := newSignedEvent(t, key)
+		e.SetSubject("other-cluster")
+		assert.ErrorContains(t, VerifyEvent(e, key), "signature mismatch")
+
+		e = newSignedEvent(t, key)
+		e.SetDataContentType("text/plain")
+		assert.ErrorContains(t, VerifyEvent(e, key), "signature mismatch")
+	})
+
+	t.Run("fails for unsigned event", func(t *testing.T) {
+		e := newTestEvent("https://temporal.test.local/default", "wf-1-completed")
+		assert.ErrorContains(t, VerifyEvent(e, key), "not signed")
+	})
+
+	t.Run("fails for invalid signature format", func(t *testing.T) {
+		e := newSignedEvent(t, key)
+		e.SetExtension(SignatureExtension, "md5=abc")
+		assert.ErrorContains(t, VerifyEvent(e, key), "invalid signature format")
+	})
+}
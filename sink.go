@@ -0,0 +1,569 @@
+package preemption
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+// Sink delivers the CloudEvents sent by the workflow to a destination. The
+// sink of an event is selected by the URL scheme of the sink configured in
+// the workflow request.
+type Sink interface {
+	Send(ctx context.Context, event ce.Event) error
+}
+
+// SinkFactory creates the Sink for the given sink configuration, including
+// its URL, auth and encoding settings
+type SinkFactory func(cfg SinkConfig) (Sink, error)
+
+// HTTPEncoding is the CloudEvents HTTP content mode of a sink
+type HTTPEncoding string
+
+const (
+	EncodingBinary     HTTPEncoding = "binary"     // attributes as ce- headers, data as body
+	EncodingStructured HTTPEncoding = "structured" // event as application/cloudevents+json body
+)
+
+const (
+	SinkSchemeHTTP   = "http"   // CloudEvents over HTTP
+	SinkSchemeHTTPS  = "https"  // CloudEvents over HTTP
+	SinkSchemeFile   = "file"   // append-only JSONL file in the worker file sink directory, e.g. file:///var/log/preemption/events.jsonl
+	SinkSchemeStdout = "stdout" // JSONL on the worker stdout for debugging, i.e. stdout://
+)
+
+// SinkConfig is a destination for the events of a workflow run
+type SinkConfig struct {
+	URL            string     `json:"url"`                      // scheme selects the sink
+	Retry          *SinkRetry `json:"retry,omitempty"`          // defaults to the activity retry policy (3 attempts)
+	Auth           *SinkAuth  `json:"auth,omitempty"`           // HTTP sinks only
+	SigningKeyFile string     `json:"signingKeyFile,omitempty"` // HMAC-SHA256 key in the worker secret directory, events are signed if set
+
+	Encoding HTTPEncoding `json:"encoding,omitempty"` // HTTP sinks only, defaults to EncodingBinary
+	Tracing  bool         `json:"tracing,omitempty"`  // set W3C traceparent and tracestate extensions
+	PerVM    bool         `json:"perVM,omitempty"`    // one preempted and restored event per VM instead of one per run
+}
+
+// SinkAuth configures the authentication of HTTP sinks. Secrets are file names
+// in the secret directory of the worker (SINK_SECRET_DIR) and read on each
+// delivery, so they are not stored in the workflow history and can be rotated
+// without restarting the worker. Credentials are only sent to the sink host
+// they are bound to on the worker (SINK_SECRET_HOSTS).
+type SinkAuth struct {
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+	Username        string `json:"username,omitempty"`       // basic auth
+	PasswordFile    string `json:"passwordFile,omitempty"`   // basic auth
+	ClientCertFile  string `json:"clientCertFile,omitempty"` // PEM, mutual TLS
+	ClientKeyFile   string `json:"clientKeyFile,omitempty"`  // PEM, mutual TLS
+	CAFile          string `json:"caFile,omitempty"`         // PEM bundle trusted in addition to the system CAs
+}
+
+// SinkRetry is the retry policy for deliveries to a sink, unset fields
+// default to the activity retry policy
+type SinkRetry struct {
+	MaxAttempts     int32         `json:"maxAttempts,omitempty"` // 1 disables retries
+	InitialInterval time.Duration `json:"initialInterval,omitempty"`
+	MaxInterval     time.Duration `json:"maxInterval,omitempty"`
+}
+
+// Delivery is the delivery status of an event to a sink
+type Delivery struct {
+	Sink      string `json:"sink"` // sink URL
+	EventType string `json:"eventType"`
+	Delivered bool   `json:"delivered"`
+	Queued    bool   `json:"queued,omitempty"` // kept in the outbox for redelivery
+	Error     string `json:"error,omitempty"`
+}
+
+func (s SinkConfig) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return fmt.Errorf("sink %q invalid: %w", s.URL, err)
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("sink %q invalid: missing scheme", s.URL)
+	}
+	switch s.Encoding {
+	case "":
+	case EncodingBinary, EncodingStructured:
+		if u.Scheme != SinkSchemeHTTP && u.Scheme != SinkSchemeHTTPS {
+			return fmt.Errorf("sink %q invalid: encoding only supported for http sinks", s.URL)
+		}
+	default:
+		return fmt.Errorf("sink %q invalid: unsupported encoding %q", s.URL, s.Encoding)
+	}
+	if u.Scheme == SinkSchemeFile && (!strings.HasPrefix(u.Path, "/") || hasParentRef(u.Path)) {
+		return fmt.Errorf("sink %q invalid: file sink path must be absolute and must not contain \"..\"", s.URL)
+	}
+	if s.Retry != nil && (s.Retry.MaxAttempts < 0 || s.Retry.InitialInterval < 0 || s.Retry.MaxInterval < 0) {
+		return fmt.Errorf("sink %q invalid: retry settings must not be negative", s.URL)
+	}
+	if a := s.Auth; a != nil {
+		switch {
+		case u.Scheme != SinkSchemeHTTP && u.Scheme != SinkSchemeHTTPS:
+			return fmt.Errorf("sink %q invalid: auth only supported for http sinks", s.URL)
+		case a.BearerTokenFile != "" && a.Username != "":
+			return fmt.Errorf("sink %q invalid: bearer token and basic auth are mutually exclusive", s.URL)
+		case (a.Username == "") != (a.PasswordFile == ""):
+			return fmt.Errorf("sink %q invalid: basic auth requires username and password file", s.URL)
+		case (a.ClientCertFile == "") != (a.ClientKeyFile == ""):
+			return fmt.Errorf("sink %q invalid: mutual TLS requires client certificate and key file", s.URL)
+		}
+	}
+	for _, name := range s.secrets() {
+		if !validSecretName(name) {
+			return fmt.Errorf("sink %q invalid: secret %q must be a file name relative to the worker secret directory", s.URL, name)
+		}
+	}
+	return nil
+}
+
+// secrets returns the names of all secrets referenced by the sink
+func (s SinkConfig) secrets() []string {
+	var names []string
+	if s.Auth != nil {
+		names = append(names, s.Auth.BearerTokenFile, s.Auth.PasswordFile, s.Auth.ClientCertFile, s.Auth.ClientKeyFile, s.Auth.CAFile)
+	}
+	names = append(names, s.SigningKeyFile)
+
+	set := names[:0]
+	for _, n := range names {
+		if n != "" {
+			set = append(set, n)
+		}
+	}
+	return set
+}
+
+// validSecretName returns true if name is a relative path which does not
+// leave the secret directory
+func validSecretName(name string) bool {
+	return name != "" && !filepath.IsAbs(name) && !strings.HasPrefix(name, "/") && !hasParentRef(name)
+}
+
+// hasParentRef returns true if path contains a ".." element
+func hasParentRef(path string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON also accepts a plain URL as used by activities scheduled by
+// earlier releases with the replyTo address as target
+func (s *SinkConfig) UnmarshalJSON(b []byte) error {
+	var target string
+	if err := json.Unmarshal(b, &target); err == nil {
+		*s = SinkConfig{URL: target}
+		return nil
+	}
+
+	type sinkConfig SinkConfig // avoid recursion
+	var cfg sinkConfig
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return err
+	}
+	*s = SinkConfig(cfg)
+	return nil
+}
+
+func (s SinkConfig) retryPolicy() temporal.RetryPolicy {
+	policy := defaultRetryPolicy
+	if s.Retry == nil {
+		return policy
+	}
+	if s.Retry.MaxAttempts > 0 {
+		policy.MaximumAttempts = s.Retry.MaxAttempts
+	}
+	if s.Retry.InitialInterval > 0 {
+		policy.InitialInterval = s.Retry.InitialInterval
+	}
+	if s.Retry.MaxInterval > 0 {
+		policy.MaximumInterval = s.Retry.MaxInterval
+	}
+	return policy
+}
+
+var (
+	sinksMu sync.RWMutex
+	sinks   = make(map[string]SinkFactory) // registered sinks by URL scheme
+)
+
+// RegisterSink registers the factory creating sinks for the given URL
+// scheme, overriding the built-in sink of this scheme. Sinks must be
+// registered before the worker is started.
+func RegisterSink(scheme string, f SinkFactory) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks[strings.ToLower(scheme)] = f
+}
+
+// sink returns the sink for the given sink configuration
+func (c *Client) sink(cfg SinkConfig) (Sink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse sink url: %w", err)
+	}
+
+	sinksMu.RLock()
+	f, ok := sinks[u.Scheme]
+	sinksMu.RUnlock()
+	if ok {
+		return f(cfg)
+	}
+
+	switch u.Scheme {
+	case SinkSchemeHTTP, SinkSchemeHTTPS:
+		return c.newHTTPSink(cfg)
+	case SinkSchemeFile:
+		path, err := c.fileSinkPath(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &fileSink{path: path}, nil
+	case SinkSchemeStdout:
+		return &writerSink{w: os.Stdout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported sink scheme %q", u.Scheme)
+	}
+}
+
+// fileSinkPath returns path if it is a file in the file sink directory of the
+// worker
+func (c *Client) fileSinkPath(path string) (string, error) {
+	if c.fileSinkDir == "" {
+		return "", errors.New("file sinks not enabled on worker (FILE_SINK_DIR not set)")
+	}
+	if path == "" {
+		return "", errors.New("file sink requires a path")
+	}
+	rel, err := filepath.Rel(c.fileSinkDir, filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file sink %q not in worker file sink directory %q", path, c.fileSinkDir)
+	}
+	return filepath.Join(c.fileSinkDir, rel), nil
+}
+
+// httpSink sends events with the CloudEvents HTTP protocol
+type httpSink struct {
+	client   ce.Client
+	target   string
+	header   http.Header // auth header, optional
+	encoding HTTPEncoding
+}
+
+// newHTTPSink returns an HTTP sink using the auth settings of cfg. The client
+// of the TLS settings is used if configured, the client of c otherwise.
+func (c *Client) newHTTPSink(cfg SinkConfig) (*httpSink, error) {
+	s := httpSink{client: c.ceclient, target: cfg.URL, encoding: cfg.Encoding}
+
+	a := cfg.Auth
+	if a == nil {
+		return &s, nil
+	}
+
+	// the CA bundle is no credential and not bound to a sink host
+	for _, name := range []string{a.BearerTokenFile, a.PasswordFile, a.ClientCertFile, a.ClientKeyFile} {
+		if name == "" {
+			continue
+		}
+		if err := c.checkSecretHost(name, cfg.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case a.BearerTokenFile != "":
+		token, err := c.readSecret(a.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("read bearer token: %w", err)
+		}
+		s.header = http.Header{"Authorization": []string{"Bearer " + string(token)}}
+	case a.Username != "":
+		password, err := c.readSecret(a.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("read password: %w", err)
+		}
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(a.Username, string(password))
+		s.header = req.Header
+	}
+
+	if a.ClientCertFile == "" && a.CAFile == "" {
+		return &s, nil
+	}
+
+	var err error
+	if s.client, err = c.tlsClient(a); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// tlsClientKey identifies the TLS settings of a sink by their secret names
+type tlsClientKey struct {
+	certFile, keyFile, caFile string
+}
+
+// cachedTLSClient is a CloudEvents client created from the TLS secrets with
+// the given hash
+type cachedTLSClient struct {
+	hash      string
+	client    ce.Client
+	transport *http.Transport
+}
+
+// tlsClient returns the CloudEvents client for the TLS settings of a. Clients
+// are cached per TLS settings, so connections are reused across deliveries,
+// and replaced once a secret was rotated.
+func (c *Client) tlsClient(a *SinkAuth) (ce.Client, error) {
+	var certPEM, keyPEM, caPEM []byte
+	if a.ClientCertFile != "" {
+		var err error
+		if certPEM, err = c.readSecretFile(a.ClientCertFile); err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		if keyPEM, err = c.readSecretFile(a.ClientKeyFile); err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+	}
+	if a.CAFile != "" {
+		var err error
+		if caPEM, err = c.readSecretFile(a.CAFile); err != nil {
+			return nil, fmt.Errorf("read ca bundle: %w", err)
+		}
+	}
+
+	key := tlsClientKey{certFile: a.ClientCertFile, keyFile: a.ClientKeyFile, caFile: a.CAFile}
+	hash := hashHex(string(certPEM)+"\x00"+string(keyPEM)+"\x00"+string(caPEM), 64)
+
+	c.tlsMu.Lock()
+	defer c.tlsMu.Unlock()
+	cached, ok := c.tlsClients[key]
+	if ok && cached.hash == hash {
+		return cached.client, nil
+	}
+
+	tlsConfig := tls.Config{MinVersion: tls.VersionTLS12}
+	if a.ClientCertFile != "" {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if a.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("ca bundle %q contains no certificates", a.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tlsConfig
+
+	p, err := ce.NewHTTP(cehttp.WithClient(http.Client{Transport: transport}))
+	if err != nil {
+		return nil, fmt.Errorf("create cloudevents http protocol: %w", err)
+	}
+	client, err := ce.NewClient(p)
+	if err != nil {
+		return nil, fmt.Errorf("create cloudevents client: %w", err)
+	}
+
+	if ok {
+		cached.transport.CloseIdleConnections()
+	}
+	if c.tlsClients == nil {
+		c.tlsClients = make(map[tlsClientKey]cachedTLSClient)
+	}
+	c.tlsClients[key] = cachedTLSClient{hash: hash, client: client, transport: transport}
+	return client, nil
+}
+
+func (s *httpSink) Send(ctx context.Context, event ce.Event) error {
+	ctx = ce.ContextWithTarget(ctx, s.target)
+	if s.header != nil {
+		ctx = cehttp.WithCustomHeader(ctx, s.header)
+	}
+	switch s.encoding {
+	case EncodingStructured:
+		ctx = ce.WithEncodingStructured(ctx)
+	case EncodingBinary:
+		ctx = ce.WithEncodingBinary(ctx)
+	}
+	if result := s.client.Send(ctx, event); !protocol.IsACK(result) {
+		return result
+	}
+	return nil
+}
+
+// secretPath returns the path of the named secret in the secret directory of
+// the worker
+func (c *Client) secretPath(name string) (string, error) {
+	if c.secretDir == "" {
+		return "", errors.New("sink secrets not enabled on worker (SINK_SECRET_DIR not set)")
+	}
+	if !validSecretName(name) {
+		return "", fmt.Errorf("secret %q must be a file name relative to the worker secret directory", name)
+	}
+	return filepath.Join(c.secretDir, name), nil
+}
+
+// checkSecretHost returns an error if the named secret is not bound to the
+// host of the given sink URL on the worker (SINK_SECRET_HOSTS), so a request
+// cannot send a credential, or events signed with a key, to another
+// destination. Sinks without host, e.g. file sinks, accept any secret.
+func (c *Client) checkSecretHost(name, sinkURL string) error {
+	if _, err := c.secretPath(name); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(sinkURL)
+	if err != nil {
+		return fmt.Errorf("parse sink url: %w", err)
+	}
+	if u.Host == "" {
+		return nil
+	}
+
+	host, ok := c.secretHosts[name]
+	if !ok {
+		return fmt.Errorf("secret %q not bound to a sink host on worker (SINK_SECRET_HOSTS)", name)
+	}
+	if !strings.EqualFold(host, u.Host) && !strings.EqualFold(host, u.Hostname()) {
+		return fmt.Errorf("secret %q not bound to sink host %q", name, u.Host)
+	}
+	return nil
+}
+
+// readSecretFile reads the named secret from the secret directory of the
+// worker
+func (c *Client) readSecretFile(name string) ([]byte, error) {
+	path, err := c.secretPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// readSecret reads the named secret from the secret directory of the worker,
+// ignoring surrounding whitespace
+func (c *Client) readSecret(name string) ([]byte, error) {
+	b, err := c.readSecretFile(name)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret %q is empty", name)
+	}
+	return secret, nil
+}
+
+// writeMu serializes writes of concurrent activities to file and stdout sinks
+var writeMu sync.Mutex
+
+// fileSink appends events in structured mode to a JSONL file
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Send(_ context.Context, event ce.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("open file sink: %w", err)
+	}
+
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write file sink: %w", err)
+	}
+	return f.Close()
+}
+
+// writerSink writes events in structured mode as JSON lines to w
+type writerSink struct {
+	w io.Writer
+}
+
+func (s *writerSink) Send(_ context.Context, event ce.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// deliver executes the send activity of the event type once for each sink of
+// the request using the retry policy of the sink. It records the delivery
+// status per sink in r, keeps undelivered events in r for redelivery by the
+// outbox and returns the first error.
+func deliver(ctx workflow.Context, req WorkflowRequest, r *run, eventType string, data interface{}) error {
+	logger := workflow.GetLogger(ctx)
+	info := workflow.GetInfo(ctx)
+	meta := newEventMeta(req)
+
+	var first error
+	for _, s := range req.sinks() {
+		sinkCtx := workflow.WithRetryPolicy(ctx, s.retryPolicy())
+
+		d := Delivery{Sink: s.URL, EventType: eventType, Delivered: true}
+		if err := workflow.ExecuteActivity(sinkCtx, sendActivities[eventType], info.WorkflowExecution.ID, s, data, meta).Get(ctx, nil); err != nil {
+			logger.Error("send cloudevent", "type", eventType, "sink", s.URL, "error", err)
+			d.Delivered = false
+			d.Error = err.Error()
+			if first == nil {
+				first = err
+			}
+
+			if workflow.GetVersion(ctx, changeOutbox, workflow.DefaultVersion, 1) >= 1 {
+				if e, err := newPendingEvent(ctx, req, eventType, s, data, meta, err); err != nil {
+					logger.Error("create pending event", "type", eventType, "sink", s.URL, "error", err)
+				} else {
+					r.undelivered = append(r.undelivered, e)
+					d.Queued = true
+				}
+			}
+		}
+		r.deliveries = append(r.deliveries, d)
+	}
+	return first
+}
@@ -0,0 +1,218 @@
+package preemption
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+type memorySink struct {
+	events []ce.Event
+}
+
+func (s *memorySink) Send(_ context.Context, event ce.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestClient_sink(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("appends events as JSON lines to file sink", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "events.jsonl")
+
+		c := Client{fileSinkDir: filepath.Dir(path)}
+		s, err := c.sink(SinkConfig{URL: "file://" + path})
+		assert.NilError(t, err)
+
+		for _, id := range []string{"1", "2"} {
+			assert.NilError(t, s.Send(ctx, newTestEvent("https://vc01/sdk", id)))
+		}
+
+		f, err := os.Open(path)
+		assert.NilError(t, err)
+		defer f.Close()
+
+		var ids []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e ce.Event
+			assert.NilError(t, json.Unmarshal(scanner.Bytes(), &e))
+			ids = append(ids, e.ID())
+		}
+		assert.NilError(t, scanner.Err())
+		assert.DeepEqual(t, ids, []string{"1", "2"})
+	})
+
+	t.Run("uses registered sink for scheme", func(t *testing.T) {
+		mem := &memorySink{}
+		var got SinkConfig
+		RegisterSink("memory", func(cfg SinkConfig) (Sink, error) {
+			got = cfg
+			return mem, nil
+		})
+		t.Cleanup(func() {
+			sinksMu.Lock()
+			defer sinksMu.Unlock()
+			delete(sinks, "memory")
+		})
+
+		var c Client
+		cfg := SinkConfig{URL: "memory://events", PerVM: true}
+		s, err := c.sink(cfg)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, cfg)
+		assert.NilError(t, s.Send(ctx, newTestEvent("https://vc01/sdk", "1")))
+		assert.Equal(t, len(mem.events), 1)
+	})
+
+	t.Run("fails for unsupported scheme", func(t *testing.T) {
+		var c Client
+		_, err := c.sink(SinkConfig{URL: "kafka://broker/topic"})
+		assert.ErrorContains(t, err, `unsupported sink scheme "kafka"`)
+	})
+
+	t.Run("fails for file sink without path", func(t *testing.T) {
+		c := Client{fileSinkDir: t.TempDir()}
+		_, err := c.sink(SinkConfig{URL: "file://"})
+		assert.ErrorContains(t, err, "requires a path")
+	})
+
+	t.Run("fails for file sink outside file sink directory", func(t *testing.T) {
+		c := Client{fileSinkDir: t.TempDir()}
+		_, err := c.sink(SinkConfig{URL: "file:///etc/cron.d/events"})
+		assert.ErrorContains(t, err, "not in worker file sink directory")
+	})
+
+	t.Run("fails for file sink without file sink directory", func(t *testing.T) {
+		var c Client
+		_, err := c.sink(SinkConfig{URL: "file://" + filepath.Join(t.TempDir(), "events.jsonl")})
+		assert.ErrorContains(t, err, "FILE_SINK_DIR not set")
+	})
+}
+
+func TestSinkConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sink    SinkConfig
+		wantErr string
+	}{
+		{name: "valid http sink", sink: SinkConfig{URL: "https://broker.local"}},
+		{name: "valid stdout sink with retry", sink: SinkConfig{URL: "stdout://", Retry: &SinkRetry{MaxAttempts: 1}}},
+		{name: "missing scheme", sink: SinkConfig{URL: "broker.local"}, wantErr: "missing scheme"},
+		{name: "negative retry", sink: SinkConfig{URL: "https://broker.local", Retry: &SinkRetry{MaxAttempts: -1}}, wantErr: "must not be negative"},
+		{name: "valid mutual TLS", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{ClientCertFile: "tls.crt", ClientKeyFile: "tls.key", CAFile: "ca.crt"}}},
+		{name: "file sink with parent directory", sink: SinkConfig{URL: "file:///var/log/preemption/../../etc/events"}, wantErr: "must not contain"},
+		{name: "auth for file sink", sink: SinkConfig{URL: "file:///tmp/events.jsonl", Auth: &SinkAuth{BearerTokenFile: "token"}}, wantErr: "only supported for http sinks"},
+		{name: "bearer and basic auth", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "token", Username: "user", PasswordFile: "password"}}, wantErr: "mutually exclusive"},
+		{name: "basic auth without password", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{Username: "user"}}, wantErr: "requires username and password file"},
+		{name: "structured http sink", sink: SinkConfig{URL: "https://broker.local", Encoding: EncodingStructured}},
+		{name: "encoding for stdout sink", sink: SinkConfig{URL: "stdout://", Encoding: EncodingBinary}, wantErr: "only supported for http sinks"},
+		{name: "unsupported encoding", sink: SinkConfig{URL: "https://broker.local", Encoding: "batch"}, wantErr: "unsupported encoding"},
+		{name: "client certificate without key", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{ClientCertFile: "tls.crt"}}, wantErr: "requires client certificate and key file"},
+		{name: "secret in subdirectory", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "broker/token"}}},
+		{name: "absolute secret path", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "/var/bindings/vsphere/password"}}, wantErr: "relative to the worker secret directory"},
+		{name: "secret outside secret directory", sink: SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{CAFile: "certs/../../ca.pem"}}, wantErr: "relative to the worker secret directory"},
+		{name: "absolute signing key path", sink: SinkConfig{URL: "stdout://", SigningKeyFile: "/etc/key"}, wantErr: "relative to the worker secret directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sink.validate()
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestSinkConfig_UnmarshalJSON(t *testing.T) {
+	t.Run("accepts plain URL", func(t *testing.T) {
+		var s SinkConfig
+		assert.NilError(t, json.Unmarshal([]byte(`"https://broker.local"`), &s))
+		assert.DeepEqual(t, s, SinkConfig{URL: "https://broker.local"})
+	})
+
+	t.Run("accepts sink object", func(t *testing.T) {
+		var s SinkConfig
+		assert.NilError(t, json.Unmarshal([]byte(`{"url":"https://broker.local","auth":{"bearerTokenFile":"token"}}`), &s))
+		assert.DeepEqual(t, s, SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "token"}})
+	})
+}
+
+func Test_newHTTPSink(t *testing.T) {
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "password"), []byte("secret\n"), 0o600))
+	c := Client{secretDir: dir, secretHosts: map[string]string{"password": "broker.local", "token": "broker.local"}}
+
+	t.Run("sets basic auth header", func(t *testing.T) {
+		s, err := c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{Username: "preemption", PasswordFile: "password"}})
+		assert.NilError(t, err)
+
+		req := http.Request{Header: s.header}
+		user, pass, ok := req.BasicAuth()
+		assert.Assert(t, ok)
+		assert.Equal(t, user, "preemption")
+		assert.Equal(t, pass, "secret")
+	})
+
+	t.Run("fails for missing token file", func(t *testing.T) {
+		_, err := c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "token"}})
+		assert.ErrorContains(t, err, "read bearer token")
+	})
+
+	t.Run("fails for secret not bound to sink host", func(t *testing.T) {
+		_, err := c.newHTTPSink(SinkConfig{URL: "https://attacker.example.com", Auth: &SinkAuth{Username: "preemption", PasswordFile: "password"}})
+		assert.ErrorContains(t, err, `secret "password" not bound to sink host "attacker.example.com"`)
+
+		_, err = c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{ClientCertFile: "tls.crt", ClientKeyFile: "tls.key"}})
+		assert.ErrorContains(t, err, `secret "tls.crt" not bound to a sink host`)
+	})
+
+	t.Run("fails for secret outside secret directory", func(t *testing.T) {
+		_, err := c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{BearerTokenFile: "../password"}})
+		assert.ErrorContains(t, err, "relative to the worker secret directory")
+	})
+
+	t.Run("fails without secret directory", func(t *testing.T) {
+		var c Client
+		_, err := c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{Username: "preemption", PasswordFile: "password"}})
+		assert.ErrorContains(t, err, "SINK_SECRET_DIR not set")
+	})
+
+	t.Run("reuses client until ca bundle changes", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.NotFoundHandler())
+		srv.Close()
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0o600))
+		cfg := SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{CAFile: "ca.pem"}}
+
+		s1, err := c.newHTTPSink(cfg)
+		assert.NilError(t, err)
+		s2, err := c.newHTTPSink(cfg)
+		assert.NilError(t, err)
+		assert.Assert(t, s1.client == s2.client)
+
+		// rotated bundle
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), append(ca, ca...), 0o600))
+		s3, err := c.newHTTPSink(cfg)
+		assert.NilError(t, err)
+		assert.Assert(t, s1.client != s3.client)
+	})
+
+	t.Run("fails for empty ca bundle", func(t *testing.T) {
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), nil, 0o600))
+		_, err := c.newHTTPSink(SinkConfig{URL: "https://broker.local", Auth: &SinkAuth{CAFile: "ca.pem"}})
+		assert.ErrorContains(t, err, "contains no certificates")
+	})
+}
@@ -0,0 +1,167 @@
+package preemption
+
+import (
+	"errors"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/temporal"
+)
+
+// RunStatus is the outcome of a single preemption workflow run
+type RunStatus string
+
+// RunPhase is the step currently executed by a preemption workflow run
+type RunPhase string
+
+// ErrorCode is a stable error code for a failed workflow run step
+type ErrorCode string
+
+const (
+	RunStatusSucceeded          RunStatus = "SUCCEEDED"
+	RunStatusPartiallySucceeded RunStatus = "PARTIALLY_SUCCEEDED" // VMs preempted but a subsequent step failed
+	RunStatusFailed             RunStatus = "FAILED"
+	RunStatusSkipped            RunStatus = "SKIPPED"
+
+	RunPhaseIdle            RunPhase = "IDLE" // waiting for requests
+	RunPhaseSearching       RunPhase = "SEARCHING"
+	RunPhaseAuthorizing     RunPhase = "AUTHORIZING" // veto hook and approval
+	RunPhasePreempting      RunPhase = "PREEMPTING"
+	RunPhasePoweringOn      RunPhase = "POWERING_ON" // RequestTypeAdmit
+	RunPhaseFinishing       RunPhase = "FINISHING"   // annotation and response event
+	RunPhaseMaintenanceMode RunPhase = "ENTERING_MAINTENANCE_MODE"
+	RunPhaseRestoring       RunPhase = "RESTORING"   // RequestTypeRestore
+	RunPhaseRebalancing     RunPhase = "REBALANCING" // DRS recommendations
+	RunPhaseMigrating       RunPhase = "MIGRATING"   // migration to overflow capacity
+	RunPhaseDraining        RunPhase = "DRAINING"    // guest drain command
+
+	ErrorCodeVSphere  ErrorCode = "VSPHERE_ERROR"
+	ErrorCodeInternal ErrorCode = "INTERNAL_ERROR"
+	ErrorCodeVetoHook ErrorCode = "VETO_HOOK_ERROR"
+	ErrorCodeCapacity ErrorCode = "INSUFFICIENT_CAPACITY"
+	ErrorCodeTimeout  ErrorCode = "TIMEOUT"
+	ErrorCodeCanceled ErrorCode = "CANCELED"
+	ErrorCodeUnknown  ErrorCode = "UNKNOWN_ERROR"
+
+	skipReasonDebounce  = "last run is not older than configured re-run threshold"
+	skipReasonVetoed    = "vetoed by veto hook"
+	skipReasonRejected  = "rejected by approver"
+	skipReasonDuplicate = "duplicate request event"
+
+	// workflow run steps
+	stepValidateRequest      = "ValidateRequest"
+	stepGetPreemptibleVMs    = "GetPreemptibleVMs"
+	stepCallVetoHook         = "CallVetoHook"
+	stepPowerOffVMs          = "PowerOffVMs"
+	stepSuspendVMs           = "SuspendVMs"
+	stepAnnotateVms          = "AnnotateVms"
+	stepSendPreemptedEvent   = "SendPreemptedEvent"
+	stepGetAdmissionPlan     = "GetAdmissionPlan"
+	stepPowerOnVM            = "PowerOnVM"
+	stepEnterMaintenanceMode = "EnterMaintenanceMode"
+	stepDisableHARestart     = "DisableHARestart"
+	stepGetPreemptedVMs      = "GetPreemptedVMs"
+	stepRestoreVMs           = "RestoreVMs"
+	stepRebalanceClusters    = "RebalanceClusters"
+	stepMigrateVMs           = "MigrateVMs"
+	stepDrainVMs             = "DrainVMs"
+	stepPostVMEvents         = "PostVMEvents"
+)
+
+// RunError describes the error of a failed workflow run step
+type RunError struct {
+	Code    ErrorCode `json:"code"`
+	Type    string    `json:"type"` // Temporal error type
+	Message string    `json:"message"`
+	Step    string    `json:"step"` // activity which failed
+}
+
+// newRunError converts the error returned by an activity into a RunError
+func newRunError(step string, err error) *RunError {
+	runErr := RunError{
+		Code:    ErrorCodeUnknown,
+		Message: err.Error(),
+		Step:    step,
+	}
+
+	var (
+		appErr      *temporal.ApplicationError
+		timeoutErr  *temporal.TimeoutError
+		canceledErr *temporal.CanceledError
+	)
+
+	switch {
+	case errors.As(err, &appErr):
+		runErr.Type = appErr.Type()
+		runErr.Message = appErr.Error()
+		switch appErr.Type() {
+		case errVSphere:
+			runErr.Code = ErrorCodeVSphere
+		case errInternal:
+			runErr.Code = ErrorCodeInternal
+		case errVeto:
+			runErr.Code = ErrorCodeVetoHook
+		case errInsufficientCapacity:
+			runErr.Code = ErrorCodeCapacity
+		}
+	case errors.As(err, &timeoutErr):
+		runErr.Type = "timeout"
+		runErr.Code = ErrorCodeTimeout
+	case errors.As(err, &canceledErr):
+		runErr.Type = "canceled"
+		runErr.Code = ErrorCodeCanceled
+	}
+
+	return &runErr
+}
+
+// run holds the outcome of a single preemption workflow run
+type run struct {
+	preempted   []types.ManagedObjectReference
+	approval    *ApprovalResponse
+	veto        *VetoResponse
+	admission   *AdmissionResult
+	restored    []types.ManagedObjectReference
+	rebalance   []DRSRecommendation
+	migrated    []Migration
+	drain       []DrainResult
+	annotations []AnnotationResult
+	deliveries  []Delivery
+	undelivered []PendingEvent // added to the outbox after the run
+	datastore   string         // datastore used to select preemptible VMs
+	status      RunStatus
+	skipReason  string
+	err         *RunError
+
+	onPhase func(RunPhase) // reports progress, optional
+}
+
+func (r *run) phase(p RunPhase) {
+	if r.onPhase != nil {
+		r.onPhase(p)
+	}
+}
+
+func (r *run) succeed() {
+	r.status = RunStatusSucceeded
+}
+
+func (r *run) skip(reason string) {
+	r.status = RunStatusSkipped
+	r.skipReason = reason
+}
+
+func (r *run) fail(step string, err error) {
+	r.status = RunStatusFailed
+	r.err = newRunError(step, err)
+}
+
+// partial marks a run as partially succeeded, keeping the first error. Failed
+// runs remain failed.
+func (r *run) partial(step string, err error) {
+	if r.status != RunStatusFailed {
+		r.status = RunStatusPartiallySucceeded
+	}
+	if r.err == nil {
+		r.err = newRunError(step, err)
+	}
+}
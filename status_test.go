@@ -0,0 +1,37 @@
+package preemption
+
+import (
+	"errors"
+	"testing"
+
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/temporal"
+	"gotest.tools/v3/assert"
+)
+
+func Test_newRunError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode ErrorCode
+		wantType string
+	}{
+		{name: "vsphere error", err: temporal.NewApplicationError("power off", errVSphere, errors.New("fault")), wantCode: ErrorCodeVSphere, wantType: errVSphere},
+		{name: "internal error", err: temporal.NewNonRetryableApplicationError("marshal", errInternal, errors.New("fault")), wantCode: ErrorCodeInternal, wantType: errInternal},
+		{name: "veto hook error", err: temporal.NewApplicationError("call veto hook", errVeto, errors.New("fault")), wantCode: ErrorCodeVetoHook, wantType: errVeto},
+		{name: "insufficient capacity error", err: temporal.NewNonRetryableApplicationError("power on vm", errInsufficientCapacity, errors.New("fault")), wantCode: ErrorCodeCapacity, wantType: errInsufficientCapacity},
+		{name: "other application error", err: temporal.NewApplicationError("other", "custom"), wantCode: ErrorCodeUnknown, wantType: "custom"},
+		{name: "timeout error", err: temporal.NewTimeoutError(enumspb.TIMEOUT_TYPE_START_TO_CLOSE, nil), wantCode: ErrorCodeTimeout, wantType: "timeout"},
+		{name: "canceled error", err: temporal.NewCanceledError(), wantCode: ErrorCodeCanceled, wantType: "canceled"},
+		{name: "plain error", err: errors.New("fault"), wantCode: ErrorCodeUnknown, wantType: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newRunError(stepPowerOffVMs, tt.err)
+			assert.Equal(t, got.Code, tt.wantCode)
+			assert.Equal(t, got.Type, tt.wantType)
+			assert.Equal(t, got.Step, stepPowerOffVMs)
+			assert.Check(t, got.Message != "")
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package preemption
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/extensions"
+)
+
+// W3C trace context version 00, i.e. version-traceID-parentID-flags
+var traceParentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// EventMeta holds the context attributes of an outbound event which are not
+// part of the event data
+type EventMeta struct {
+	Subject     string `json:"subject,omitempty"`     // affected cluster, set to the VM for events of a single VM
+	TraceParent string `json:"traceparent,omitempty"` // W3C trace context of the request, if any
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// newEventMeta returns the event attributes for the given request. The trace
+// context of the request takes precedence over the trace context extension of
+// the triggering event.
+func newEventMeta(req WorkflowRequest) EventMeta {
+	meta := EventMeta{
+		Subject:     req.Cluster,
+		TraceParent: req.TraceParent,
+		TraceState:  req.TraceState,
+	}
+
+	if meta.TraceParent == "" {
+		if ext, ok := extensions.GetDistributedTracingExtension(req.Event); ok && validTraceParent(ext.TraceParent) {
+			meta.TraceParent = ext.TraceParent
+			meta.TraceState = ext.TraceState
+		}
+	}
+	return meta
+}
+
+// validTraceParent returns true if tp is a valid version 00 W3C traceparent
+func validTraceParent(tp string) bool {
+	m := traceParentRegexp.FindStringSubmatch(tp)
+	if m == nil {
+		return false
+	}
+	return strings.Trim(m[1], "0") != "" && strings.Trim(m[2], "0") != ""
+}
+
+// setTraceContext sets the W3C traceparent and tracestate extensions of the
+// event. The event continues the trace of meta as a child span identified by
+// the event ID. Without trace context a new trace is derived from the
+// workflow run, so all events of a run share the same trace ID.
+func setTraceContext(event *ce.Event, meta EventMeta, wfRunID string) {
+	traceID, flags := hashHex(wfRunID, 32), "01"
+	state := ""
+	if m := traceParentRegexp.FindStringSubmatch(meta.TraceParent); m != nil {
+		traceID, flags = m[1], m[3]
+		state = meta.TraceState
+	}
+
+	ext := extensions.DistributedTracingExtension{
+		TraceParent: fmt.Sprintf("00-%s-%s-%s", traceID, hashHex(event.ID(), 16), flags),
+		TraceState:  state,
+	}
+	ext.AddTracingAttributes(event)
+}
+
+// hashHex returns the first n hex characters of the SHA-256 hash of s
+func hashHex(s string, n int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:n]
+}
@@ -0,0 +1,89 @@
+package preemption
+
+import (
+	"strings"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func Test_newEventMeta(t *testing.T) {
+	e := ce.NewEvent()
+	e.SetExtension("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	e.SetExtension("tracestate", "event=1")
+
+	t.Run("uses trace context of triggering event", func(t *testing.T) {
+		meta := newEventMeta(WorkflowRequest{Cluster: "cluster01", Event: e})
+		assert.DeepEqual(t, meta, EventMeta{
+			Subject:     "cluster01",
+			TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			TraceState:  "event=1",
+		})
+	})
+
+	t.Run("prefers trace context of request", func(t *testing.T) {
+		meta := newEventMeta(WorkflowRequest{Event: e, TraceParent: testTraceParent})
+		assert.DeepEqual(t, meta, EventMeta{TraceParent: testTraceParent})
+	})
+
+	t.Run("ignores invalid trace context of triggering event", func(t *testing.T) {
+		invalid := ce.NewEvent()
+		invalid.SetExtension("traceparent", "invalid")
+		meta := newEventMeta(WorkflowRequest{Event: invalid})
+		assert.DeepEqual(t, meta, EventMeta{})
+	})
+}
+
+func Test_validTraceParent(t *testing.T) {
+	tests := []struct {
+		name string
+		tp   string
+		want bool
+	}{
+		{name: "valid", tp: testTraceParent, want: true},
+		{name: "unsupported version", tp: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "upper case", tp: strings.ToUpper(testTraceParent)},
+		{name: "zero trace id", tp: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "zero parent id", tp: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, validTraceParent(tt.tp), tt.want)
+		})
+	}
+}
+
+func Test_setTraceContext(t *testing.T) {
+	newEvent := func(id string) ce.Event {
+		e := ce.NewEvent()
+		e.SetID(id)
+		return e
+	}
+
+	t.Run("derives trace from workflow run without trace context", func(t *testing.T) {
+		e1, e2 := newEvent("1"), newEvent("2")
+		setTraceContext(&e1, EventMeta{}, "run-1")
+		setTraceContext(&e2, EventMeta{}, "run-1")
+
+		tp1, tp2 := e1.Extensions()["traceparent"].(string), e2.Extensions()["traceparent"].(string)
+		assert.Assert(t, validTraceParent(tp1))
+		assert.Equal(t, tp1[:36], tp2[:36], "events of a run must share the trace id")
+		assert.Assert(t, tp1 != tp2, "events must have different span ids")
+		_, ok := e1.Extensions()["tracestate"]
+		assert.Assert(t, !ok)
+	})
+
+	t.Run("continues trace context", func(t *testing.T) {
+		e := newEvent("1")
+		setTraceContext(&e, EventMeta{TraceParent: testTraceParent, TraceState: "vendor=value"}, "run-1")
+
+		tp := e.Extensions()["traceparent"].(string)
+		assert.Assert(t, strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+		assert.Assert(t, strings.HasSuffix(tp, "-01"))
+		assert.Equal(t, e.Extensions()["tracestate"], "vendor=value")
+	})
+}
@@ -0,0 +1,96 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/vmware/govmomi/event"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// VMEvent describes the preemption of a VM in the vCenter event stream
+type VMEvent struct {
+	WorkflowID  string      `json:"workflowID"`
+	Criticality Criticality `json:"criticality"`
+	Reason      string      `json:"reason"` // e.g. triggering event or admitted VM
+}
+
+// message returns the message of the vCenter user event
+func (e VMEvent) message() string {
+	return fmt.Sprintf("Preempted by vsphere-preemption workflow %q (criticality %s): %s", e.WorkflowID, e.Criticality, e.Reason)
+}
+
+// PostVMEvents posts a user event against each of the given VMs using the
+// vCenter EventManager, so preemptions show up in the events of a VM. Posting
+// is not retried to avoid duplicate events, an error is returned if any event
+// could not be posted.
+func (c *Client) PostVMEvents(ctx context.Context, refs []types.ManagedObjectReference, e VMEvent) error {
+	logger := activity.GetLogger(ctx)
+
+	if len(refs) == 0 {
+		logger.Debug("empty list of virtual machines")
+		return nil
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(c.vcclient)
+	if err := pc.Retrieve(ctx, refs, []string{"name"}, &vms); err != nil {
+		return temporal.NewApplicationError("retrieve vm names", errVSphere, err)
+	}
+
+	names := make(map[types.ManagedObjectReference]string, len(vms))
+	for _, vm := range vms {
+		names[vm.Reference()] = vm.Name
+	}
+
+	var (
+		mu     sync.Mutex
+		failed int
+	)
+
+	m := event.NewManager(c.vcclient)
+	msg := e.message()
+
+	_, err := c.forEachVM(ctx, refs, func(ctx context.Context, ref types.ManagedObjectReference) bool {
+		ev := types.GeneralUserEvent{
+			GeneralEvent: types.GeneralEvent{
+				Event: types.Event{
+					CreatedTime: c.clock.Now().UTC(),
+					Vm: &types.VmEventArgument{
+						EntityEventArgument: types.EntityEventArgument{Name: names[ref]},
+						Vm:                  ref,
+					},
+					FullFormattedMessage: msg,
+				},
+				Message: msg,
+			},
+			Entity: &types.ManagedEntityEventArgument{
+				EntityEventArgument: types.EntityEventArgument{Name: names[ref]},
+				Entity:              ref,
+			},
+		}
+
+		if err := m.PostEvent(ctx, &ev); err != nil {
+			logger.Warn("failed to post vm event", "error", err, "ref", ref.String())
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		msg := fmt.Sprintf("post event for %d of %d vms failed", failed, len(refs))
+		return temporal.NewNonRetryableApplicationError(msg, errVSphere, nil)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package preemption
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
+)
+
+// VetoFailurePolicy defines the workflow behavior when the veto hook cannot be
+// reached
+type VetoFailurePolicy string
+
+const (
+	VetoFailOpen   VetoFailurePolicy = "OPEN"   // continue preemption (default)
+	VetoFailClosed VetoFailurePolicy = "CLOSED" // fail the run without preemption
+
+	vetoEventType = "com.vmware.workflows.vsphere.VmPreemptionVetoRequestEvent.v0" // sent to veto hook
+
+	errVeto = "veto"
+)
+
+// veto hook activity retry policy
+var vetoRetryPolicy = temporal.RetryPolicy{
+	InitialInterval:    time.Second,
+	BackoffCoefficient: 2,
+	MaximumInterval:    time.Second * 5,
+	MaximumAttempts:    3,
+}
+
+// VetoRequest is the data sent to the veto hook before preempting VMs
+type VetoRequest struct {
+	Tag             string                         `json:"tag"`
+	Criticality     Criticality                    `json:"criticality"`
+	WorkflowID      string                         `json:"workflowID"`
+	RunID           string                         `json:"workflowRunID"`
+	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"` // preemption candidates
+	Event           ce.Event                       `json:"event"`           // event that triggered preemption
+}
+
+// VetoResponse is the data returned by the veto hook in the response event. An
+// empty response allows preemption of all candidates.
+type VetoResponse struct {
+	Veto    bool                           `json:"veto"`              // skip this preemption run
+	Reason  string                         `json:"reason,omitempty"`  // optional comment
+	Exclude []types.ManagedObjectReference `json:"exclude,omitempty"` // remove these VMs from the candidates
+}
+
+// filter returns the candidates without the VMs excluded by the veto hook
+func (v *VetoResponse) filter(candidates []types.ManagedObjectReference) []types.ManagedObjectReference {
+	if v == nil || len(v.Exclude) == 0 {
+		return candidates
+	}
+
+	excluded := make(map[types.ManagedObjectReference]struct{}, len(v.Exclude))
+	for _, ref := range v.Exclude {
+		excluded[ref] = struct{}{}
+	}
+
+	var refs []types.ManagedObjectReference
+	for _, ref := range candidates {
+		if _, ok := excluded[ref]; ok {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// CallVetoHook sends the preemption candidates to the veto hook configured on
+// the worker and returns its decision. The hook specified in the workflow
+// request is an additional check called after the worker hook, it cannot
+// replace the worker hook. VMs excluded by any hook are removed and the run is
+// vetoed if any hook vetoes. A nil response is returned if no hook is
+// configured.
+func (c *Client) CallVetoHook(ctx context.Context, hook string, data VetoRequest) (*VetoResponse, error) {
+	var env EnvConfig
+	if err := envconfig.Process("", &env); err != nil {
+		return nil, err
+	}
+
+	logger := activity.GetLogger(ctx)
+
+	var hooks []string
+	if env.VetoHook != "" {
+		hooks = append(hooks, env.VetoHook)
+	}
+	if hook != "" && hook != env.VetoHook {
+		hooks = append(hooks, hook)
+	}
+
+	if len(hooks) == 0 {
+		logger.Debug("not calling veto hook: no hook configured")
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// send heartbeats
+	go heartbeat(ctx)
+
+	source := fmt.Sprintf("%s/%s", env.Address, env.Namespace) // temporal URL + namespace
+	event := ce.NewEvent()
+	event.SetSource(source)
+	event.SetID(fmt.Sprintf("%s-%s-veto", data.WorkflowID, data.Event.ID())) // format: wfID-vcEventID-veto
+	event.SetTime(c.clock.Now().UTC())
+	event.SetType(vetoEventType)
+	if err := event.SetData(ce.ApplicationJSON, data); err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("set event data", errInternal, err)
+	}
+
+	var res VetoResponse
+	for _, target := range hooks {
+		hookRes, err := c.callVetoHook(ctx, target, event)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Exclude = append(res.Exclude, hookRes.Exclude...)
+		if hookRes.Veto {
+			res.Veto = true
+			res.Reason = hookRes.Reason
+			break
+		}
+	}
+	return &res, nil
+}
+
+// callVetoHook sends the veto request event to the given hook and returns its
+// response
+func (c *Client) callVetoHook(ctx context.Context, hook string, event ce.Event) (*VetoResponse, error) {
+	logger := activity.GetLogger(ctx)
+	ctx = ce.ContextWithTarget(ctx, hook)
+
+	logger.Debug("calling veto hook", "id", event.ID(), "target", hook)
+	resp, result := c.ceclient.Request(ctx, event) // retries handled by activity options
+	if !protocol.IsACK(result) {
+		logger.Error("call veto hook", "id", event.ID(), "target", hook, "error", result)
+		return nil, temporal.NewApplicationError("call veto hook", errVeto, result)
+	}
+
+	var res VetoResponse
+	if resp == nil || len(resp.Data()) == 0 {
+		logger.Debug("veto hook returned empty response", "id", event.ID(), "target", hook)
+		return &res, nil
+	}
+
+	if err := resp.DataAs(&res); err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("decode veto hook response", errVeto, err)
+	}
+
+	logger.Debug("veto hook response", "id", event.ID(), "target", hook, "veto", res.Veto, "exclude", res.Exclude)
+	return &res, nil
+}
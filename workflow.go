@@ -2,6 +2,7 @@ package preemption
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,18 +14,68 @@ import (
 
 type Criticality string
 
+// RequestType defines the action of a workflow request
+type RequestType string
+
+// PreemptAction defines how preemptible VMs are stopped
+type PreemptAction string
+
 const (
 	CriticalityLow    Criticality = "LOW" // attempts graceful VM shutdown
 	CriticalityMedium Criticality = "MEDIUM"
 	CriticalityHigh   Criticality = "HIGH"
 
-	WorkflowName      = "PreemptVMsWorkflow"
-	SignalChannel     = "PreemptVMsChan"
-	WorkFlowQueryType = "current_state"
+	RequestTypePreempt  RequestType = "PREEMPT"  // preempt all preemptible VMs (default)
+	RequestTypeAdmit    RequestType = "ADMIT"    // preempt VMs to power on a target VM
+	RequestTypeEvacuate RequestType = "EVACUATE" // preempt VMs on a host and optionally enter maintenance mode
+	RequestTypeRestore  RequestType = "RESTORE"  // power on preempted VMs and restore their HA restart priority
+
+	ActionPowerOff PreemptAction = "POWER_OFF" // shutdown (CriticalityLow) or power off VMs (default)
+	ActionSuspend  PreemptAction = "SUSPEND"   // suspend VMs, releases swap space but keeps the memory state on the datastore
+
+	DecisionApprove Decision = "APPROVE"
+	DecisionReject  Decision = "REJECT"
+
+	WorkflowName          = "PreemptVMsWorkflow"
+	SignalChannel         = "PreemptVMsChan"
+	ApprovalSignalChannel = "PreemptVMsApprovalChan"
+	WorkFlowQueryType     = "current_state"
+
+	// custom search attributes, must be registered in the Temporal cluster
+	SearchAttributeTag            = "Tag"                // Keyword
+	SearchAttributeCriticality    = "Criticality"        // Keyword
+	SearchAttributeVCenter        = "VCenter"            // Keyword
+	SearchAttributeLastPreemption = "LastPreemptionTime" // Datetime
+	SearchAttributePreemptedCount = "PreemptedCount"     // Int
+
+	MemoScope = "scope" // memo field holding the workflow Scope
+
+	DefaultApprovalTimeout  = time.Minute * 15 // used when request does not specify approval timeout
+	DefaultApprovalDecision = DecisionReject   // used when request does not specify approval default
 
 	minTimeBetweenRuns = time.Minute // prevent multiple workflow executions within this window
+	maxHandledSignals  = 200         // handled signals, timers and enforcement watches before the workflow continues as new
+
+	// workflow change IDs for workflow.GetVersion, add a new change ID (or
+	// increment the max version) for every change to the activity sequence
+	changeVetoHook     = "veto-hook"
+	changeApprovalGate = "approval-gate"
+	changeFailureEvent = "failure-event"
+	changeDedup        = "dedup"
+	changeDatastore    = "datastore"
+	changeVMEvents     = "vm-events"
+
+	changeLifecycleEvents = "lifecycle-events"
+	changeOutbox          = "outbox"
+	changeDedupFailed     = "dedup-failed"
+	changeLastRun         = "last-run"
+	changeAdmitAuthorize  = "admit-authorize"
+	changeContinueAsNew   = "continue-as-new"
 )
 
+// Decision is the outcome of an approval request
+type Decision string
+
 // default activity retry policy
 var defaultRetryPolicy = temporal.RetryPolicy{
 	InitialInterval:    time.Second * 2,
@@ -34,10 +85,202 @@ var defaultRetryPolicy = temporal.RetryPolicy{
 }
 
 type WorkflowRequest struct {
-	Tag         string      `json:"tag"` // tag identifying preemptible VMs
-	Criticality Criticality `json:"criticality"`
-	Event       ce.Event    `json:"event"`   // e.g. AlarmStatusChangedEvent
-	ReplyTo     string      `json:"replyTo"` // empty if no cloudevent response wanted
+	Type        RequestType   `json:"type,omitempty"`      // defaults to RequestTypePreempt
+	Tag         string        `json:"tag"`                 // tag identifying preemptible VMs
+	VCenter     string        `json:"vcenter,omitempty"`   // must match worker vCenter if set
+	Cluster     string        `json:"cluster,omitempty"`   // only preempt VMs in this cluster if set
+	Host        string        `json:"host,omitempty"`      // only preempt VMs on this host if set, required for RequestTypeEvacuate
+	Datastore   string        `json:"datastore,omitempty"` // only preempt VMs with files on this datastore if set, defaults to the datastore of an alarm event
+	Criticality Criticality   `json:"criticality"`
+	Action      PreemptAction `json:"action,omitempty"`      // defaults to ActionPowerOff
+	Event       ce.Event      `json:"event"`                 // e.g. AlarmStatusChangedEvent
+	ReplyTo     string        `json:"replyTo"`               // empty if no cloudevent response wanted
+	Sinks       []SinkConfig  `json:"sinks,omitempty"`       // additional event destinations, e.g. file or stdout
+	EventExpiry time.Duration `json:"eventExpiry,omitempty"` // undelivered events are redelivered until expired, defaults to DefaultEventExpiry
+	RequestedBy string        `json:"requestedBy,omitempty"` // must not approve its own request (CriticalityMedium), not verified
+	TraceParent string        `json:"traceparent,omitempty"` // W3C trace context of sent events, defaults to the traceparent extension of Event
+	TraceState  string        `json:"tracestate,omitempty"`
+
+	// veto hook settings
+	VetoHook          string            `json:"vetoHook,omitempty"`          // additional veto hook, called after the veto hook configured on worker
+	VetoFailurePolicy VetoFailurePolicy `json:"vetoFailurePolicy,omitempty"` // defaults to VetoFailOpen
+
+	// approval settings (CriticalityMedium only)
+	ApprovalTimeout time.Duration `json:"approvalTimeout,omitempty"` // defaults to DefaultApprovalTimeout
+	ApprovalDefault Decision      `json:"approvalDefault,omitempty"` // decision on timeout, defaults to DefaultApprovalDecision
+
+	// annotation settings
+	AnnotationFailurePolicy AnnotationFailurePolicy `json:"annotationFailurePolicy,omitempty"` // defaults to AnnotationFailPartial
+
+	// preemption marker settings
+	MarkerCategory string `json:"markerCategory,omitempty"` // attach the PreemptedTag tag of this category to preempted VMs until restored if set
+
+	// vSphere HA settings
+	DisableHARestart bool `json:"disableHARestart,omitempty"` // disable HA restart of preempted VMs until restored with RequestTypeRestore
+
+	// enforcement settings
+	Enforcement EnforcementMode `json:"enforcement,omitempty"` // watch preempted VMs for power on until cancelled or restored, disabled if empty
+
+	// DRS settings
+	Rebalance RebalanceMode `json:"rebalance,omitempty"` // request DRS recommendations for the clusters of the preempted VMs, disabled if empty
+
+	// migration settings
+	Migrate *MigrationTarget `json:"migrate,omitempty"` // migrate preemptible VMs to overflow capacity before preempting them, disabled if nil
+
+	// guest drain settings
+	Drain *DrainSettings `json:"drain,omitempty"` // run a command in preemptible VMs before graceful shutdown, disabled if nil
+
+	// admission settings (RequestTypeAdmit only)
+	Target          *types.ManagedObjectReference `json:"target,omitempty"`          // VM to power on
+	AdmissionBudget int                           `json:"admissionBudget,omitempty"` // max VMs to preempt, defaults to DefaultAdmissionBudget
+
+	// evacuation settings (RequestTypeEvacuate only)
+	MaintenanceMode bool `json:"maintenanceMode,omitempty"` // put host into maintenance mode after preemption
+}
+
+// Scope returns the scope of the request
+func (r WorkflowRequest) Scope() Scope {
+	return Scope{
+		VCenter: r.VCenter,
+		Cluster: r.Cluster,
+		Tag:     r.Tag,
+	}
+}
+
+// datastore returns the datastore of the request, falling back to the datastore
+// entity of an alarm event
+func (r WorkflowRequest) datastore() string {
+	if r.Datastore != "" {
+		return r.Datastore
+	}
+	return alarmDatastore(r.Event)
+}
+
+// validate returns a non-retryable error for the first invalid field of the
+// request
+func (r WorkflowRequest) validate() error {
+	switch r.Type {
+	case "", RequestTypePreempt:
+	case RequestTypeAdmit:
+		if r.Target == nil {
+			return invalidRequest("admission target not set")
+		}
+	case RequestTypeEvacuate:
+		if r.Host == "" {
+			return invalidRequest("evacuation host not set")
+		}
+	case RequestTypeRestore:
+	default:
+		return invalidRequest("invalid request type %q", r.Type)
+	}
+
+	if r.MaintenanceMode && r.Type != RequestTypeEvacuate {
+		return invalidRequest("maintenance mode not supported for request type %q", r.Type)
+	}
+
+	switch r.Action {
+	case "", ActionPowerOff, ActionSuspend:
+	default:
+		return invalidRequest("invalid action %q", r.Action)
+	}
+
+	switch r.Enforcement {
+	case "", EnforcementRepreempt, EnforcementLog:
+	default:
+		return invalidRequest("invalid enforcement mode %q", r.Enforcement)
+	}
+
+	switch r.Rebalance {
+	case "", RebalanceApply, RebalanceRecord:
+	default:
+		return invalidRequest("invalid rebalance mode %q", r.Rebalance)
+	}
+
+	if r.Migrate != nil {
+		if r.Migrate.Cluster == "" {
+			return invalidRequest("migration cluster not set")
+		}
+		if r.Type == RequestTypeAdmit || r.Type == RequestTypeRestore {
+			return invalidRequest("migration not supported for request type %q", r.Type)
+		}
+	}
+
+	switch r.AnnotationFailurePolicy {
+	case "", AnnotationFailPartial, AnnotationFailRun:
+	default:
+		return invalidRequest("invalid annotation failure policy %q", r.AnnotationFailurePolicy)
+	}
+
+	if r.Drain != nil {
+		if r.Drain.Command == "" {
+			return invalidRequest("drain command not set")
+		}
+		switch r.Drain.FailurePolicy {
+		case "", DrainFailSkip, DrainFailForce:
+		default:
+			return invalidRequest("invalid drain failure policy %q", r.Drain.FailurePolicy)
+		}
+		if r.Type == RequestTypeAdmit || r.Type == RequestTypeRestore {
+			return invalidRequest("guest drain not supported for request type %q", r.Type)
+		}
+	}
+
+	if r.TraceParent != "" && !validTraceParent(r.TraceParent) {
+		return invalidRequest("invalid traceparent %q", r.TraceParent)
+	}
+
+	for _, sink := range r.Sinks {
+		if err := sink.validate(); err != nil {
+			return invalidRequest("%s", err)
+		}
+	}
+
+	return nil
+}
+
+// invalidRequest returns a non-retryable error for an invalid request
+func invalidRequest(format string, args ...interface{}) error {
+	return temporal.NewNonRetryableApplicationError(fmt.Sprintf(format, args...), errInternal, nil)
+}
+
+// sinks returns the event destinations of the request, the replyTo address
+// first
+func (r WorkflowRequest) sinks() []SinkConfig {
+	var sinks []SinkConfig
+	if r.ReplyTo != "" {
+		sinks = append(sinks, SinkConfig{URL: r.ReplyTo})
+	}
+	return append(sinks, r.Sinks...)
+}
+
+// graceful returns true if preemptible VMs are shut down via the guest OS
+func (r WorkflowRequest) graceful() bool {
+	return r.Criticality == CriticalityLow && r.Action != ActionSuspend
+}
+
+// debounced returns true if the request is subject to the re-run threshold.
+// Admission, evacuation and restore requests are explicit operator actions.
+func (r WorkflowRequest) debounced() bool {
+	return r.Type == "" || r.Type == RequestTypePreempt
+}
+
+// reason describes why VMs are preempted by the request
+func (r WorkflowRequest) reason() string {
+	switch r.Type {
+	case RequestTypeAdmit:
+		return fmt.Sprintf("admission of virtual machine %s", r.Target.Value)
+	case RequestTypeEvacuate:
+		return fmt.Sprintf("evacuation of host %s", r.Host)
+	}
+	return fmt.Sprintf("%s event %s from %s", r.Event.Type(), r.Event.ID(), r.Event.Source())
+}
+
+// ApprovalResponse is sent as a signal to ApprovalSignalChannel to approve or
+// reject a pending preemption
+type ApprovalResponse struct {
+	Decision Decision `json:"decision"`
+	Approver string   `json:"approver"`         // identity of the approver, empty on timeout
+	Reason   string   `json:"reason,omitempty"` // optional comment
 }
 
 type WorkflowResponse struct {
@@ -45,11 +288,55 @@ type WorkflowResponse struct {
 	RunID           string                         `json:"workflowRunID"`
 	WorkflowName    string                         `json:"workflowName"`
 	LastPreemption  time.Time                      `json:"lastPreemptionTime"`
+	Type            RequestType                    `json:"type,omitempty"`
 	VirtualMachines []types.ManagedObjectReference `json:"virtualMachines"`
 	Tag             string                         `json:"tag"`
+	VCenter         string                         `json:"vcenter,omitempty"`
+	Cluster         string                         `json:"cluster,omitempty"`
+	Host            string                         `json:"host,omitempty"`
+	Datastore       string                         `json:"datastore,omitempty"`
 	Criticality     Criticality                    `json:"criticality"`
 	Event           ce.Event                       `json:"event"`
 	ReplyTo         string                         `json:"replyTo"`
+	Approval        *ApprovalResponse              `json:"approval,omitempty"`      // nil if no approval was required
+	Veto            *VetoResponse                  `json:"veto,omitempty"`          // nil if veto hook was not called
+	Admission       *AdmissionResult               `json:"admission,omitempty"`     // nil for RequestTypePreempt
+	Restored        []types.ManagedObjectReference `json:"restored,omitempty"`      // RequestTypeRestore only
+	Enforced        []types.ManagedObjectReference `json:"enforced,omitempty"`      // preempted VMs watched for power on
+	Violations      []Violation                    `json:"violations,omitempty"`    // latest power on of enforced VMs
+	Rebalance       []DRSRecommendation            `json:"rebalance,omitempty"`     // DRS recommendations after preemption
+	Migrated        []Migration                    `json:"migrated,omitempty"`      // VMs migrated instead of preempted
+	Drain           []DrainResult                  `json:"drain,omitempty"`         // guest drain result per VM
+	Annotations     []AnnotationResult             `json:"annotations,omitempty"`   // annotation result per VM
+	Deliveries      []Delivery                     `json:"deliveries,omitempty"`    // event delivery status per sink
+	PendingEvents   int                            `json:"pendingEvents,omitempty"` // undelivered events waiting for redelivery
+	DroppedEvents   int                            `json:"droppedEvents,omitempty"` // undelivered events which expired or were dropped
+	Status          RunStatus                      `json:"status,omitempty"`        // empty if no run was executed
+	SkipReason      string                         `json:"skipReason,omitempty"`
+	Error           *RunError                      `json:"error,omitempty"`           // first error encountered in the run
+	DuplicateEvents int                            `json:"duplicateEvents,omitempty"` // number of ignored duplicate requests
+	Phase           RunPhase                       `json:"phase"`                     // progress of the current run
+}
+
+// WorkflowState is the state carried over to the next run of the workflow when
+// it continues as new to bound its history
+type WorkflowState struct {
+	LastRun         time.Time         `json:"lastRun"`
+	SeenEvents      []eventKey        `json:"seenEvents,omitempty"`
+	Requests        []WorkflowRequest `json:"requests,omitempty"` // received but not handled yet
+	DuplicateEvents int               `json:"duplicateEvents,omitempty"`
+
+	// outbox
+	PendingEvents []PendingEvent `json:"pendingEvents,omitempty"`
+	EventSeq      int            `json:"eventSeq,omitempty"`
+	DroppedEvents int            `json:"droppedEvents,omitempty"`
+
+	// enforcement
+	Enforcement EnforcementMode                `json:"enforcement,omitempty"`
+	Action      PreemptAction                  `json:"action,omitempty"`
+	Enforced    []types.ManagedObjectReference `json:"enforced,omitempty"`
+	Logged      []types.ManagedObjectReference `json:"logged,omitempty"`
+	Violations  []Violation                    `json:"violations,omitempty"`
 }
 
 func (res *WorkflowResponse) getCurrentState() (string, error) {
@@ -60,18 +347,27 @@ func (res *WorkflowResponse) getCurrentState() (string, error) {
 	return string(b), nil
 }
 
-// PreemptVMsWorkflow preempts VMs
-func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
-	var (
-		lastRun time.Time
-	)
+// PreemptVMsWorkflow preempts VMs. The state is nil unless the workflow
+// continued as new.
+func PreemptVMsWorkflow(ctx workflow.Context, state *WorkflowState) (*WorkflowResponse, error) {
+	if state == nil {
+		state = &WorkflowState{}
+	}
+	lastRun := state.LastRun
 
 	info := workflow.GetInfo(ctx)
 	res := &WorkflowResponse{
-		WorkflowID:   info.WorkflowExecution.ID,
-		RunID:        info.WorkflowExecution.RunID,
-		WorkflowName: info.WorkflowType.Name,
-		Event:        ce.NewEvent(),
+		WorkflowID:      info.WorkflowExecution.ID,
+		RunID:           info.WorkflowExecution.RunID,
+		WorkflowName:    info.WorkflowType.Name,
+		LastPreemption:  lastRun,
+		Event:           ce.NewEvent(),
+		Enforced:        state.Enforced,
+		Violations:      state.Violations,
+		PendingEvents:   len(state.PendingEvents),
+		DroppedEvents:   state.DroppedEvents,
+		DuplicateEvents: state.DuplicateEvents,
+		Phase:           RunPhaseIdle,
 	}
 
 	logger := workflow.GetLogger(ctx)
@@ -84,9 +380,45 @@ func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
 		return nil, err
 	}
 
+	ob := &outbox{events: state.PendingEvents, seq: state.EventSeq, dropped: state.DroppedEvents}
+	err = workflow.SetQueryHandler(ctx, PendingEventsQueryType, func() ([]PendingEvent, error) {
+		logger.Debug("received query", "queryType", PendingEventsQueryType)
+		return ob.events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// search attributes are only upserted when set on workflow start, i.e. when
+	// they are registered in the Temporal cluster
+	searchAttributes := hasSearchAttribute(info, SearchAttributeTag)
+	seen := newSeenEvents(maxSeenEvents)
+	for _, key := range state.SeenEvents {
+		seen.addKey(key)
+	}
+
+	enforcer := &enforcement{mode: state.Enforcement, action: state.Action, vms: state.Enforced, logged: state.Logged}
+	if len(enforcer.vms) > 0 {
+		enforcer.start(ctx)
+	}
+	ob.schedule(ctx)
+
 	sigCh := workflow.GetSignalChannel(ctx, SignalChannel)
+	redeliverCh := workflow.GetSignalChannel(ctx, RedeliverSignalChannel)
+
+	// requests carried over from the previous run are handled first
+	carriedCh := workflow.NewBufferedChannel(ctx, len(state.Requests))
+	for _, req := range state.Requests {
+		carriedCh.Send(ctx, req)
+	}
+	carried := len(state.Requests)
+
+	for handled := 0; ctx.Err() == nil; handled++ {
+		if handled >= maxHandledSignals && workflow.GetVersion(ctx, changeContinueAsNew, workflow.DefaultVersion, 1) >= 1 {
+			logger.Info("continuing as new workflow run", "handled", handled)
+			return nil, continueAsNew(ctx, lastRun, seen, res, ob, enforcer, redeliverCh, carriedCh, sigCh)
+		}
 
-	for ctx.Err() == nil {
 		logger.Info("waiting for incoming signal", "channel", SignalChannel)
 		sel := workflow.NewSelector(ctx)
 
@@ -96,34 +428,119 @@ func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
 			logger.Info("stopping workflow")
 		})
 
-		// workflow handling
-		sel.AddReceive(sigCh, func(c workflow.ReceiveChannel, _ bool) {
-			var (
-				req         WorkflowRequest
-				vc          *Client // vcenter client will be injected
-				preemptible []types.ManagedObjectReference
-				preempted   []types.ManagedObjectReference
-			)
+		// enforcement handling
+		if enforcer.watch != nil {
+			sel.AddFuture(enforcer.watch, func(f workflow.Future) {
+				violations := enforcer.handle(ctx, f)
+				res.Violations = appendViolations(res.Violations, violations...)
+				res.Enforced = enforcer.vms
+			})
+		}
+
+		// outbox handling
+		if ob.timer != nil {
+			sel.AddFuture(ob.timer, func(_ workflow.Future) {
+				ob.timer = nil
+				ob.redeliver(ctx, nil)
+				ob.schedule(ctx)
+				res.PendingEvents = len(ob.events)
+				res.DroppedEvents = ob.dropped
+			})
+		}
+
+		sel.AddReceive(redeliverCh, func(c workflow.ReceiveChannel, _ bool) {
+			var req RedeliverRequest
+			c.Receive(ctx, &req)
+			logger.Info("received redelivery signal", "ids", req.IDs)
+
+			ob.redeliver(ctx, req.IDs)
+			ob.schedule(ctx)
+			res.PendingEvents = len(ob.events)
+			res.DroppedEvents = ob.dropped
+		})
 
+		// workflow handling
+		reqCh := sigCh
+		if carried > 0 {
+			reqCh = carriedCh
+		}
+		sel.AddReceive(reqCh, func(c workflow.ReceiveChannel, _ bool) {
+			var req WorkflowRequest
 			c.Receive(ctx, &req)
+			if c == carriedCh {
+				carried--
+			}
 			logger.Debug("received signal", "signal", req)
 
+			r := &run{onPhase: func(p RunPhase) {
+				res.Phase = p
+			}}
+
 			// update workflow response stats
 			defer func() {
-				lastRun = workflow.Now(ctx)
+				// failed runs which did not preempt any VM are not recorded so
+				// that retries of the request event are not skipped as
+				// duplicates
+				if r.status != RunStatusFailed {
+					seen.add(req.Event)
+				} else if v := workflow.GetVersion(ctx, changeDedupFailed, workflow.DefaultVersion, 2); v == workflow.DefaultVersion || (v >= 2 && len(r.preempted) > 0) {
+					seen.add(req.Event)
+				}
+
+				// only debounced requests which ran are considered a run for
+				// the re-run threshold, duplicates never
+				ran := req.debounced() && r.skipReason != skipReasonDebounce && (r.err == nil || r.err.Step != stepValidateRequest)
+				if r.skipReason != skipReasonDuplicate && (ran || workflow.GetVersion(ctx, changeLastRun, workflow.DefaultVersion, 1) == workflow.DefaultVersion) {
+					lastRun = workflow.Now(ctx)
+				}
 
 				// 	persist last run information in case workflow is stopped/canceled
 				res.LastPreemption = lastRun
-				res.VirtualMachines = preempted
+				res.VirtualMachines = r.preempted
+				res.Type = req.Type
 				res.Criticality = req.Criticality
 				res.Tag = req.Tag
+				res.VCenter = req.VCenter
+				res.Cluster = req.Cluster
+				res.Host = req.Host
+				res.Datastore = r.datastore
 				res.Event = req.Event
 				res.ReplyTo = req.ReplyTo
+				res.Approval = r.approval
+				res.Veto = r.veto
+				res.Admission = r.admission
+				res.Restored = r.restored
+				res.Enforced = enforcer.vms
+				res.Rebalance = r.rebalance
+				res.Migrated = r.migrated
+				res.Drain = r.drain
+				res.Annotations = r.annotations
+				res.Deliveries = r.deliveries
+				if len(r.undelivered) > 0 {
+					ob.add(ctx, r.undelivered...)
+					ob.schedule(ctx)
+				}
+				res.PendingEvents = len(ob.events)
+				res.DroppedEvents = ob.dropped
+				res.Status = r.status
+				res.SkipReason = r.skipReason
+				res.Error = r.err
+				res.Phase = RunPhaseIdle
 			}()
 
+			// triggers retry delivery, i.e. the same event might be received
+			// multiple times
+			if seen.has(req.Event) && workflow.GetVersion(ctx, changeDedup, workflow.DefaultVersion, 1) >= 1 {
+				logger.Info("skipping workflow run because request event was already received", "source", req.Event.Source(), "id", req.Event.ID())
+				res.DuplicateEvents++
+				r.skip(skipReasonDuplicate)
+				sendOutcome(ctx, req, r)
+				return
+			}
+
 			now := workflow.Now(ctx)
 			// don't run if still within window
-			if now.Sub(lastRun) < minTimeBetweenRuns {
+			if req.debounced() && now.Sub(lastRun) < minTimeBetweenRuns {
 				logger.Info(
 					"skipping workflow run because last run is not older than configured re-run threshold",
 					"threshold",
@@ -133,6 +550,8 @@ func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
 					"lastRun",
 					lastRun.UTC().String(),
 				)
+				r.skip(skipReasonDebounce)
+				sendOutcome(ctx, req, r)
 				return
 			}
 
@@ -145,53 +564,71 @@ func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
 			}
 			ctx = workflow.WithActivityOptions(ctx, options)
 
-			logger.Debug("searching for preemptible virtual machines")
-			if err := workflow.ExecuteActivity(ctx, vc.GetPreemptibleVMs, req.Tag).Get(ctx, &preemptible); err != nil {
-				logger.Error("get preemptible vms", "error", err)
-				return
+			if err := req.validate(); err != nil {
+				logger.Error("invalid workflow request", "error", err)
+				r.fail(stepValidateRequest, err)
+			} else if req.Type == RequestTypeAdmit {
+				admit(ctx, req, r)
+			} else if req.Type == RequestTypeRestore {
+				// pressure cleared
+				enforcer.stop()
+				restore(ctx, req, r)
+			} else {
+				preempt(ctx, req, r)
 			}
-			logger.Debug("preemptible virtual machines result", "count", len(preemptible), "refs", preemptible)
 
-			logger.Debug("preempting virtual machines")
-			force := req.Criticality != CriticalityLow
-			if err := workflow.ExecuteActivity(ctx, vc.PowerOffVMs, preemptible, force).Get(ctx, &preempted); err != nil {
-				logger.Error("power off preemptible vms", "error", err)
-				return
+			if req.Rebalance != "" && len(r.preempted) > 0 {
+				rebalance(ctx, req, r)
 			}
-			logger.Debug("preempted virtual machines result", "count", len(preempted), "refs", preempted)
 
-			info := workflow.GetInfo(ctx)
-			annotation := annotationData{
-				Preempted:       true,
-				Tag:             req.Tag,
-				ForcedShutdown:  force,
-				Criticality:     req.Criticality,
-				WorkflowID:      info.WorkflowExecution.ID,
-				WorkflowStarted: info.WorkflowStartTime.UTC(),
-				Event:           req.Event,
+			if req.Enforcement != "" && len(r.preempted) > 0 {
+				logger.Info("enforcing preemption", "mode", req.Enforcement, "preempted", len(r.preempted))
+				enforcer.enforce(ctx, req.Enforcement, req.Action, r.preempted)
 			}
+			logger.Info("workflow run finished", "status", r.status, "preempted", len(r.preempted))
 
-			logger.Debug("annotating preempted virtual machines")
-			if err := workflow.ExecuteActivity(ctx, vc.AnnotateVms, preempted, annotation).Get(ctx, nil); err != nil {
-				// log only, continue workflow
-				logger.Warn("annotate virtual machines", "error", err)
+			if searchAttributes {
+				attrs := map[string]interface{}{
+					SearchAttributeTag:            req.Tag,
+					SearchAttributeCriticality:    string(req.Criticality),
+					SearchAttributeVCenter:        req.VCenter,
+					SearchAttributePreemptedCount: len(r.preempted),
+				}
+				if len(r.preempted) > 0 {
+					attrs[SearchAttributeLastPreemption] = workflow.Now(ctx).UTC()
+				}
+				if err := workflow.UpsertSearchAttributes(ctx, attrs); err != nil {
+					// log only, continue workflow
+					logger.Warn("upsert search attributes", "error", err)
+				}
 			}
 
-			if req.ReplyTo == "" {
-				logger.Debug("not creating cloud event response: replyTo address not set")
+			sendOutcome(ctx, req, r)
+			if r.status != RunStatusFailed {
 				return
 			}
 
-			eventData := eventResponseData{
-				annotationData:  annotation,
-				VirtualMachines: preempted,
+			if workflow.GetVersion(ctx, changeFailureEvent, workflow.DefaultVersion, 1) == workflow.DefaultVersion {
+				return
 			}
-			logger.Debug("sending cloudevents response")
 
-			if err := workflow.ExecuteActivity(ctx, vc.SendPreemptedEvent, info.WorkflowExecution.ID, req.ReplyTo, eventData).Get(ctx, nil); err != nil {
-				logger.Error("send cloudevent", "error", err)
+			if len(req.sinks()) == 0 {
+				logger.Debug("not creating failure cloud event: no sinks set")
 				return
 			}
+
+			info := workflow.GetInfo(ctx)
+			data := failedEventData{
+				Tag:         req.Tag,
+				Criticality: req.Criticality,
+				WorkflowID:  info.WorkflowExecution.ID,
+				RunID:       info.WorkflowExecution.RunID,
+				Error:       *r.err,
+				Event:       req.Event,
+			}
+
+			logger.Debug("sending failure cloudevent")
+			_ = deliver(ctx, req, r, failedEventType, data) // errors are logged and recorded per sink
 		})
 
 		// blocks on workflow ctx and signal chan
@@ -200,3 +637,736 @@ func PreemptVMsWorkflow(ctx workflow.Context) (*WorkflowResponse, error) {
 
 	return res, nil
 }
+
+// continueAsNew returns the error to continue the workflow as new. Received
+// but not yet handled requests on reqChs are carried over with the workflow
+// state, received redelivery requests make the selected pending events due.
+func continueAsNew(ctx workflow.Context, lastRun time.Time, seen *seenEvents, res *WorkflowResponse, ob *outbox,
+	enforcer *enforcement, redeliverCh workflow.ReceiveChannel, reqChs ...workflow.ReceiveChannel) error {
+	var requests []WorkflowRequest
+	for _, c := range reqChs {
+		var req WorkflowRequest
+		for c.ReceiveAsync(&req) {
+			requests = append(requests, req)
+			req = WorkflowRequest{}
+		}
+	}
+
+	var redeliver RedeliverRequest
+	for redeliverCh.ReceiveAsync(&redeliver) {
+		ob.expedite(ctx, redeliver.IDs)
+		redeliver = RedeliverRequest{}
+	}
+
+	if enforcer.cancel != nil {
+		enforcer.cancel()
+	}
+
+	state := WorkflowState{
+		LastRun:         lastRun,
+		SeenEvents:      seen.events(),
+		Requests:        requests,
+		DuplicateEvents: res.DuplicateEvents,
+		PendingEvents:   ob.events,
+		EventSeq:        ob.seq,
+		DroppedEvents:   ob.dropped,
+		Enforcement:     enforcer.mode,
+		Action:          enforcer.action,
+		Enforced:        enforcer.vms,
+		Logged:          enforcer.logged,
+		Violations:      res.Violations,
+	}
+	return workflow.NewContinueAsNewError(ctx, WorkflowName, state)
+}
+
+func hasSearchAttribute(info *workflow.Info, name string) bool {
+	if info.SearchAttributes == nil {
+		return false
+	}
+	_, ok := info.SearchAttributes.GetIndexedFields()[name]
+	return ok
+}
+
+// preempt executes the preemption activities for the given request and records
+// the outcome in r
+func preempt(ctx workflow.Context, req WorkflowRequest, r *run) {
+	var (
+		vc          *Client // vcenter client will be injected
+		preemptible []types.ManagedObjectReference
+	)
+
+	logger := workflow.GetLogger(ctx)
+
+	r.phase(RunPhaseSearching)
+	logger.Debug("searching for preemptible virtual machines")
+	query := candidateQuery{Scope: req.Scope(), Host: req.Host}
+	if ds := req.datastore(); ds != "" && workflow.GetVersion(ctx, changeDatastore, workflow.DefaultVersion, 1) >= 1 {
+		query.Datastore = ds
+		r.datastore = ds
+	}
+	if err := workflow.ExecuteActivity(ctx, vc.GetPreemptibleVMs, query).Get(ctx, &preemptible); err != nil {
+		logger.Error("get preemptible vms", "error", err)
+		r.fail(stepGetPreemptibleVMs, err)
+		return
+	}
+	logger.Debug("preemptible virtual machines result", "count", len(preemptible), "refs", preemptible)
+
+	preemptible, ok := authorize(ctx, req, r, preemptible)
+	if !ok {
+		return
+	}
+	sendStarted(ctx, req, r, preemptible)
+
+	var migrateErr, drainErr error
+	if req.Migrate != nil && len(preemptible) > 0 {
+		preemptible, migrateErr = migrate(ctx, req, r, preemptible)
+	}
+
+	if req.Drain != nil && len(preemptible) > 0 {
+		if req.graceful() {
+			preemptible, drainErr = drain(ctx, req, r, preemptible)
+		} else {
+			logger.Info("skipping guest drain: virtual machines are not shut down gracefully", "criticality", req.Criticality, "action", req.Action)
+		}
+	}
+
+	r.phase(RunPhasePreempting)
+	logger.Debug("preempting virtual machines")
+	force := req.Criticality != CriticalityLow
+	if !stop(ctx, req, r, preemptible, &r.preempted) {
+		return
+	}
+	logger.Debug("preempted virtual machines result", "count", len(r.preempted), "refs", r.preempted)
+	r.succeed()
+	if n := len(preemptible) - len(r.preempted); n > 0 {
+		step := stepPowerOffVMs
+		if req.Action == ActionSuspend {
+			step = stepSuspendVMs
+		}
+		msg := fmt.Sprintf("%d of %d virtual machines not stopped", n, len(preemptible))
+		err := temporal.NewNonRetryableApplicationError(msg, errVSphere, nil)
+		if len(r.preempted) == 0 {
+			logger.Error("preempt virtual machines", "error", err)
+			r.fail(step, err)
+			return
+		}
+		logger.Warn("preempt virtual machines", "error", err)
+		r.partial(step, err)
+	}
+	if migrateErr != nil {
+		r.partial(stepMigrateVMs, migrateErr)
+	}
+	if drainErr != nil {
+		r.partial(stepDrainVMs, drainErr)
+	}
+
+	finish(ctx, req, r, force)
+
+	if req.Type != RequestTypeEvacuate || !req.MaintenanceMode {
+		return
+	}
+
+	r.phase(RunPhaseMaintenanceMode)
+	logger.Debug("entering maintenance mode", "host", req.Host)
+	mmCtx := workflow.WithStartToCloseTimeout(ctx, maintenanceModeTimeout+time.Minute*5)
+	if err := workflow.ExecuteActivity(mmCtx, vc.EnterMaintenanceMode, req.Host).Get(ctx, nil); err != nil {
+		logger.Error("enter maintenance mode", "host", req.Host, "error", err)
+		r.partial(stepEnterMaintenanceMode, err)
+	}
+}
+
+// admit preempts just enough preemptible VMs in the cluster of the requested
+// target VM to power it on. If powering on the target fails due to
+// insufficient capacity, additional VMs are preempted up to the admission
+// budget of the request.
+func admit(ctx workflow.Context, req WorkflowRequest, r *run) {
+	var (
+		vc   *Client // vcenter client will be injected
+		plan admissionPlan
+	)
+
+	logger := workflow.GetLogger(ctx)
+
+	r.admission = &AdmissionResult{Target: *req.Target}
+
+	r.phase(RunPhaseSearching)
+	logger.Debug("computing admission plan", "target", req.Target.String())
+	query := admissionQuery{Scope: req.Scope(), Target: *req.Target}
+	if err := workflow.ExecuteActivity(ctx, vc.GetAdmissionPlan, query).Get(ctx, &plan); err != nil {
+		logger.Error("get admission plan", "error", err)
+		r.fail(stepGetAdmissionPlan, err)
+		return
+	}
+	logger.Debug("admission plan result", "cluster", plan.Cluster, "required", plan.Required, "deficit", plan.Deficit, "candidates", len(plan.Candidates))
+	r.admission.Cluster = plan.Cluster
+
+	if plan.PoweredOn {
+		logger.Info("target virtual machine already powered on", "target", req.Target.String())
+		r.admission.Admitted = true
+		r.succeed()
+		return
+	}
+
+	budget := req.AdmissionBudget
+	if budget <= 0 {
+		budget = DefaultAdmissionBudget
+	}
+
+	candidates := plan.Candidates
+	if len(candidates) > budget {
+		candidates = candidates[:budget]
+	}
+
+	// veto hook and approval cover all VMs which might be preempted for the
+	// admission. Without deficit they are called once powering on the target
+	// failed due to insufficient capacity.
+	authorized := false
+	if selectVictims(candidates, plan.Deficit) > 0 {
+		refs := make([]types.ManagedObjectReference, 0, len(candidates))
+		for _, c := range candidates {
+			refs = append(refs, c.Ref)
+		}
+
+		allowed, ok := authorize(ctx, req, r, refs)
+		if !ok {
+			return
+		}
+		candidates = filterCandidates(candidates, allowed)
+		authorized = true
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(candidates))
+	for _, c := range candidates {
+		refs = append(refs, c.Ref)
+	}
+	selected := selectVictims(candidates, plan.Deficit)
+	sendStarted(ctx, req, r, refs)
+
+	force := req.Criticality != CriticalityLow
+	victims, next := refs[:selected], selected
+	for {
+		if len(victims) > 0 {
+			var preempted []types.ManagedObjectReference
+			r.phase(RunPhasePreempting)
+			logger.Debug("preempting virtual machines for admission", "count", len(victims), "refs", victims)
+			if !stop(ctx, req, r, victims, &preempted) {
+				break
+			}
+			r.preempted = append(r.preempted, preempted...)
+		}
+
+		r.phase(RunPhasePoweringOn)
+		logger.Debug("powering on target virtual machine", "target", req.Target.String())
+		err := workflow.ExecuteActivity(ctx, vc.PowerOnVM, *req.Target).Get(ctx, nil)
+		if err == nil {
+			r.admission.Admitted = true
+			r.succeed()
+			break
+		}
+
+		var appErr *temporal.ApplicationError
+		insufficient := errors.As(err, &appErr) && appErr.Type() == errInsufficientCapacity
+		if insufficient && !authorized && next < len(refs) && workflow.GetVersion(ctx, changeAdmitAuthorize, workflow.DefaultVersion, 1) >= 1 {
+			// the plan was too optimistic, e.g. due to HA admission control
+			logger.Info("insufficient capacity to power on target vm without deficit in admission plan, authorizing candidates", "candidates", len(refs))
+			allowed, ok := authorize(ctx, req, r, refs)
+			if !ok {
+				break
+			}
+			refs = allowed
+			authorized = true
+		}
+
+		if !insufficient || next >= len(refs) {
+			logger.Error("power on target vm", "error", err, "preempted", len(r.preempted), "budget", budget)
+			r.fail(stepPowerOnVM, err)
+			break
+		}
+
+		logger.Info("insufficient capacity to power on target vm, preempting additional virtual machine", "preempted", len(r.preempted), "budget", budget)
+		victims, next = refs[next:next+1], next+1
+	}
+	r.admission.Victims = r.preempted
+
+	if len(r.preempted) == 0 {
+		return
+	}
+	finish(ctx, req, r, force)
+}
+
+// restore powers on the preempted VMs in the scope of the request and restores
+// their HA restart priority
+func restore(ctx workflow.Context, req WorkflowRequest, r *run) {
+	var (
+		vc        *Client // vcenter client will be injected
+		preempted []types.ManagedObjectReference
+	)
+
+	logger := workflow.GetLogger(ctx)
+
+	r.phase(RunPhaseSearching)
+	logger.Debug("searching for preempted virtual machines")
+	query := candidateQuery{Scope: req.Scope(), Host: req.Host}
+	if err := workflow.ExecuteActivity(ctx, vc.GetPreemptedVMs, query).Get(ctx, &preempted); err != nil {
+		logger.Error("get preempted vms", "error", err)
+		r.fail(stepGetPreemptedVMs, err)
+		return
+	}
+	logger.Debug("preempted virtual machines result", "count", len(preempted), "refs", preempted)
+
+	info := workflow.GetInfo(ctx)
+	record := AnnotationRecord{
+		Tag:             req.Tag,
+		Criticality:     req.Criticality,
+		WorkflowID:      info.WorkflowExecution.ID,
+		WorkflowStarted: info.WorkflowStartTime.UTC(),
+		Event:           &req.Event,
+	}
+
+	r.phase(RunPhaseRestoring)
+	if err := workflow.ExecuteActivity(ctx, vc.RestoreVMs, preempted, record, req.MarkerCategory).Get(ctx, &r.restored); err != nil {
+		logger.Error("restore preempted vms", "error", err)
+		r.fail(stepRestoreVMs, err)
+		return
+	}
+	logger.Debug("restored virtual machines result", "count", len(r.restored), "refs", r.restored)
+
+	if len(r.restored) < len(preempted) {
+		logger.Warn("not all preempted virtual machines restored", "preempted", len(preempted), "restored", len(r.restored))
+	}
+	r.succeed()
+}
+
+// migrate migrates the given preemptible VMs to the migration target of the
+// request and records the migrations in r. It returns the VMs which were not
+// migrated and must be preempted. If the migration fails, the VMs still on the
+// source cluster are returned together with the error.
+func migrate(ctx workflow.Context, req WorkflowRequest, r *run, preemptible []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+
+	r.phase(RunPhaseMigrating)
+	logger.Debug("migrating preemptible virtual machines", "cluster", req.Migrate.Cluster, "hostGroup", req.Migrate.HostGroup)
+	migCtx := workflow.WithStartToCloseTimeout(ctx, batchTimeout(req.Migrate.timeout(), len(preemptible)))
+	err := workflow.ExecuteActivity(migCtx, vc.MigrateVMs, preemptible, *req.Migrate).Get(ctx, &r.migrated)
+	if err != nil {
+		// vms migrated before the failure are returned as error or heartbeat
+		// details and must not be preempted on the overflow cluster
+		var (
+			done       []types.ManagedObjectReference
+			appErr     *temporal.ApplicationError
+			timeoutErr *temporal.TimeoutError
+		)
+		switch {
+		case errors.As(err, &appErr) && appErr.HasDetails():
+			if dErr := appErr.Details(&done); dErr != nil {
+				done = nil
+			}
+		case errors.As(err, &timeoutErr) && timeoutErr.HasLastHeartbeatDetails():
+			if dErr := timeoutErr.LastHeartbeatDetails(&done); dErr != nil {
+				done = nil
+			}
+		}
+
+		r.migrated = nil
+		for _, ref := range done {
+			r.migrated = append(r.migrated, Migration{VM: ref, Cluster: req.Migrate.Cluster})
+		}
+		logger.Warn("migrate preemptible vms: preempting virtual machines not migrated", "error", err, "migrated", len(done))
+	} else {
+		logger.Debug("migrated virtual machines result", "count", len(r.migrated))
+	}
+
+	migrated := make(map[types.ManagedObjectReference]struct{}, len(r.migrated))
+	for _, m := range r.migrated {
+		migrated[m.VM] = struct{}{}
+	}
+
+	remaining := make([]types.ManagedObjectReference, 0, len(preemptible)-len(migrated))
+	for _, ref := range preemptible {
+		if _, ok := migrated[ref]; !ok {
+			remaining = append(remaining, ref)
+		}
+	}
+	return remaining, err
+}
+
+// drain runs the drain command of the request in the given preemptible VMs
+// and records the results in r. It returns the VMs to preempt according to the
+// drain failure policy and the error if the drain activity failed.
+func drain(ctx workflow.Context, req WorkflowRequest, r *run, preemptible []types.ManagedObjectReference) ([]types.ManagedObjectReference, error) {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+	policy := req.Drain.failurePolicy()
+
+	r.phase(RunPhaseDraining)
+	logger.Debug("draining preemptible virtual machines", "command", req.Drain.Command, "policy", policy)
+	drainCtx := workflow.WithStartToCloseTimeout(ctx, batchTimeout(req.Drain.timeout(), len(preemptible)))
+	if err := workflow.ExecuteActivity(drainCtx, vc.DrainVMs, preemptible, *req.Drain).Get(ctx, &r.drain); err != nil {
+		if policy == DrainFailForce {
+			logger.Warn("drain preemptible vms: preempting all virtual machines due to failure policy", "error", err, "policy", policy)
+			return preemptible, err
+		}
+		logger.Warn("drain preemptible vms: not preempting virtual machines due to failure policy", "error", err, "policy", policy)
+		return nil, err
+	}
+
+	if policy == DrainFailForce {
+		return preemptible, nil
+	}
+
+	drained := make([]types.ManagedObjectReference, 0, len(r.drain))
+	for _, res := range r.drain {
+		if res.Drained {
+			drained = append(drained, res.VM)
+		}
+	}
+	if len(drained) < len(preemptible) {
+		logger.Info("not preempting virtual machines which failed to drain", "preemptible", len(preemptible), "drained", len(drained))
+	}
+	if len(drained) == 0 {
+		msg := fmt.Sprintf("none of %d virtual machines drained", len(preemptible))
+		return nil, temporal.NewNonRetryableApplicationError(msg, errVSphere, nil)
+	}
+	return drained, nil
+}
+
+// rebalance requests DRS recommendations for the clusters of the preempted VMs
+// and applies them depending on the rebalance mode of the request
+func rebalance(ctx workflow.Context, req WorkflowRequest, r *run) {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+
+	r.phase(RunPhaseRebalancing)
+	apply := req.Rebalance == RebalanceApply
+	logger.Debug("requesting drs recommendations", "apply", apply)
+	if err := workflow.ExecuteActivity(ctx, vc.RebalanceClusters, r.preempted, apply).Get(ctx, &r.rebalance); err != nil {
+		logger.Warn("rebalance clusters", "error", err)
+		r.partial(stepRebalanceClusters, err)
+		return
+	}
+	logger.Debug("drs recommendations result", "count", len(r.rebalance))
+}
+
+// stop powers off or suspends the given VMs depending on the action of the
+// request and stores the stopped VMs in stopped. It returns false if the run
+// failed.
+func stop(ctx workflow.Context, req WorkflowRequest, r *run, refs []types.ManagedObjectReference, stopped *[]types.ManagedObjectReference) bool {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+
+	if req.Action == ActionSuspend {
+		if err := workflow.ExecuteActivity(ctx, vc.SuspendVMs, refs).Get(ctx, stopped); err != nil {
+			logger.Error("suspend preemptible vms", "error", err)
+			r.fail(stepSuspendVMs, err)
+			sendVMFailed(ctx, req, r, refs, nil, err)
+			return false
+		}
+		sendVMFailed(ctx, req, r, refs, *stopped, nil)
+		return true
+	}
+
+	force := req.Criticality != CriticalityLow
+	if err := workflow.ExecuteActivity(ctx, vc.PowerOffVMs, refs, force).Get(ctx, stopped); err != nil {
+		logger.Error("power off preemptible vms", "error", err)
+		r.fail(stepPowerOffVMs, err)
+		sendVMFailed(ctx, req, r, refs, nil, err)
+		return false
+	}
+	sendVMFailed(ctx, req, r, refs, *stopped, nil)
+	return true
+}
+
+// authorize calls the veto hook and requests approval (CriticalityMedium) for
+// the given preemptible VMs. It returns the VMs which may be preempted and
+// false if the run must not continue.
+func authorize(ctx workflow.Context, req WorkflowRequest, r *run, preemptible []types.ManagedObjectReference) ([]types.ManagedObjectReference, bool) {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+	info := workflow.GetInfo(ctx)
+
+	vetoVersion := workflow.DefaultVersion
+	if len(preemptible) > 0 {
+		r.phase(RunPhaseAuthorizing)
+		vetoVersion = workflow.GetVersion(ctx, changeVetoHook, workflow.DefaultVersion, 1)
+	}
+
+	if vetoVersion >= 1 {
+		data := VetoRequest{
+			Tag:             req.Tag,
+			Criticality:     req.Criticality,
+			WorkflowID:      info.WorkflowExecution.ID,
+			RunID:           info.WorkflowExecution.RunID,
+			VirtualMachines: preemptible,
+			Event:           req.Event,
+		}
+
+		vetoCtx := workflow.WithRetryPolicy(ctx, vetoRetryPolicy)
+		logger.Debug("calling veto hook")
+		if err := workflow.ExecuteActivity(vetoCtx, vc.CallVetoHook, req.VetoHook, data).Get(ctx, &r.veto); err != nil {
+			if req.VetoFailurePolicy == VetoFailClosed {
+				logger.Error("call veto hook: failing workflow run due to failure policy", "error", err, "policy", VetoFailClosed)
+				r.fail(stepCallVetoHook, err)
+				return nil, false
+			}
+			logger.Warn("call veto hook: continuing workflow run due to failure policy", "error", err, "policy", VetoFailOpen)
+		}
+
+		if r.veto != nil && r.veto.Veto {
+			logger.Info("preemption vetoed by hook", "reason", r.veto.Reason)
+			r.skip(skipReasonVetoed)
+			return nil, false
+		}
+
+		preemptible = r.veto.filter(preemptible)
+		logger.Debug("preemptible virtual machines after veto hook", "count", len(preemptible), "refs", preemptible)
+	}
+
+	approvalRequired := req.Criticality == CriticalityMedium && len(preemptible) > 0
+	if approvalRequired && workflow.GetVersion(ctx, changeApprovalGate, workflow.DefaultVersion, 1) >= 1 {
+		r.approval = waitForApproval(ctx, req, r, preemptible)
+		if r.approval.Decision != DecisionApprove {
+			logger.Info("preemption rejected", "approver", r.approval.Approver, "reason", r.approval.Reason)
+			r.skip(skipReasonRejected)
+			return nil, false
+		}
+		logger.Info("preemption approved", "approver", r.approval.Approver, "reason", r.approval.Reason)
+	}
+
+	return preemptible, true
+}
+
+// finish annotates the preempted VMs and sends the response event
+func finish(ctx workflow.Context, req WorkflowRequest, r *run, force bool) {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+	info := workflow.GetInfo(ctx)
+	r.phase(RunPhaseFinishing)
+
+	annotation := AnnotationRecord{
+		Preempted:       true,
+		Tag:             req.Tag,
+		ForcedShutdown:  force && req.Action != ActionSuspend,
+		Suspended:       req.Action == ActionSuspend,
+		Action:          VMActionPreempted,
+		Criticality:     req.Criticality,
+		WorkflowID:      info.WorkflowExecution.ID,
+		WorkflowStarted: info.WorkflowStartTime.UTC(),
+		Event:           &req.Event,
+	}
+	if r.approval != nil {
+		annotation.ApprovedBy = r.approval.Approver
+	}
+	if r.admission != nil {
+		annotation.AdmittedVM = &r.admission.Target
+	}
+
+	logger.Debug("annotating preempted virtual machines")
+	annotated := annotate(ctx, req, r, r.preempted, annotation, req.MarkerCategory)
+
+	if len(r.migrated) > 0 {
+		migrated := annotation
+		migrated.Preempted = false
+		migrated.ForcedShutdown = false
+		migrated.Suspended = false
+		migrated.Action = VMActionMigrated
+		migrated.MigratedTo = req.Migrate.Cluster
+
+		refs := make([]types.ManagedObjectReference, 0, len(r.migrated))
+		for _, m := range r.migrated {
+			refs = append(refs, m.VM)
+		}
+
+		logger.Debug("annotating migrated virtual machines")
+		annotate(ctx, req, r, refs, migrated, "")
+	}
+
+	if req.DisableHARestart && len(r.preempted) > 0 {
+		// previous settings are stored in the annotation
+		if len(annotated) < len(r.preempted) {
+			logger.Warn("not disabling ha restart of virtual machines which were not annotated", "count", len(r.preempted)-len(annotated))
+		}
+		if len(annotated) == 0 {
+			logger.Warn("not disabling ha restart: annotation failed")
+		} else if err := workflow.ExecuteActivity(ctx, vc.DisableHARestart, annotated).Get(ctx, nil); err != nil {
+			logger.Warn("disable ha restart", "error", err)
+			r.partial(stepDisableHARestart, err)
+		}
+	}
+
+	if len(r.preempted) > 0 && workflow.GetVersion(ctx, changeVMEvents, workflow.DefaultVersion, 1) >= 1 {
+		vmEvent := VMEvent{
+			WorkflowID:  info.WorkflowExecution.ID,
+			Criticality: req.Criticality,
+			Reason:      req.reason(),
+		}
+
+		logger.Debug("posting vcenter events for preempted virtual machines")
+		if err := workflow.ExecuteActivity(ctx, vc.PostVMEvents, r.preempted, vmEvent).Get(ctx, nil); err != nil {
+			// log only, continue workflow
+			logger.Warn("post vm events", "error", err)
+			r.partial(stepPostVMEvents, err)
+		}
+	}
+
+	if len(req.sinks()) == 0 {
+		logger.Debug("not creating cloud event response: no sinks set")
+		return
+	}
+
+	eventData := eventResponseData{
+		AnnotationRecord: annotation,
+		VirtualMachines:  r.preempted,
+		Migrated:         r.migrated,
+		Drain:            r.drain,
+	}
+	logger.Debug("sending cloudevents response")
+
+	if err := deliver(ctx, req, r, eventType, eventData); err != nil {
+		r.partial(stepSendPreemptedEvent, err)
+	}
+}
+
+// annotate adds the given record to the annotation history of the given VMs,
+// records the result per VM in r and applies the annotation failure policy of
+// the request. It returns the annotated VMs.
+func annotate(ctx workflow.Context, req WorkflowRequest, r *run, refs []types.ManagedObjectReference, record AnnotationRecord, markerCategory string) []types.ManagedObjectReference {
+	var vc *Client // vcenter client will be injected
+
+	logger := workflow.GetLogger(ctx)
+
+	var results []AnnotationResult
+	if err := workflow.ExecuteActivity(ctx, vc.AnnotateVms, refs, record, markerCategory).Get(ctx, &results); err != nil {
+		// per vm results are returned as error details
+		var appErr *temporal.ApplicationError
+		if !errors.As(err, &appErr) || !appErr.HasDetails() || appErr.Details(&results) != nil {
+			results = make([]AnnotationResult, 0, len(refs))
+			for _, ref := range refs {
+				results = append(results, AnnotationResult{VM: ref, Action: record.Action, Error: err.Error()})
+			}
+		}
+
+		if req.AnnotationFailurePolicy == AnnotationFailRun {
+			logger.Error("annotate virtual machines: failing workflow run due to failure policy", "error", err, "policy", AnnotationFailRun)
+			if r.status != RunStatusFailed {
+				r.fail(stepAnnotateVms, err)
+			}
+		} else {
+			// log only, continue workflow
+			logger.Warn("annotate virtual machines", "error", err, "action", record.Action)
+			r.partial(stepAnnotateVms, err)
+		}
+	}
+	r.annotations = append(r.annotations, results...)
+
+	annotated := make([]types.ManagedObjectReference, 0, len(results))
+	for _, res := range results {
+		if res.Annotated {
+			annotated = append(annotated, res.VM)
+		}
+	}
+	return annotated
+}
+
+// waitForApproval requests approval for the given preemptible VMs and blocks
+// until an approval decision is received or the approval timeout fires, in
+// which case the default decision of the request is returned
+func waitForApproval(ctx workflow.Context, req WorkflowRequest, r *run, preemptible []types.ManagedObjectReference) *ApprovalResponse {
+	logger := workflow.GetLogger(ctx)
+	info := workflow.GetInfo(ctx)
+
+	timeout := req.ApprovalTimeout
+	if timeout <= 0 {
+		timeout = DefaultApprovalTimeout
+	}
+
+	defaultDecision := req.ApprovalDefault
+	if defaultDecision == "" {
+		defaultDecision = DefaultApprovalDecision
+	}
+
+	approvalCh := workflow.GetSignalChannel(ctx, ApprovalSignalChannel)
+
+	// discard decisions sent while no approval was pending
+	for {
+		var stale ApprovalResponse
+		if ok := approvalCh.ReceiveAsync(&stale); !ok {
+			break
+		}
+		logger.Warn("discarding stale approval decision", "decision", stale.Decision, "approver", stale.Approver)
+	}
+
+	if len(req.sinks()) == 0 {
+		logger.Debug("not creating approval request event: no sinks set")
+	} else {
+		data := approvalRequestData{
+			Tag:             req.Tag,
+			Criticality:     req.Criticality,
+			WorkflowID:      info.WorkflowExecution.ID,
+			RunID:           info.WorkflowExecution.RunID,
+			RequestedBy:     req.RequestedBy,
+			Timeout:         timeout.String(),
+			DefaultDecision: defaultDecision,
+			VirtualMachines: preemptible,
+			Event:           req.Event,
+		}
+
+		logger.Debug("sending approval request cloudevent")
+		// log only, approval can still be sent
+		_ = deliver(ctx, req, r, approvalEventType, data)
+	}
+
+	timerCtx, cancelTimer := workflow.WithCancel(ctx)
+	defer cancelTimer()
+	timer := workflow.NewTimer(timerCtx, timeout)
+
+	var (
+		decision *ApprovalResponse
+		done     bool
+	)
+
+	logger.Info("waiting for approval", "channel", ApprovalSignalChannel, "timeout", timeout.String(), "default", defaultDecision)
+	for !done {
+		sel := workflow.NewSelector(ctx)
+		sel.AddReceive(ctx.Done(), func(_ workflow.ReceiveChannel, _ bool) {
+			logger.Info("received cancellation signal while waiting for approval")
+			decision = &ApprovalResponse{Decision: DecisionReject, Reason: "workflow cancelled"}
+			done = true
+		})
+
+		sel.AddFuture(timer, func(_ workflow.Future) {
+			logger.Info("approval timed out, applying default decision", "decision", defaultDecision)
+			decision = &ApprovalResponse{Decision: defaultDecision, Reason: "approval timed out"}
+			done = true
+		})
+
+		sel.AddReceive(approvalCh, func(c workflow.ReceiveChannel, _ bool) {
+			var resp ApprovalResponse
+			c.Receive(ctx, &resp)
+
+			if resp.Decision != DecisionApprove && resp.Decision != DecisionReject {
+				logger.Warn("ignoring invalid approval decision", "decision", resp.Decision, "approver", resp.Approver)
+				return
+			}
+
+			// two-person rule
+			if req.RequestedBy != "" && resp.Approver == req.RequestedBy {
+				logger.Warn("ignoring approval decision: requester must not approve own request", "approver", resp.Approver)
+				return
+			}
+
+			decision = &resp
+			done = true
+		})
+
+		sel.Select(ctx)
+	}
+
+	return decision
+}
@@ -2,10 +2,16 @@ package preemption
 
 import (
 	"context"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,9 +20,12 @@ import (
 
 	"github.com/benbjohnson/clock"
 	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
 	"github.com/cloudevents/sdk-go/v2/client/test"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"github.com/vmware/govmomi/event"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/property"
@@ -27,8 +36,11 @@ import (
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
 	vimtypes "github.com/vmware/govmomi/vim25/types"
+	"go.temporal.io/sdk/converter"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/testsuite"
+	"go.temporal.io/sdk/worker"
+	"go.temporal.io/sdk/workflow"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
@@ -55,6 +67,28 @@ func TestUnitTestSuite(t *testing.T) {
 	suite.Run(t, new(UnitTestSuite))
 }
 
+// Test_WorkflowReplay replays workflow histories recorded with previous releases
+// against the current workflow code to detect non-deterministic changes
+func (s *UnitTestSuite) Test_WorkflowReplay() {
+	histories, err := filepath.Glob(filepath.Join("testdata", "histories", "*.json"))
+	s.Require().NoError(err)
+	s.Require().NotEmpty(histories)
+
+	for _, h := range histories {
+		h := h
+		s.T().Run(filepath.Base(h), func(t *testing.T) {
+			// replays of the same history share the cached workflow state
+			worker.PurgeStickyWorkflowCache()
+
+			replayer := worker.NewWorkflowReplayer()
+			replayer.RegisterWorkflowWithOptions(PreemptVMsWorkflow, workflow.RegisterOptions{Name: WorkflowName})
+
+			err := replayer.ReplayWorkflowHistoryFromJSONFile(nil, h)
+			s.NoError(err)
+		})
+	}
+}
+
 func (s *UnitTestSuite) Test_Workflow() {
 	s.T().Run("cancel workflow stops workflow execution without error", func(t *testing.T) {
 		env := s.NewTestWorkflowEnvironment()
@@ -63,7 +97,7 @@ func (s *UnitTestSuite) Test_Workflow() {
 			env.CancelWorkflow()
 		}, time.Minute*10)
 
-		env.ExecuteWorkflow(PreemptVMsWorkflow)
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
 		elapsed := env.Now().Sub(start)
 		s.Equal(time.Minute*10, elapsed)
@@ -103,9 +137,9 @@ func (s *UnitTestSuite) Test_Workflow() {
 		env.OnActivity("PowerOffVMs", any, any, true).Return(nil, nil).Once()
 
 		// assert no event is sent
-		env.OnActivity("SendPreemptedEvent", any, any, any, any).Never()
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Never()
 
-		env.ExecuteWorkflow(PreemptVMsWorkflow)
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
 		s.True(env.IsWorkflowCompleted())
 		s.NoError(env.GetWorkflowError())
@@ -141,18 +175,23 @@ func (s *UnitTestSuite) Test_Workflow() {
 		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
 		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, errors.New("failed to power off")).Times(3)
 
-		env.OnActivity("AnnotateVms", any, any, any).Never()
-		env.OnActivity("SendPreemptedEvent", any, any, any, any).Never()
+		env.OnActivity("AnnotateVms", any, any, any, any).Never()
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Never()
 
-		env.ExecuteWorkflow(PreemptVMsWorkflow)
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
 		s.True(env.IsWorkflowCompleted())
 		s.NoError(env.GetWorkflowError())
 
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(stepPowerOffVMs, res.Error.Step)
+
 		env.AssertExpectations(t)
 	})
 
-	s.T().Run("fails to annotate VMs due to missing custom field, no retry and continues this workflow run", func(t *testing.T) {
+	s.T().Run("sends failure event when run fails", func(t *testing.T) {
 		env := s.NewTestWorkflowEnvironment()
 		env.RegisterDelayedCallback(func() {
 			e := ce.NewEvent()
@@ -176,30 +215,109 @@ func (s *UnitTestSuite) Test_Workflow() {
 		var c *Client
 		env.RegisterActivity(c)
 
-		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
-		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
-
-		// should not retry
-		env.OnActivity("AnnotateVms", any, any, any).Return(temporal.NewNonRetryableApplicationError("annotation failed", errVSphere, errors.New("custom field not found"))).Once()
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, temporal.NewNonRetryableApplicationError("get tag", errVSphere, errors.New("tag not found"))).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Never()
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Never()
 
-		// assert event is sent
-		env.OnActivity("SendPreemptedEvent", any, any, any, any).Return(nil).Once()
+		// assert failure event is sent with stable error code
+		env.OnActivity("SendFailedEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data failedEventData) bool {
+			return data.Error.Code == ErrorCodeVSphere && data.Error.Step == stepGetPreemptibleVMs
+		}), any).Return(nil).Once()
 
-		env.ExecuteWorkflow(PreemptVMsWorkflow)
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
 		s.True(env.IsWorkflowCompleted())
 		s.NoError(env.GetWorkflowError())
 
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(ErrorCodeVSphere, res.Error.Code)
+		s.Equal(errVSphere, res.Error.Type)
+
 		env.AssertExpectations(t)
 	})
 
-	s.T().Run("sends event after preemption", func(t *testing.T) {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		logger := zaptest.NewLogger(s.T())
+	s.T().Run("sends lifecycle events for started, failed VMs, completed, skipped and restored runs", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		requests := []struct {
+			delay time.Duration
+			id    string
+			typ   RequestType
+		}{
+			{time.Minute, "1", RequestTypePreempt},
+			{time.Minute * 2, "1", RequestTypePreempt}, // duplicate
+			{time.Minute * 3, "2", RequestTypeRestore},
+		}
+		for _, r := range requests {
+			r := r
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID(r.id)
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
 
-		const broker = "https://test-broker.local"
+				req := WorkflowRequest{
+					Type:        r.typ,
+					Tag:         "test-preemption",
+					Criticality: CriticalityHigh,
+					Event:       e,
+					ReplyTo:     "https://test-broker.local",
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, r.delay)
+		}
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+		vms := []vimtypes.ManagedObjectReference{vm1, vm2}
+
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Return(nil).Once()
+		env.OnActivity("GetPreemptedVMs", any, any).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("RestoreVMs", any, any, any, any).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+
+		env.OnActivity("SendStartedEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data startedEventData) bool {
+			return reflect.DeepEqual(data.Candidates, vms) && data.Event.ID() == "1"
+		}), any).Return(nil).Once()
+		env.OnActivity("SendVMFailedEvents", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data []vmFailedEventData) bool {
+			return len(data) == 1 && data[0].VirtualMachine == vm2 && data[0].Action == ActionPowerOff
+		}), any).Return(nil).Once()
+		env.OnActivity("SendCompletedEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data completedEventData) bool {
+			return data.Status == RunStatusPartiallySucceeded && data.Error.Step == stepPowerOffVMs && reflect.DeepEqual(data.VirtualMachines, []vimtypes.ManagedObjectReference{vm1})
+		}), any).Return(nil).Once()
+		env.OnActivity("SendSkippedEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data skippedEventData) bool {
+			return data.Code == SkipCodeDuplicate && data.Reason == skipReasonDuplicate
+		}), any).Return(nil).Once()
+		env.OnActivity("SendRestoredEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, mock.MatchedBy(func(data restoredEventData) bool {
+			return data.Type == RequestTypeRestore && reflect.DeepEqual(data.VirtualMachines, []vimtypes.ManagedObjectReference{vm1})
+		}), any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(1, res.DuplicateEvents)
+
+		env.AssertExpectations(t)
+	})
 
+	s.T().Run("fails run if no preemptible VM was stopped", func(t *testing.T) {
 		env := s.NewTestWorkflowEnvironment()
 		env.RegisterDelayedCallback(func() {
 			e := ce.NewEvent()
@@ -211,7 +329,6 @@ func (s *UnitTestSuite) Test_Workflow() {
 				Tag:         "test-preemption",
 				Criticality: CriticalityHigh,
 				Event:       e,
-				ReplyTo:     broker,
 			}
 			env.SignalWorkflow(SignalChannel, req)
 		}, time.Minute)
@@ -220,238 +337,3584 @@ func (s *UnitTestSuite) Test_Workflow() {
 			env.CancelWorkflow()
 		}, time.Minute*10)
 
-		ceMock, recvCh := test.NewMockSenderClient(t, 1)
-		c := Client{
-			ceclient: ceMock,
-			clock:    clock.NewMock(),
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{
+			{Type: "VirtualMachine", Value: "vm-1"},
+			{Type: "VirtualMachine", Value: "vm-2"},
 		}
-		env.RegisterActivity(&c)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Never()
 
-		// mock everything
-		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
-		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
-		env.OnActivity("AnnotateVms", any, any, any).Return(nil).Once()
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
-		var (
-			expected int32 = 1
-			received int32
-			wg       sync.WaitGroup
-		)
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
 
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			select {
-			case <-ctx.Done():
-				s.FailNow("context cancelled before receiving event")
-			case e := <-recvCh:
-				logger.Debug("received event", zap.String("event", e.String()))
-				atomic.AddInt32(&received, 1)
-				return
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(stepPowerOffVMs, res.Error.Step)
+		s.Equal(ErrorCodeVSphere, res.Error.Code)
+		s.Contains(res.Error.Message, "2 of 2 virtual machines not stopped")
+		s.Empty(res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("delivers events to each sink with its retry policy and records delivery status", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				ReplyTo:     "https://test-broker.local",
+				Sinks:       []SinkConfig{{URL: "stdout://", Retry: &SinkRetry{MaxAttempts: 1}}},
 			}
-		}()
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
 
-		err := setEnvVars()
-		s.NoError(err, "set environment variables")
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
 
-		env.ExecuteWorkflow(PreemptVMsWorkflow)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+		env.OnActivity("SendPreemptedEvent", any, any, SinkConfig{URL: "https://test-broker.local"}, any, any).Return(nil).Once()
+
+		// assert delivery to stdout sink is not retried, but redelivered once by
+		// the outbox before the workflow is cancelled
+		env.OnActivity("SendPreemptedEvent", any, any, SinkConfig{URL: "stdout://", Retry: &SinkRetry{MaxAttempts: 1}}, any, any).Return(errors.New("stdout closed")).Times(2)
+		env.OnActivity("SendCompletedEvent", any, any, any, any, any).Return(nil).Times(2)
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
 		s.True(env.IsWorkflowCompleted())
 		s.NoError(env.GetWorkflowError())
 
-		wg.Wait()
-		s.Equal(expected, atomic.LoadInt32(&received), "receiving cloud event")
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(stepSendPreemptedEvent, res.Error.Step)
+		s.Len(res.Deliveries, 4)
+		s.Equal(Delivery{Sink: "https://test-broker.local", EventType: eventType, Delivered: true}, res.Deliveries[0])
+		s.Equal("stdout://", res.Deliveries[1].Sink)
+		s.False(res.Deliveries[1].Delivered)
+		s.Contains(res.Deliveries[1].Error, "stdout closed")
+		s.True(res.Deliveries[1].Queued)
+		s.Equal(completedEventType, res.Deliveries[3].EventType)
+		s.Equal(1, res.PendingEvents)
 
 		env.AssertExpectations(t)
 	})
 
-	s.T().Run("e2e: retry GetPreemptibleVMs activity due to non-existing tag", func(t *testing.T) {
-		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
-			rc := rest.NewClient(client)
-			rcRT := rc.Client.Client.Transport
-			logger := zaptest.NewLogger(t)
+	s.T().Run("redelivers undelivered events from outbox until delivered or expired", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		sink := SinkConfig{URL: "stdout://", Retry: &SinkRetry{MaxAttempts: 1}}
 
-			fakeRT := fakeRoundTripper{
-				rt:       rcRT,
-				Logger:   logger,
-				callsMap: make(map[string]int),
-			}
-			rc.Client.Client.Transport = &fakeRT
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
 
-			c := Client{
-				vcclient:   client,
-				clock:      clock.NewMock(),
-				tagManager: tags.NewManager(rc),
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Sinks:       []SinkConfig{sink},
+				EventExpiry: time.Minute * 30,
 			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
 
-			env := s.NewTestWorkflowEnvironment()
-			env.RegisterDelayedCallback(func() {
-				e := ce.NewEvent()
-				e.SetID("1")
-				e.SetType("AlarmStatusChangedEvent")
-				e.SetSource("https://vcenter.test/sdk")
+		// first redelivery after 6m fails, next attempt at 16m
+		env.RegisterDelayedCallback(func() {
+			v, err := env.QueryWorkflow(PendingEventsQueryType)
+			s.NoError(err)
 
-				req := WorkflowRequest{
-					Tag:         "does-not-exist",
-					Criticality: CriticalityHigh,
-					Event:       e,
-					ReplyTo:     "",
-				}
-				env.SignalWorkflow(SignalChannel, req)
-			}, time.Minute)
+			var pending []PendingEvent
+			s.NoError(v.Get(&pending))
+			s.Len(pending, 2)
+			s.Equal(eventType, pending[0].EventType)
+			s.Equal(1, pending[0].Attempts)
+			s.Contains(pending[0].LastError, "stdout closed")
+			s.Equal(completedEventType, pending[1].EventType)
 
-			env.RegisterDelayedCallback(func() {
-				env.CancelWorkflow()
-			}, time.Minute*10)
+			env.SignalWorkflow(RedeliverSignalChannel, RedeliverRequest{IDs: []string{pending[0].ID}})
+		}, time.Minute*8)
 
-			env.RegisterActivity(&c)
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Hour)
 
-			// assert never called
-			env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Never()
+		var c *Client
+		env.RegisterActivity(c)
 
-			// assert never called
-			env.OnActivity("AnnotateVms", any, any, any).Return(nil).Never()
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
 
-			// assert never called
-			env.OnActivity("SendPreemptedEvent", any, any, any, any).Return(nil).Never()
+		// initial delivery and automatic redelivery fail, manual redelivery succeeds
+		env.OnActivity("SendPreemptedEvent", any, any, sink, any, any).Return(errors.New("stdout closed")).Times(2)
+		env.OnActivity("SendPreemptedEvent", any, any, sink, any, any).Return(nil).Once()
 
-			env.ExecuteWorkflow(PreemptVMsWorkflow)
+		// completed event is never delivered and expires after 30m
+		env.OnActivity("SendCompletedEvent", any, any, sink, any, any).Return(errors.New("stdout closed"))
 
-			s.True(env.IsWorkflowCompleted())
-			s.NoError(env.GetWorkflowError())
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
-			// expect three retried VAPI ListTag calls from GetPreemptibleVMs activity
-			s.Equal(3, fakeRT.callsMap[getTag])
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
 
-			env.AssertExpectations(t)
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.True(res.Deliveries[0].Queued)
+		s.Equal(0, res.PendingEvents)
+		s.Equal(1, res.DroppedEvents)
 
-			return nil
-		})
+		env.AssertExpectations(t)
 	})
 
-	s.T().Run("e2e: power off two preemptible VM", func(t *testing.T) {
-		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
-			rc := rest.NewClient(client)
-			err := rc.Login(ctx, simulator.DefaultLogin)
-			s.NoError(err)
+	s.T().Run("does not debounce PREEMPT request after RESTORE request or invalid request", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		requests := []struct {
+			delay   time.Duration
+			typ     RequestType
+			invalid bool
+		}{
+			{time.Minute, RequestTypeRestore, false},
+			{time.Minute + time.Second*20, RequestTypePreempt, true},
+			{time.Minute + time.Second*40, RequestTypePreempt, false},
+		}
+		for i, r := range requests {
+			id, r := fmt.Sprint(i), r
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID(id)
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
 
-			c := Client{
-				vcclient:   client,
-				clock:      clock.NewMock(),
-				tagManager: tags.NewManager(rc),
-			}
+				req := WorkflowRequest{
+					Type:            r.typ,
+					Tag:             "test-preemption",
+					Criticality:     CriticalityHigh,
+					Event:           e,
+					MaintenanceMode: r.invalid, // requires RequestTypeEvacuate
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, r.delay)
+		}
 
-			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
-				Name:            "test-category",
-				Description:     "test category",
-				AssociableTypes: []string{"VirtualMachine"},
-				Cardinality:     "SINGLE",
-			})
-			s.NoError(err)
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
 
-			const tagName = "preemptible"
-			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
-				Name:        tagName,
-				Description: "test tag",
-				CategoryID:  cID,
-			})
-			s.NoError(err)
+		var c *Client
+		env.RegisterActivity(c)
 
-			vms, err := getAllVms(ctx, client)
-			s.NoError(err)
+		env.OnActivity("GetPreemptedVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("RestoreVMs", any, any, any, any).Return(nil, nil).Once()
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
 
-			const wantVms = 4
-			if len(vms) != wantVms {
-				s.FailNowf("received unexpected number of virtual machines", "want=%d got=%d", wantVms, len(vms))
-			}
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
-			for _, vm := range vms {
-				state, err := vm.PowerState(ctx)
-				s.NoError(err)
-				if state != vimtypes.VirtualMachinePowerStatePoweredOn {
-					s.FailNowf("expected vm to be powered on", "vm: %q", vm.Reference().String())
-				}
-			}
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
 
-			tagVms := []mo.Reference{vms[0], vms[1]}
-			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
-			s.NoError(err)
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
 
-			env := s.NewTestWorkflowEnvironment()
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("skips second run within re-run threshold", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		for i, d := range []time.Duration{time.Minute, time.Minute + time.Second*30} {
+			id := fmt.Sprint(i)
 			env.RegisterDelayedCallback(func() {
 				e := ce.NewEvent()
-				e.SetID("1")
+				e.SetID(id)
 				e.SetType("AlarmStatusChangedEvent")
 				e.SetSource("https://vcenter.test/sdk")
 
 				req := WorkflowRequest{
-					Tag:         tagName,
+					Tag:         "test-preemption",
 					Criticality: CriticalityHigh,
 					Event:       e,
-					ReplyTo:     "",
 				}
 				env.SignalWorkflow(SignalChannel, req)
-			}, time.Minute)
+			}, d)
+		}
 
-			env.RegisterDelayedCallback(func() {
-				env.CancelWorkflow()
-			}, time.Minute*10)
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
 
-			env.RegisterActivity(&c)
-			env.ExecuteWorkflow(PreemptVMsWorkflow)
+		var c *Client
+		env.RegisterActivity(c)
 
-			s.True(env.IsWorkflowCompleted())
-			s.NoError(env.GetWorkflowError())
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
 
-			// retrieve updated vm states
-			vms, err = getAllVms(ctx, client)
-			s.NoError(err)
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
-			// first two vms should be preempted and annotated
-			for _, vm := range vms[:2] {
-				state, err := vm.PowerState(ctx)
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSkipped, res.Status)
+		s.Equal(skipReasonDebounce, res.SkipReason)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("skips duplicate request events outside of re-run threshold", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		for _, d := range []time.Duration{time.Minute, time.Minute * 5} {
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         "test-preemption",
+					Criticality: CriticalityHigh,
+					Event:       e,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, d)
+		}
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSkipped, res.Status)
+		s.Equal(skipReasonDuplicate, res.SkipReason)
+		s.Equal(1, res.DuplicateEvents)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("runs retried request event again if previous run failed", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		for _, d := range []time.Duration{time.Minute, time.Minute * 5} {
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         "test-preemption",
+					Criticality: CriticalityHigh,
+					Event:       e,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, d)
+		}
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vsphereErr := temporal.NewApplicationError("get tag", errVSphere)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, vsphereErr).Times(3)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(0, res.DuplicateEvents)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("skips retried request event if failed ADMIT run already preempted VMs", func(t *testing.T) {
+		target := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-100"}
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+
+		env := s.NewTestWorkflowEnvironment()
+		for _, d := range []time.Duration{time.Minute, time.Minute * 5} {
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AdmissionRequestedEvent")
+				e.SetSource("https://ops.test")
+
+				req := WorkflowRequest{
+					Type:        RequestTypeAdmit,
+					Tag:         "test-preemption",
+					Criticality: CriticalityHigh,
+					Event:       e,
+					Target:      &target,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, d)
+		}
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		plan := admissionPlan{
+			Cluster:    "cluster-01",
+			Required:   capacity{MemoryMB: 4096, CpuMHz: 2000},
+			Deficit:    capacity{MemoryMB: 1024, CpuMHz: 1000},
+			Candidates: []admissionCandidate{{Ref: vm1, Capacity: capacity{MemoryMB: 2048, CpuMHz: 2000}}},
+		}
+
+		env.OnActivity("GetAdmissionPlan", any, any).Return(&plan, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference{vm1}, true).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("PowerOnVM", any, target).Return(temporal.NewNonRetryableApplicationError("power on vm", errVSphere, nil)).Once()
+		env.OnActivity("AnnotateVms", any, []vimtypes.ManagedObjectReference{vm1}, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSkipped, res.Status)
+		s.Equal(skipReasonDuplicate, res.SkipReason)
+		s.Equal(1, res.DuplicateEvents)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("fails to annotate VMs due to missing custom field, no retry and continues this workflow run", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				ReplyTo:     "https://test-broker.local",
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+
+		// should not retry
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, temporal.NewNonRetryableApplicationError("annotation failed", errVSphere, errors.New("custom field not found"))).Once()
+
+		// assert event is sent
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Return(nil).Once()
+		env.OnActivity("SendCompletedEvent", any, any, any, mock.MatchedBy(func(data completedEventData) bool {
+			return data.Status == RunStatusPartiallySucceeded && data.Error.Step == stepAnnotateVms
+		}), any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(ErrorCodeVSphere, res.Error.Code)
+		s.Equal(stepAnnotateVms, res.Error.Step)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("MEDIUM criticality preempts VMs after approval and records approver", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:             "test-preemption",
+				Criticality:     CriticalityMedium,
+				Event:           e,
+				ReplyTo:         "https://test-broker.local",
+				RequestedBy:     "alice",
+				ApprovalTimeout: time.Minute * 5,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		// requester must not approve own request
+		env.RegisterDelayedCallback(func() {
+			env.SignalWorkflow(ApprovalSignalChannel, ApprovalResponse{Decision: DecisionApprove, Approver: "alice"})
+		}, time.Minute*2)
+
+		env.RegisterDelayedCallback(func() {
+			env.SignalWorkflow(ApprovalSignalChannel, ApprovalResponse{Decision: DecisionApprove, Approver: "bob"})
+		}, time.Minute*3)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("SendApprovalRequestEvent", any, any, any, any, any).Return(nil).Once()
+
+		// assert forced is true
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, mock.MatchedBy(func(data AnnotationRecord) bool {
+			return data.ApprovedBy == "bob"
+		}), any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Return(nil).Once()
+		env.OnActivity("SendStartedEvent", any, any, any, any, any).Return(nil).Once()
+		env.OnActivity("SendCompletedEvent", any, any, any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(DecisionApprove, res.Approval.Decision)
+		s.Equal("bob", res.Approval.Approver)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("MEDIUM criticality applies default decision on approval timeout", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:             "test-preemption",
+				Criticality:     CriticalityMedium,
+				Event:           e,
+				ApprovalTimeout: time.Minute * 5,
+				ApprovalDefault: DecisionReject,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+
+		// assert no approval event is sent without replyTo and nothing is preempted
+		env.OnActivity("SendApprovalRequestEvent", any, any, any, any, any).Never()
+		env.OnActivity("PowerOffVMs", any, any, any).Never()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(DecisionReject, res.Approval.Decision)
+		s.Equal("", res.Approval.Approver)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("veto hook removes excluded VMs from preemption", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				VetoHook:    "https://veto.test.local",
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return([]vimtypes.ManagedObjectReference{vm1, vm2}, nil).Once()
+		env.OnActivity("CallVetoHook", any, "https://veto.test.local", any).Return(&VetoResponse{Exclude: []vimtypes.ManagedObjectReference{vm2}}, nil).Once()
+
+		// assert excluded vm is not powered off
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference{vm1}, true).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("veto hook failure fails run without preemption with failure policy CLOSED", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:               "test-preemption",
+				Criticality:       CriticalityHigh,
+				Event:             e,
+				VetoFailurePolicy: VetoFailClosed,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+
+		// assert retried with veto retry policy
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, errors.New("hook unavailable")).Times(int(vetoRetryPolicy.MaximumAttempts))
+		env.OnActivity("PowerOffVMs", any, any, any).Never()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Require().NotNil(res.Error)
+		s.Equal(stepCallVetoHook, res.Error.Step)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("veto hook response is returned to workflow", func(t *testing.T) {
+		hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Ce-Id", "veto-1")
+			w.Header().Set("Ce-Source", "https://veto.test.local")
+			w.Header().Set("Ce-Specversion", "1.0")
+			w.Header().Set("Ce-Type", "VetoResponse")
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"veto":true,"reason":"not now"}`))
+		}))
+		defer hook.Close()
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+
+		p, err := ce.NewHTTP()
+		s.NoError(err)
+		ceclient, err := ce.NewClient(p)
+		s.NoError(err)
+
+		c := Client{
+			ceclient: ceclient,
+			clock:    clock.NewMock(),
+		}
+
+		env := s.NewTestActivityEnvironment()
+		env.RegisterActivity(&c)
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+		val, err := env.ExecuteActivity(c.CallVetoHook, hook.URL, VetoRequest{WorkflowID: "test", Event: e})
+		s.Require().NoError(err)
+
+		var res VetoResponse
+		s.NoError(val.Get(&res))
+		s.True(res.Veto)
+		s.Equal("not now", res.Reason)
+	})
+
+	s.T().Run("veto hook of request does not replace veto hook of worker", func(t *testing.T) {
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+		newHook := func(body string, calls *int32) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(calls, 1)
+				w.Header().Set("Ce-Id", "veto-1")
+				w.Header().Set("Ce-Source", "https://veto.test.local")
+				w.Header().Set("Ce-Specversion", "1.0")
+				w.Header().Set("Ce-Type", "VetoResponse")
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(body))
+			}))
+		}
+
+		var workerCalls, requestCalls int32
+		workerHook := newHook(`{"exclude":[{"type":"VirtualMachine","value":"vm-1"}]}`, &workerCalls)
+		defer workerHook.Close()
+		requestHook := newHook(`{"exclude":[{"type":"VirtualMachine","value":"vm-2"}]}`, &requestCalls)
+		defer requestHook.Close()
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+		t.Setenv("VETO_HOOK_URL", workerHook.URL)
+
+		p, err := ce.NewHTTP()
+		s.NoError(err)
+		ceclient, err := ce.NewClient(p)
+		s.NoError(err)
+
+		c := Client{
+			ceclient: ceclient,
+			clock:    clock.NewMock(),
+		}
+
+		env := s.NewTestActivityEnvironment()
+		env.RegisterActivity(&c)
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+		val, err := env.ExecuteActivity(c.CallVetoHook, requestHook.URL, VetoRequest{WorkflowID: "test", VirtualMachines: vms, Event: e})
+		s.Require().NoError(err)
+
+		var res VetoResponse
+		s.NoError(val.Get(&res))
+		s.False(res.Veto)
+		s.Equal(vms, res.Exclude)
+		s.Equal(int32(1), atomic.LoadInt32(&workerCalls))
+		s.Equal(int32(1), atomic.LoadInt32(&requestCalls))
+	})
+
+	s.T().Run("sends signed event with bearer token to TLS sink with custom CA", func(t *testing.T) {
+		dir := t.TempDir()
+		key := []byte("signing-secret")
+		files := map[string][]byte{
+			"token": []byte("broker-token\n"),
+			"key":   key,
+		}
+
+		var (
+			mu       sync.Mutex
+			received *ce.Event
+			auth     string
+		)
+		broker := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			received, auth = e, r.Header.Get("Authorization")
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer broker.Close()
+
+		files["ca.pem"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: broker.Certificate().Raw})
+		for name, content := range files {
+			s.Require().NoError(os.WriteFile(filepath.Join(dir, name), content, 0o600))
+		}
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+
+		u, err := url.Parse(broker.URL)
+		s.Require().NoError(err)
+		hosts := map[string]string{"token": u.Host, "key": u.Host}
+
+		c := Client{clock: clock.NewMock(), secretDir: dir, secretHosts: hosts}
+		env := s.NewTestActivityEnvironment()
+		env.RegisterActivity(&c)
+
+		sink := SinkConfig{
+			URL: broker.URL,
+			Auth: &SinkAuth{
+				BearerTokenFile: "token",
+				CAFile:          "ca.pem",
+			},
+			SigningKeyFile: "key",
+		}
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+		_, err = env.ExecuteActivity(c.SendFailedEvent, "test", sink, failedEventData{WorkflowID: "test", Event: e}, EventMeta{})
+		s.Require().NoError(err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		s.Equal("Bearer broker-token", auth)
+		s.Require().NotNil(received)
+		s.Equal("test-1-failed", received.ID())
+		s.NoError(VerifyEvent(*received, key))
+		s.Error(VerifyEvent(*received, []byte("other-secret")))
+	})
+
+	s.T().Run("does not send sink secrets to host they are not bound to", func(t *testing.T) {
+		dir := t.TempDir()
+		s.Require().NoError(os.WriteFile(filepath.Join(dir, "token"), []byte("broker-token\n"), 0o600))
+		s.Require().NoError(os.WriteFile(filepath.Join(dir, "key"), []byte("signing-secret"), 0o600))
+
+		var called int32
+		attacker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&called, 1)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer attacker.Close()
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+
+		hosts := map[string]string{"token": "broker.local", "key": "broker.local"}
+		c := Client{clock: clock.NewMock(), secretDir: dir, secretHosts: hosts}
+		env := s.NewTestActivityEnvironment()
+		env.RegisterActivity(&c)
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+
+		sinks := []SinkConfig{
+			{URL: attacker.URL, Auth: &SinkAuth{BearerTokenFile: "token"}},
+			{URL: attacker.URL, SigningKeyFile: "key"},
+		}
+		for _, sink := range sinks {
+			_, err = env.ExecuteActivity(c.SendFailedEvent, "test", sink, failedEventData{WorkflowID: "test", Event: e}, EventMeta{})
+			s.Error(err)
+		}
+		s.Zero(atomic.LoadInt32(&called))
+	})
+
+	s.T().Run("sends one structured event per preempted VM with subject and trace context", func(t *testing.T) {
+		var (
+			mu           sync.Mutex
+			received     []*ce.Event
+			contentTypes []string
+		)
+		broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e, err := binding.ToEvent(r.Context(), cehttp.NewMessageFromHttpRequest(r))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			received = append(received, e)
+			contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer broker.Close()
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+
+		ceclient, err := ce.NewClientHTTP()
+		s.Require().NoError(err)
+
+		c := Client{clock: clock.NewMock(), ceclient: ceclient}
+		env := s.NewTestActivityEnvironment()
+		env.RegisterActivity(&c)
+
+		sink := SinkConfig{URL: broker.URL, Encoding: EncodingStructured, Tracing: true, PerVM: true}
+		meta := EventMeta{
+			Subject:     "cluster01",
+			TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			TraceState:  "vendor=value",
+		}
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+		data := eventResponseData{
+			AnnotationRecord: AnnotationRecord{WorkflowID: "test", Event: &e},
+			VirtualMachines:  []vimtypes.ManagedObjectReference{vm1, vm2},
+			Drain:            []DrainResult{{VM: vm1, Drained: true}, {VM: vm2, Error: "timeout"}},
+		}
+		_, err = env.ExecuteActivity(c.SendPreemptedEvent, "test", sink, data, meta)
+		s.Require().NoError(err)
+
+		mu.Lock()
+		defer mu.Unlock()
+		s.Require().Len(received, 2)
+		for i, vm := range []vimtypes.ManagedObjectReference{vm1, vm2} {
+			got := received[i]
+			s.Equal("test-1-"+vm.Value, got.ID())
+			s.Equal(vm.Value, got.Subject())
+			s.Contains(contentTypes[i], "application/cloudevents+json")
+
+			tp := got.Extensions()["traceparent"].(string)
+			s.True(validTraceParent(tp))
+			s.True(strings.HasPrefix(tp, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+			s.NotEqual(meta.TraceParent, tp, "event must be a child span")
+			s.Equal("vendor=value", got.Extensions()["tracestate"])
+
+			var d eventResponseData
+			s.Require().NoError(got.DataAs(&d))
+			s.Equal([]vimtypes.ManagedObjectReference{vm}, d.VirtualMachines)
+			s.Len(d.Drain, 1)
+			s.Equal(vm, d.Drain[0].VM)
+		}
+	})
+
+	s.T().Run("upserts search attributes after run if set on workflow start", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		start := env.Now()
+
+		err := env.SetSearchAttributesOnStart(map[string]interface{}{
+			SearchAttributeTag:            "test-preemption",
+			SearchAttributeCriticality:    string(CriticalityHigh),
+			SearchAttributeVCenter:        "vcenter.test",
+			SearchAttributePreemptedCount: 0,
+		})
+		s.NoError(err)
+
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				VCenter:     "vcenter.test",
+				Criticality: CriticalityHigh,
+				Event:       e,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		// workflow.GetVersion change markers
+		env.OnUpsertSearchAttributes(map[string]interface{}{
+			"TemporalChangeVersion": []string{changeVetoHook + "-1"},
+		}).Return(nil).Once()
+		env.OnUpsertSearchAttributes(map[string]interface{}{
+			"TemporalChangeVersion": []string{changeVMEvents + "-1", changeVetoHook + "-1"},
+		}).Return(nil).Once()
+
+		env.OnUpsertSearchAttributes(map[string]interface{}{
+			SearchAttributeTag:            "test-preemption",
+			SearchAttributeCriticality:    string(CriticalityHigh),
+			SearchAttributeVCenter:        "vcenter.test",
+			SearchAttributePreemptedCount: 1,
+			SearchAttributeLastPreemption: start.Add(time.Minute).UTC(),
+		}).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("sends event after preemption", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		logger := zaptest.NewLogger(s.T())
+
+		const broker = "https://test-broker.local"
+
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				ReplyTo:     broker,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		ceMock, recvCh := test.NewMockSenderClient(t, 2)
+		c := Client{
+			ceclient: ceMock,
+			clock:    clock.NewMock(),
+		}
+		env.RegisterActivity(&c)
+
+		// mock everything
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Once()
+
+		var (
+			expected int32 = 2 // preempted and completed event
+			received int32
+			seen     []string
+			wg       sync.WaitGroup
+		)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&received) < expected {
+				select {
+				case <-ctx.Done():
+					s.FailNow("context cancelled before receiving events")
+				case e := <-recvCh:
+					logger.Debug("received event", zap.String("event", e.String()))
+					seen = append(seen, e.Type())
+					atomic.AddInt32(&received, 1)
+				}
+			}
+		}()
+
+		err := setEnvVars()
+		s.NoError(err, "set environment variables")
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		wg.Wait()
+		s.Equal(expected, atomic.LoadInt32(&received), "receiving cloud events")
+		s.Equal([]string{eventType, completedEventType}, seen)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("ADMIT request preempts additional VM when target does not fit and links victims", func(t *testing.T) {
+		target := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-100"}
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+		vm3 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-3"}
+
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AdmissionRequestedEvent")
+			e.SetSource("https://ops.test")
+
+			req := WorkflowRequest{
+				Type:            RequestTypeAdmit,
+				Tag:             "test-preemption",
+				Criticality:     CriticalityHigh,
+				Event:           e,
+				Target:          &target,
+				AdmissionBudget: 2,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		plan := admissionPlan{
+			Cluster:  "cluster-01",
+			Required: capacity{MemoryMB: 4096, CpuMHz: 2000},
+			Deficit:  capacity{MemoryMB: 2048, CpuMHz: 1000},
+			Candidates: []admissionCandidate{
+				{Ref: vm1, Capacity: capacity{MemoryMB: 2048, CpuMHz: 2000}},
+				{Ref: vm2, Capacity: capacity{MemoryMB: 1024, CpuMHz: 1000}},
+				{Ref: vm3, Capacity: capacity{MemoryMB: 1024, CpuMHz: 1000}},
+			},
+		}
+
+		env.OnActivity("GetAdmissionPlan", any, admissionQuery{Scope: Scope{Tag: "test-preemption"}, Target: target}).Return(&plan, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, mock.MatchedBy(func(data VetoRequest) bool {
+			// veto hook receives all VMs within budget
+			return len(data.VirtualMachines) == 2
+		})).Return(nil, nil).Once()
+
+		// first victim does not release enough capacity
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference{vm1}, true).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("PowerOnVM", any, target).Return(temporal.NewNonRetryableApplicationError("power on vm", errInsufficientCapacity, nil)).Once()
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference{vm2}, true).Return([]vimtypes.ManagedObjectReference{vm2}, nil).Once()
+		env.OnActivity("PowerOnVM", any, target).Return(nil).Once()
+
+		env.OnActivity("AnnotateVms", any, []vimtypes.ManagedObjectReference{vm1, vm2}, mock.MatchedBy(func(data AnnotationRecord) bool {
+			return data.AdmittedVM != nil && *data.AdmittedVM == target
+		}), any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, []vimtypes.ManagedObjectReference{vm1, vm2}, mock.MatchedBy(func(e VMEvent) bool {
+			return e.Reason == "admission of virtual machine vm-100" && e.Criticality == CriticalityHigh
+		})).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(RequestTypeAdmit, res.Type)
+		s.Require().NotNil(res.Admission)
+		s.True(res.Admission.Admitted)
+		s.Equal(target, res.Admission.Target)
+		s.Equal("cluster-01", res.Admission.Cluster)
+		s.Equal([]vimtypes.ManagedObjectReference{vm1, vm2}, res.Admission.Victims)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("ADMIT request fails when admission budget is exhausted", func(t *testing.T) {
+		target := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-100"}
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AdmissionRequestedEvent")
+			e.SetSource("https://ops.test")
+
+			req := WorkflowRequest{
+				Type:            RequestTypeAdmit,
+				Tag:             "test-preemption",
+				Criticality:     CriticalityHigh,
+				Event:           e,
+				Target:          &target,
+				AdmissionBudget: 1,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		plan := admissionPlan{
+			Cluster:  "cluster-01",
+			Required: capacity{MemoryMB: 4096, CpuMHz: 2000},
+			Deficit:  capacity{MemoryMB: 1024, CpuMHz: 1000},
+			Candidates: []admissionCandidate{
+				{Ref: vm1, Capacity: capacity{MemoryMB: 2048, CpuMHz: 2000}},
+				{Ref: vm2, Capacity: capacity{MemoryMB: 1024, CpuMHz: 1000}},
+			},
+		}
+
+		env.OnActivity("GetAdmissionPlan", any, any).Return(&plan, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference{vm1}, true).Return([]vimtypes.ManagedObjectReference{vm1}, nil).Once()
+		env.OnActivity("PowerOnVM", any, target).Return(temporal.NewNonRetryableApplicationError("power on vm", errInsufficientCapacity, nil)).Once()
+
+		// victims are annotated although admission failed
+		env.OnActivity("AnnotateVms", any, []vimtypes.ManagedObjectReference{vm1}, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(ErrorCodeCapacity, res.Error.Code)
+		s.Equal(stepPowerOnVM, res.Error.Step)
+		s.Require().NotNil(res.Admission)
+		s.False(res.Admission.Admitted)
+		s.Equal([]vimtypes.ManagedObjectReference{vm1}, res.Admission.Victims)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("ADMIT request calls veto hook before preempting VMs when plan has no deficit", func(t *testing.T) {
+		target := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-100"}
+		vm1 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"}
+		vm2 := vimtypes.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}
+
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AdmissionRequestedEvent")
+			e.SetSource("https://ops.test")
+
+			req := WorkflowRequest{
+				Type:        RequestTypeAdmit,
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Target:      &target,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		// e.g. HA admission control reserves capacity not seen by the plan
+		plan := admissionPlan{
+			Cluster:  "cluster-01",
+			Required: capacity{MemoryMB: 4096, CpuMHz: 2000},
+			Candidates: []admissionCandidate{
+				{Ref: vm1, Capacity: capacity{MemoryMB: 2048, CpuMHz: 2000}},
+				{Ref: vm2, Capacity: capacity{MemoryMB: 1024, CpuMHz: 1000}},
+			},
+		}
+
+		env.OnActivity("GetAdmissionPlan", any, any).Return(&plan, nil).Once()
+		env.OnActivity("PowerOnVM", any, target).Return(temporal.NewNonRetryableApplicationError("power on vm", errInsufficientCapacity, nil)).Once()
+		env.OnActivity("CallVetoHook", any, any, mock.MatchedBy(func(data VetoRequest) bool {
+			return len(data.VirtualMachines) == 2
+		})).Return(&VetoResponse{Veto: true, Reason: "batch jobs must finish"}, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Never()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSkipped, res.Status)
+		s.Equal(skipReasonVetoed, res.SkipReason)
+		s.Require().NotNil(res.Admission)
+		s.False(res.Admission.Admitted)
+		s.Empty(res.Admission.Victims)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("EVACUATE request reports progress and enters maintenance mode after preemption", func(t *testing.T) {
+		const host = "esx01.test.local"
+
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("EvacuationRequestedEvent")
+			e.SetSource("https://ops.test")
+
+			req := WorkflowRequest{
+				Type:            RequestTypeEvacuate,
+				Tag:             "test-preemption",
+				Host:            host,
+				MaintenanceMode: true,
+				Criticality:     CriticalityMedium,
+				Event:           e,
+				RequestedBy:     "alice",
+				ApprovalTimeout: time.Minute * 5,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		// query progress while waiting for approval
+		var phase RunPhase
+		env.RegisterDelayedCallback(func() {
+			val, err := env.QueryWorkflow(WorkFlowQueryType)
+			s.NoError(err)
+
+			var state string
+			s.NoError(val.Get(&state))
+
+			var progress struct {
+				Phase RunPhase `json:"phase"`
+			}
+			s.NoError(json.Unmarshal([]byte(state), &progress))
+			phase = progress.Phase
+
+			env.SignalWorkflow(ApprovalSignalChannel, ApprovalResponse{Decision: DecisionApprove, Approver: "bob"})
+		}, time.Minute*2)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, candidateQuery{Scope: Scope{Tag: "test-preemption"}, Host: host}).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("EnterMaintenanceMode", any, host).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+		s.Equal(RunPhaseAuthorizing, phase)
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(RunPhaseIdle, res.Phase)
+		s.Equal(host, res.Host)
+		s.Equal(vms, res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("datastore alarm scopes preemption to datastore and suspends VMs", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+			err := e.SetData(ce.ApplicationJSON, map[string]interface{}{
+				"Entity": map[string]interface{}{
+					"Name":   "ds01",
+					"Entity": vimtypes.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"},
+				},
+			})
+			s.NoError(err)
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Action:      ActionSuspend,
+				Event:       e,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, candidateQuery{Scope: Scope{Tag: "test-preemption"}, Datastore: "ds01"}).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, any, any).Never()
+		env.OnActivity("SuspendVMs", any, vms).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, mock.MatchedBy(func(data AnnotationRecord) bool {
+			return data.Suspended && !data.ForcedShutdown
+		}), any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal("ds01", res.Datastore)
+		s.Equal(vms, res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("records annotation result per VM and does not disable HA restart of VMs which were not annotated", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:              "test-preemption",
+				Criticality:      CriticalityHigh,
+				Event:            e,
+				DisableHARestart: true,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{
+			{Type: "VirtualMachine", Value: "vm-1"},
+			{Type: "VirtualMachine", Value: "vm-2"},
+		}
+		results := []AnnotationResult{
+			{VM: vms[0], Action: VMActionPreempted, Annotated: true},
+			{VM: vms[1], Action: VMActionPreempted, Error: "set custom field: connection reset"},
+		}
+
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, temporal.NewApplicationError("annotate 1 of 2 vms failed", errVSphere, results)).Times(3)
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("DisableHARestart", any, vms[:1]).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(stepAnnotateVms, res.Error.Step)
+		s.Equal(results, res.Annotations)
+		s.Equal(vms, res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("annotation failure policy FAIL fails run", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:                     "test-preemption",
+				Criticality:             CriticalityHigh,
+				Event:                   e,
+				AnnotationFailurePolicy: AnnotationFailRun,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, temporal.NewNonRetryableApplicationError("create custom field", errVSphere, nil)).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(stepAnnotateVms, res.Error.Step)
+		s.Equal(ErrorCodeVSphere, res.Error.Code)
+		s.Require().Len(res.Annotations, 1)
+		s.False(res.Annotations[0].Annotated)
+		s.Contains(res.Annotations[0].Error, "create custom field")
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("RESTORE request restores preempted VMs after HA restart was disabled", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:              "test-preemption",
+				Criticality:      CriticalityHigh,
+				Event:            e,
+				DisableHARestart: true,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("2")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Type:        RequestTypeRestore,
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute*2)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return([]AnnotationResult{{VM: vms[0], Action: VMActionPreempted, Annotated: true}}, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("DisableHARestart", any, vms).Return(nil).Once()
+		env.OnActivity("GetPreemptedVMs", any, candidateQuery{Scope: Scope{Tag: "test-preemption"}}).Return(vms, nil).Once()
+		env.OnActivity("RestoreVMs", any, vms, any, any).Return(vms, nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RequestTypeRestore, res.Type)
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(vms, res.Restored)
+		s.Empty(res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("marks run partially succeeded if HA restart was not disabled for all VMs", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:              "test-preemption",
+				Criticality:      CriticalityHigh,
+				Event:            e,
+				DisableHARestart: true,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+		annotated := []AnnotationResult{
+			{VM: vms[0], Action: VMActionPreempted, Annotated: true},
+			{VM: vms[1], Action: VMActionPreempted, Annotated: true},
+		}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(annotated, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("DisableHARestart", any, vms).Return(temporal.NewApplicationError("disable ha restart for 1 of 2 vms failed", errVSphere, vms[1:])).Times(3)
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Require().NotNil(res.Error)
+		s.Equal(stepDisableHARestart, res.Error.Step)
+		s.Equal(vms, res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("enforcement re-preempts powered on VMs and records violations", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityLow,
+				Event:       e,
+				Enforcement: EnforcementRepreempt,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, false).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		// vm-2 powered on by a user, enforcement stops when watch fails
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(vms[1:], nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms[1:], true).Return(vms[1:], nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(nil, temporal.NewNonRetryableApplicationError("watch failed", errVSphere, nil)).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Require().Len(res.Violations, 1)
+		s.Equal(vms[1], res.Violations[0].VM)
+		s.True(res.Violations[0].Repreempted)
+		s.Empty(res.Enforced)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("enforcement records failed re-preemption and reports VM again", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Enforcement: EnforcementRepreempt,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		// re-preemption fails, the still powered on VM is reported by the
+		// restarted watch
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(vms, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(nil, nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(vms, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(nil, temporal.NewNonRetryableApplicationError("watch failed", errVSphere, nil)).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Require().Len(res.Violations, 2)
+		s.False(res.Violations[0].Repreempted)
+		s.Equal("virtual machine not stopped", res.Violations[0].Error)
+		s.True(res.Violations[1].Repreempted)
+		s.Empty(res.Violations[1].Error)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("enforcement does not report logged VMs again", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Enforcement: EnforcementLog,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		// the restarted watch skips the logged vm-1
+		var none []vimtypes.ManagedObjectReference
+		env.OnActivity("WaitForPowerOn", any, vms, none).Return(vms[:1], nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, vms[:1]).Return(vms[1:], nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, vms).Return(nil, temporal.NewNonRetryableApplicationError("watch failed", errVSphere, nil)).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Require().Len(res.Violations, 2)
+		s.Equal(vms[0], res.Violations[0].VM)
+		s.Equal(vms[1], res.Violations[1].VM)
+		s.False(res.Violations[0].Repreempted)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("continues as new after handled signals and restores carried state", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		sink := SinkConfig{URL: "stdout://", Retry: &SinkRetry{MaxAttempts: 1}}
+
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("AlarmStatusChangedEvent")
+		e.SetSource("https://vcenter.test/sdk")
+
+		req := WorkflowRequest{
+			Tag:         "test-preemption",
+			Criticality: CriticalityHigh,
+			Event:       e,
+			Sinks:       []SinkConfig{sink},
+			Enforcement: EnforcementLog,
+		}
+
+		env.RegisterDelayedCallback(func() {
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}, {Type: "VirtualMachine", Value: "vm-2"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("SendStartedEvent", any, any, sink, any, any).Return(errors.New("stdout closed")).Once()
+		env.OnActivity("SendPreemptedEvent", any, any, sink, any, any).Return(errors.New("stdout closed")).Once()
+		env.OnActivity("SendCompletedEvent", any, any, sink, any, any).Return(errors.New("stdout closed")).Once()
+
+		// vm-1 is powered on, then every enforcement interval passes without
+		// power on until the workflow continues as new
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(vms[:1], nil).Once()
+		env.OnActivity("WaitForPowerOn", any, vms, any).Return(nil, nil)
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		var canErr *workflow.ContinueAsNewError
+		s.Require().True(errors.As(env.GetWorkflowError(), &canErr))
+
+		var state WorkflowState
+		s.NoError(converter.GetDefaultDataConverter().FromPayloads(canErr.Input, &state))
+		s.False(state.LastRun.IsZero())
+		s.Equal([]eventKey{{Source: "https://vcenter.test/sdk", ID: "1"}}, state.SeenEvents)
+		s.Len(state.PendingEvents, 3)
+		s.Equal(3, state.EventSeq)
+		s.Equal(EnforcementLog, state.Enforcement)
+		s.Equal(vms, state.Enforced)
+		s.Equal(vms[:1], state.Logged)
+		s.Len(state.Violations, 1)
+
+		// the next run handles the retried request event carried over as
+		// duplicate, keeps watching and redelivers the pending events
+		state.Requests = []WorkflowRequest{req}
+
+		env = s.NewTestWorkflowEnvironment()
+		env.SetStartTime(state.LastRun.Add(time.Minute * 2))
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		env.RegisterActivity(c)
+		env.OnActivity("WaitForPowerOn", any, vms, vms[:1]).Return(nil, temporal.NewNonRetryableApplicationError("watch failed", errVSphere, nil)).Once()
+		env.OnActivity("SendStartedEvent", any, any, sink, any, any).Return(nil).Once()
+		env.OnActivity("SendPreemptedEvent", any, any, sink, any, any).Return(nil).Once()
+		env.OnActivity("SendCompletedEvent", any, any, sink, any, any).Return(nil).Once()
+		env.OnActivity("SendSkippedEvent", any, any, sink, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, &state)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(state.LastRun.UTC(), res.LastPreemption.UTC())
+		s.Equal(1, res.DuplicateEvents)
+		s.Equal(skipReasonDuplicate, res.SkipReason)
+		s.Len(res.Violations, 1)
+		s.Equal(0, res.PendingEvents)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("requests and applies DRS recommendations after preemption", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Rebalance:   RebalanceApply,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		recommendations := []DRSRecommendation{{
+			Cluster: "cluster-1",
+			Key:     "1",
+			Rating:  3,
+			Reason:  "Balance average CPU loads.",
+			Actions: []string{"migrate vm-2 from host-1 to host-2"},
+			Applied: true,
+		}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+		env.OnActivity("RebalanceClusters", any, vms, true).Return(recommendations, nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(recommendations, res.Rebalance)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("migrates preemptible VMs to overflow cluster and preempts VMs which cannot be migrated", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		target := MigrationTarget{Cluster: "overflow", Timeout: time.Minute}
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Migrate:     &target,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{
+			{Type: "VirtualMachine", Value: "vm-1"},
+			{Type: "VirtualMachine", Value: "vm-2"},
+		}
+		migrated := []Migration{{VM: vms[0], Cluster: "overflow", Host: "esx-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("MigrateVMs", any, vms, target).Return(migrated, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms[1:], true).Return(vms[1:], nil).Once()
+		env.OnActivity("AnnotateVms", any, vms[1:], mock.MatchedBy(func(a AnnotationRecord) bool {
+			return a.Preempted && a.Action == VMActionPreempted
+		}), any).Return(nil, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms[:1], mock.MatchedBy(func(a AnnotationRecord) bool {
+			return !a.Preempted && a.Action == VMActionMigrated && a.MigratedTo == "overflow"
+		}), any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(vms[1:], res.VirtualMachines)
+		s.Equal(migrated, res.Migrated)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("preempts only VMs not migrated if migration fails after migrating VMs", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Migrate:     &MigrationTarget{Cluster: "overflow"},
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{
+			{Type: "VirtualMachine", Value: "vm-1"},
+			{Type: "VirtualMachine", Value: "vm-2"},
+		}
+		migrateErr := temporal.NewNonRetryableApplicationError("retrieve vm resource demand", errVSphere, nil, vms[:1])
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("MigrateVMs", any, vms, any).Return(nil, migrateErr).Once()
+		env.OnActivity("PowerOffVMs", any, vms[1:], true).Return(vms[1:], nil).Once()
+		env.OnActivity("AnnotateVms", any, vms[1:], any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(stepMigrateVMs, res.Error.Step)
+		s.Equal(vms[1:], res.VirtualMachines)
+		s.Equal([]Migration{{VM: vms[0], Cluster: "overflow"}}, res.Migrated)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("preempts all VMs if migration fails", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Migrate:     &MigrationTarget{Cluster: "overflow"},
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		migrateErr := temporal.NewNonRetryableApplicationError("cluster \"overflow\" not found", errVSphere, nil)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("MigrateVMs", any, vms, any).Return(nil, migrateErr).Once()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(stepMigrateVMs, res.Error.Step)
+		s.Equal(vms, res.VirtualMachines)
+		s.Empty(res.Migrated)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("drains preemptible VMs and skips VMs which failed to drain", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		settings := DrainSettings{Command: "app-drain", Timeout: time.Minute}
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityLow,
+				Event:       e,
+				Drain:       &settings,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{
+			{Type: "VirtualMachine", Value: "vm-1"},
+			{Type: "VirtualMachine", Value: "vm-2"},
+		}
+		results := []DrainResult{
+			{VM: vms[0], Drained: true},
+			{VM: vms[1], ExitCode: 1, Error: "drain command exited with exit code 1"},
+		}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("DrainVMs", any, vms, settings).Return(results, nil).Once()
+		env.OnActivity("PowerOffVMs", any, vms[:1], false).Return(vms[:1], nil).Once()
+		env.OnActivity("AnnotateVms", any, vms[:1], any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Equal(vms[:1], res.VirtualMachines)
+		s.Equal(results, res.Drain)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("marks run partially succeeded if no VM was drained with failure policy SKIP", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityLow,
+				Event:       e,
+				Drain:       &DrainSettings{Command: "app-drain"},
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		results := []DrainResult{{VM: vms[0], Error: "drain command did not exit within 5m0s"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("DrainVMs", any, vms, any).Return(results, nil).Once()
+		env.OnActivity("PowerOffVMs", any, []vimtypes.ManagedObjectReference(nil), false).Return(nil, nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Require().NotNil(res.Error)
+		s.Equal(stepDrainVMs, res.Error.Step)
+		s.Empty(res.VirtualMachines)
+		s.Equal(results, res.Drain)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("preempts all VMs if drain fails with failure policy FORCE", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityLow,
+				Event:       e,
+				Drain:       &DrainSettings{Command: "app-drain", FailurePolicy: DrainFailForce},
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		drainErr := temporal.NewNonRetryableApplicationError("read guest username from secret", errInternal, nil)
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("DrainVMs", any, vms, any).Return(nil, drainErr).Once()
+		env.OnActivity("PowerOffVMs", any, vms, false).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusPartiallySucceeded, res.Status)
+		s.Equal(stepDrainVMs, res.Error.Step)
+		s.Equal(vms, res.VirtualMachines)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("does not drain VMs which are powered off forcefully", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			req := WorkflowRequest{
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+				Drain:       &DrainSettings{Command: "app-drain"},
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		vms := []vimtypes.ManagedObjectReference{{Type: "VirtualMachine", Value: "vm-1"}}
+		env.OnActivity("GetPreemptibleVMs", any, any).Return(vms, nil).Once()
+		env.OnActivity("CallVetoHook", any, any, any).Return(nil, nil).Once()
+		env.OnActivity("DrainVMs", any, any, any).Never()
+		env.OnActivity("PowerOffVMs", any, vms, true).Return(vms, nil).Once()
+		env.OnActivity("AnnotateVms", any, vms, any, any).Return(nil, nil).Once()
+		env.OnActivity("PostVMEvents", any, any, any).Return(nil).Once()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusSucceeded, res.Status)
+		s.Empty(res.Drain)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("fails run for invalid request without executing activities", func(t *testing.T) {
+		env := s.NewTestWorkflowEnvironment()
+		env.RegisterDelayedCallback(func() {
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("EvacuationRequestedEvent")
+			e.SetSource("https://ops.test")
+
+			req := WorkflowRequest{
+				Type:        RequestTypeEvacuate,
+				Tag:         "test-preemption",
+				Criticality: CriticalityHigh,
+				Event:       e,
+			}
+			env.SignalWorkflow(SignalChannel, req)
+		}, time.Minute)
+
+		env.RegisterDelayedCallback(func() {
+			env.CancelWorkflow()
+		}, time.Minute*10)
+
+		var c *Client
+		env.RegisterActivity(c)
+
+		env.OnActivity("GetPreemptibleVMs", any, any).Never()
+		env.OnActivity("EnterMaintenanceMode", any, any).Never()
+
+		env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+		s.True(env.IsWorkflowCompleted())
+		s.NoError(env.GetWorkflowError())
+
+		var res WorkflowResponse
+		s.NoError(env.GetWorkflowResult(&res))
+		s.Equal(RunStatusFailed, res.Status)
+		s.Equal(stepValidateRequest, res.Error.Step)
+		s.Equal(ErrorCodeInternal, res.Error.Code)
+
+		env.AssertExpectations(t)
+	})
+
+	s.T().Run("e2e: retry GetPreemptibleVMs activity due to non-existing tag", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			rcRT := rc.Client.Client.Transport
+			logger := zaptest.NewLogger(t)
+
+			fakeRT := fakeRoundTripper{
+				rt:       rcRT,
+				Logger:   logger,
+				callsMap: make(map[string]int),
+			}
+			rc.Client.Client.Transport = &fakeRT
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         "does-not-exist",
+					Criticality: CriticalityHigh,
+					Event:       e,
+					ReplyTo:     "",
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+
+			// assert never called
+			env.OnActivity("PowerOffVMs", any, any, any).Return(nil, nil).Never()
+
+			// assert never called
+			env.OnActivity("AnnotateVms", any, any, any, any).Return(nil, nil).Never()
+
+			// assert never called
+			env.OnActivity("SendPreemptedEvent", any, any, any, any, any).Return(nil).Never()
+
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			// expect three retried VAPI ListTag calls from GetPreemptibleVMs activity
+			s.Equal(3, fakeRT.callsMap[getTag])
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusFailed, res.Status)
+			s.Equal(ErrorCodeVSphere, res.Error.Code)
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: power off two preemptible VM", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			const wantVms = 4
+			if len(vms) != wantVms {
+				s.FailNowf("received unexpected number of virtual machines", "want=%d got=%d", wantVms, len(vms))
+			}
+
+			for _, vm := range vms {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+				if state != vimtypes.VirtualMachinePowerStatePoweredOn {
+					s.FailNowf("expected vm to be powered on", "vm: %q", vm.Reference().String())
+				}
+			}
+
+			tagVms := []mo.Reference{vms[0], vms[1]}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         tagName,
+					Criticality: CriticalityHigh,
+					Event:       e,
+					ReplyTo:     "",
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			// retrieve updated vm states
+			vms, err = getAllVms(ctx, client)
+			s.NoError(err)
+
+			// first two vms should be preempted and annotated
+			for _, vm := range vms[:2] {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOff, state)
+			}
+
+			// other vms should not be preempted
+			for _, vm := range vms[2:] {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOn, state)
+			}
+
+			// first two vms should have annotation
+			var objs []mo.ManagedEntity
+			refs := []vimtypes.ManagedObjectReference{vms[0].Reference(), vms[1].Reference()}
+			err = property.DefaultCollector(client).Retrieve(ctx, refs, []string{"customValue"}, &objs)
+			s.NoError(err)
+
+			fm, err := object.GetCustomFieldsManager(client)
+			s.NoError(err)
+
+			keyID, err := fm.FindKey(ctx, DefaultAnnotationKey)
+			s.NoError(err)
+
+			var found bool
+			for _, obj := range objs {
+				for _, cv := range obj.CustomValue {
+					val := cv.(*vimtypes.CustomFieldStringValue)
+					if val.Key != keyID {
+						continue
+					}
+
+					found = true
+					s.NotEqual("", val.Value)
+
+				}
+			}
+			s.Equal(true, found, "custom field %q value not found", DefaultAnnotationKey)
+
+			// first two vms should have a vcenter user event
+			em := event.NewManager(client)
+			for _, vm := range vms[:2] {
+				events, err := em.QueryEvents(ctx, vimtypes.EventFilterSpec{
+					Entity: &vimtypes.EventFilterSpecByEntity{
+						Entity:    vm.Reference(),
+						Recursion: vimtypes.EventFilterSpecRecursionOptionSelf,
+					},
+					EventTypeId: []string{"GeneralUserEvent"},
+				})
+				s.NoError(err)
+				s.Require().Len(events, 1)
+				s.Contains(events[0].GetEvent().FullFormattedMessage, "criticality HIGH")
+				s.Contains(events[0].GetEvent().FullFormattedMessage, "AlarmStatusChangedEvent event 1")
+			}
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: get preemptible VMs ignores powered off VMs", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{Name: tagName, CategoryID: cID})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, []mo.Reference{vms[0], vms[1], vms[2]})
+			s.NoError(err)
+
+			// e.g. preempted in an earlier run
+			task, err := vms[1].PowerOff(ctx)
+			s.NoError(err)
+			s.NoError(task.Wait(ctx))
+
+			env := s.NewTestActivityEnvironment()
+			env.RegisterActivity(&c)
+
+			val, err := env.ExecuteActivity(c.GetPreemptibleVMs, candidateQuery{Scope: Scope{Tag: tagName}})
+			s.Require().NoError(err)
+
+			var refs []vimtypes.ManagedObjectReference
+			s.NoError(val.Get(&refs))
+			s.ElementsMatch([]vimtypes.ManagedObjectReference{vms[0].Reference(), vms[2].Reference()}, refs)
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: set cluster of VMs or VM as event subject", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{vcclient: client, clock: clock.NewMock()}
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			var all, clustered []vimtypes.ManagedObjectReference
+			for _, vm := range vms {
+				all = append(all, vm.Reference())
+				if strings.HasPrefix(vm.Name(), "DC0_C0") {
+					clustered = append(clustered, vm.Reference())
+				}
+			}
+			s.Require().Len(clustered, 2)
+
+			s.Equal("DC0_C0", c.withSubject(ctx, EventMeta{}, clustered).Subject)
+			s.Empty(c.withSubject(ctx, EventMeta{}, all).Subject, "vms do not share a cluster")
+			s.Equal("cluster01", c.withSubject(ctx, EventMeta{Subject: "cluster01"}, all).Subject, "keeps cluster of request")
+			s.Equal(all[0].Value, c.withSubject(ctx, EventMeta{Subject: "cluster01"}, all[:1]).Subject)
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: power off preemptible VMs in requested cluster only", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			// tag all vms
+			var tagVms []mo.Reference
+			for _, vm := range vms {
+				tagVms = append(tagVms, vm)
+			}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			const cluster = "DC0_C0"
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         tagName,
+					Cluster:     cluster,
+					Criticality: CriticalityHigh,
+					Event:       e,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			// only vms in cluster should be powered off
+			vms, err = getAllVms(ctx, client)
+			s.NoError(err)
+
+			var preempted int
+			for _, vm := range vms {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+
+				want := vimtypes.VirtualMachinePowerStatePoweredOn
+				if strings.HasPrefix(vm.Name(), cluster) {
+					want = vimtypes.VirtualMachinePowerStatePoweredOff
+					preempted++
+				}
+				s.Equal(want, state, "vm %q", vm.Name())
+			}
+			s.Equal(2, preempted)
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Len(res.VirtualMachines, 2)
+			s.Equal(cluster, res.Cluster)
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: admit powered off VM in cluster", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			var (
+				target *object.VirtualMachine
+				tagVms []mo.Reference
+			)
+			for _, vm := range vms {
+				if vm.Name() == "DC0_C0_RP0_VM0" {
+					target = vm
+					continue
+				}
+				tagVms = append(tagVms, vm)
+			}
+			s.Require().NotNil(target)
+
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			task, err := target.PowerOff(ctx)
+			s.NoError(err)
+			s.NoError(task.Wait(ctx))
+
+			// simulator cluster has sufficient capacity for the target
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+			query := admissionQuery{Scope: Scope{Tag: tagName}, Target: target.Reference()}
+			val, err := actEnv.ExecuteActivity(c.GetAdmissionPlan, query)
+			s.Require().NoError(err)
+
+			var plan admissionPlan
+			s.NoError(val.Get(&plan))
+			s.Equal("DC0_C0", plan.Cluster)
+			s.False(plan.PoweredOn)
+			s.Equal(capacity{}, plan.Deficit)
+			s.Len(plan.Candidates, 1) // other vm in cluster
+
+			ref := target.Reference()
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AdmissionRequestedEvent")
+				e.SetSource("https://ops.test")
+
+				req := WorkflowRequest{
+					Type:        RequestTypeAdmit,
+					Tag:         tagName,
+					Criticality: CriticalityHigh,
+					Event:       e,
+					Target:      &ref,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			state, err := target.PowerState(ctx)
+			s.NoError(err)
+			s.Equal(vimtypes.VirtualMachinePowerStatePoweredOn, state)
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusSucceeded, res.Status)
+			s.Require().NotNil(res.Admission)
+			s.True(res.Admission.Admitted)
+			s.Empty(res.Admission.Victims)
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: evacuate host and enter maintenance mode", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			// tag all vms
+			var tagVms []mo.Reference
+			for _, vm := range vms {
+				tagVms = append(tagVms, vm)
+			}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			// evacuate host of the first vm
+			host, err := vms[0].HostSystem(ctx)
+			s.NoError(err)
+			hostName, err := host.ObjectName(ctx)
+			s.NoError(err)
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("EvacuationRequestedEvent")
+				e.SetSource("https://ops.test")
+
+				req := WorkflowRequest{
+					Type:            RequestTypeEvacuate,
+					Tag:             tagName,
+					Host:            hostName,
+					MaintenanceMode: true,
+					Criticality:     CriticalityHigh,
+					Event:           e,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			// only vms on host should be powered off
+			var preempted int
+			for _, vm := range vms {
+				vmHost, err := vm.HostSystem(ctx)
 				s.NoError(err)
-				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOff, state)
+
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+
+				want := vimtypes.VirtualMachinePowerStatePoweredOn
+				if vmHost.Reference() == host.Reference() {
+					want = vimtypes.VirtualMachinePowerStatePoweredOff
+					preempted++
+				}
+				s.Equal(want, state, "vm %q", vm.Name())
+			}
+			s.NotZero(preempted)
+
+			var hs mo.HostSystem
+			err = property.DefaultCollector(client).RetrieveOne(ctx, host.Reference(), []string{"runtime.inMaintenanceMode"}, &hs)
+			s.NoError(err)
+			s.True(hs.Runtime.InMaintenanceMode)
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusSucceeded, res.Status)
+			s.Len(res.VirtualMachines, preempted)
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+	s.T().Run("e2e: suspend preemptible VMs on requested datastore", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			// tag all vms
+			var tagVms []mo.Reference
+			for _, vm := range vms {
+				tagVms = append(tagVms, vm)
+			}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			// simulator vms are placed on the local datastore
+			ds, err := find.NewFinder(client).Datastore(ctx, "LocalDS_0")
+			s.NoError(err)
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         tagName,
+					Datastore:   ds.Name(),
+					Criticality: CriticalityHigh,
+					Action:      ActionSuspend,
+					Event:       e,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			for _, vm := range vms {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+				s.Equal(vimtypes.VirtualMachinePowerStateSuspended, state, "vm %q", vm.Name())
+			}
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusSucceeded, res.Status)
+			s.Equal(ds.Name(), res.Datastore)
+			s.Len(res.VirtualMachines, len(vms))
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: disable HA restart of preempted VMs, mark them and restore them", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			// tag all vms
+			var tagVms []mo.Reference
+			for _, vm := range vms {
+				tagVms = append(tagVms, vm)
+			}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			const markerCategory = "preemption-markers"
+			_, err = c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            markerCategory,
+				Description:     "preemption markers",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "MULTIPLE",
+			})
+			s.NoError(err)
+
+			const cluster = "DC0_C0"
+			ccr, err := find.NewFinder(client).ClusterComputeResource(ctx, cluster)
+			s.NoError(err)
+
+			// vm with existing ha override
+			var clusterVMs []*object.VirtualMachine
+			for _, vm := range vms {
+				if strings.HasPrefix(vm.Name(), cluster) {
+					clusterVMs = append(clusterVMs, vm)
+				}
 			}
+			s.Len(clusterVMs, 2)
+
+			override := &vimtypes.ClusterDasVmSettings{RestartPriority: string(vimtypes.ClusterDasVmSettingsRestartPriorityHigh)}
+			s.NoError(c.setDasVmSettings(ctx, ccr.Reference(), clusterVMs[0].Reference(), override))
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:              tagName,
+					Cluster:          cluster,
+					Criticality:      CriticalityHigh,
+					Event:            e,
+					DisableHARestart: true,
+					MarkerCategory:   markerCategory,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				// ha restart disabled while preempted
+				for _, vm := range clusterVMs {
+					settings, err := c.dasVmSettings(ctx, ccr.Reference(), vm.Reference())
+					s.NoError(err)
+					s.Equal(string(vimtypes.ClusterDasVmSettingsRestartPriorityDisabled), settings.RestartPriority, "vm %q", vm.Name())
+				}
+
+				// preempted vms marked
+				tag, err := c.tagManager.GetTagForCategory(ctx, PreemptedTag, markerCategory)
+				s.Require().NoError(err)
+				marked, err := c.tagManager.ListAttachedObjects(ctx, tag.ID)
+				s.NoError(err)
+				s.Len(marked, len(clusterVMs))
+
+				e := ce.NewEvent()
+				e.SetID("2")
+				e.SetType("PreemptionRestoreEvent")
+				e.SetSource("https://ops.test")
+
+				req := WorkflowRequest{
+					Type:           RequestTypeRestore,
+					Tag:            tagName,
+					Cluster:        cluster,
+					Event:          e,
+					MarkerCategory: markerCategory,
+				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute*2)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
 
-			// other vms should not be preempted
-			for _, vm := range vms[2:] {
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			// previous ha settings restored and vms powered on
+			settings, err := c.dasVmSettings(ctx, ccr.Reference(), clusterVMs[0].Reference())
+			s.NoError(err)
+			s.Equal(override.RestartPriority, settings.RestartPriority)
+
+			settings, err = c.dasVmSettings(ctx, ccr.Reference(), clusterVMs[1].Reference())
+			s.NoError(err)
+			s.Nil(settings)
+
+			om, err := object.GetCustomFieldsManager(client)
+			s.NoError(err)
+			key, err := om.FindKey(ctx, DefaultAnnotationKey)
+			s.NoError(err)
+
+			for _, vm := range clusterVMs {
 				state, err := vm.PowerState(ctx)
 				s.NoError(err)
-				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOn, state)
+				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOn, state, "vm %q", vm.Name())
+
+				// preemption and restore recorded in annotation history
+				a, err := c.getAnnotation(ctx, key, vm.Reference())
+				s.NoError(err)
+				s.Len(a.Records, 2, "vm %q", vm.Name())
+				s.Equal(VMActionPreempted, a.Records[0].Action)
+				s.NotNil(a.Records[0].HARestart)
+				s.Equal(VMActionRestored, a.Latest().Action)
+				s.False(a.Preempted())
 			}
 
-			// first two vms should have annotation
-			var objs []mo.ManagedEntity
+			tag, err := c.tagManager.GetTagForCategory(ctx, PreemptedTag, markerCategory)
+			s.NoError(err)
+			marked, err := c.tagManager.ListAttachedObjects(ctx, tag.ID)
+			s.NoError(err)
+			s.Empty(marked)
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusSucceeded, res.Status)
+			s.Len(res.Restored, 2)
+
+			env.AssertExpectations(t)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: annotate VMs skips VMs annotated in previous attempt and reports failed VMs", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{
+				vcclient: client,
+				clock:    clock.NewMock(),
+			}
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			refs := []vimtypes.ManagedObjectReference{vms[0].Reference(), vms[1].Reference(), vms[2].Reference()}
+
+			om, err := object.GetCustomFieldsManager(client)
+			s.NoError(err)
+			def, err := om.Add(ctx, DefaultAnnotationKey, "VirtualMachine", nil, nil)
+			s.NoError(err)
+
+			// written by a newer release
+			err = om.Set(ctx, refs[1], def.Key, `{"version":99,"records":[]}`)
+			s.NoError(err)
+
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+			actEnv.SetHeartbeatDetails(refs[:1])
+
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, refs, AnnotationRecord{Action: VMActionPreempted, Preempted: true, Event: &e}, "")
+			s.Require().Error(err)
+
+			var appErr *temporal.ApplicationError
+			s.Require().True(errors.As(err, &appErr))
+			s.False(appErr.NonRetryable())
+
+			var results []AnnotationResult
+			s.Require().NoError(appErr.Details(&results))
+			s.Require().Len(results, 3)
+			s.True(results[0].Annotated)
+			s.False(results[1].Annotated)
+			s.Contains(results[1].Error, "unsupported annotation version")
+			s.True(results[2].Annotated)
+
+			// annotated in previous attempt
+			a, err := c.getAnnotation(ctx, def.Key, refs[0])
+			s.NoError(err)
+			s.Empty(a.Records)
+
+			a, err = c.getAnnotation(ctx, def.Key, refs[2])
+			s.NoError(err)
+			s.Len(a.Records, 1)
+			s.True(a.Preempted())
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: disable HA restart reports VMs without preempted annotation", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{
+				vcclient: client,
+				clock:    clock.NewMock(),
+			}
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
 			refs := []vimtypes.ManagedObjectReference{vms[0].Reference(), vms[1].Reference()}
-			err = property.DefaultCollector(client).Retrieve(ctx, refs, []string{"customValue"}, &objs)
+
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			// only refs[0] is annotated as preempted
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, refs[:1], AnnotationRecord{Action: VMActionPreempted, Preempted: true, Event: &e}, "")
+			s.Require().NoError(err)
+
+			_, err = actEnv.ExecuteActivity(c.DisableHARestart, refs)
+			s.Require().Error(err)
+
+			var appErr *temporal.ApplicationError
+			s.Require().True(errors.As(err, &appErr))
+			s.Equal(errVSphere, appErr.Type())
+			s.Contains(appErr.Error(), "1 of 2 vms failed")
+
+			var failed []vimtypes.ManagedObjectReference
+			s.Require().NoError(appErr.Details(&failed))
+			s.Equal(refs[1:], failed)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: annotate VMs using configured annotation key and fields", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			const key = "corp.preemption"
+			c := Client{
+				vcclient:         client,
+				clock:            clock.NewMock(),
+				annotationKey:    key,
+				annotationFields: []string{"time", "workflowID"},
+			}
+
+			vms, err := getAllVms(ctx, client)
 			s.NoError(err)
+			refs := []vimtypes.ManagedObjectReference{vms[0].Reference()}
 
-			fm, err := object.GetCustomFieldsManager(client)
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+
+			record := AnnotationRecord{Action: VMActionPreempted, Preempted: true, Tag: "preemptible", WorkflowID: "wf-1", Event: &e}
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, refs, record, "")
+			s.Require().NoError(err)
+
+			om, err := object.GetCustomFieldsManager(client)
+			s.NoError(err)
+
+			_, err = om.FindKey(ctx, DefaultAnnotationKey)
+			s.Error(err, "default custom field must not be created")
+
+			keyID, err := om.FindKey(ctx, key)
+			s.Require().NoError(err)
+
+			a, err := c.getAnnotation(ctx, keyID, refs[0])
 			s.NoError(err)
+			s.Require().Len(a.Records, 1)
+			s.True(a.Preempted())
+			s.Equal("wf-1", a.Latest().WorkflowID)
+			s.Empty(a.Latest().Tag)
+			s.Nil(a.Latest().Event)
+
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: wait for power on of preempted VM", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{
+				vcclient: client,
+				clock:    clock.NewMock(),
+			}
 
-			keyID, err := fm.FindKey(ctx, customField)
+			vms, err := getAllVms(ctx, client)
 			s.NoError(err)
 
-			var found bool
-			for _, obj := range objs {
-				for _, cv := range obj.CustomValue {
-					val := cv.(*vimtypes.CustomFieldStringValue)
-					if val.Key != keyID {
-						continue
-					}
+			vm := vms[0]
+			refs := []vimtypes.ManagedObjectReference{vm.Reference()}
 
-					found = true
-					s.NotEqual("", val.Value)
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, refs, AnnotationRecord{Preempted: true, Event: &e}, "")
+			s.Require().NoError(err)
+
+			task, err := vm.PowerOff(ctx)
+			s.NoError(err)
+			s.NoError(task.Wait(ctx))
+
+			type result struct {
+				refs []vimtypes.ManagedObjectReference
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				val, err := actEnv.ExecuteActivity(c.WaitForPowerOn, refs, nil)
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+
+				var poweredOn []vimtypes.ManagedObjectReference
+				err = val.Get(&poweredOn)
+				done <- result{refs: poweredOn, err: err}
+			}()
 
+			// power cycle until the watch observed the power on
+			for i := 0; i < 20; i++ {
+				time.Sleep(time.Millisecond * 100)
+
+				task, err = vm.PowerOn(ctx)
+				s.NoError(err)
+				s.NoError(task.Wait(ctx))
+
+				select {
+				case res := <-done:
+					s.NoError(res.err)
+					s.Equal(refs, res.refs)
+					return nil
+				case <-time.After(time.Millisecond * 100):
+				}
+
+				task, err = vm.PowerOff(ctx)
+				s.NoError(err)
+				s.NoError(task.Wait(ctx))
+			}
+
+			s.Fail("power on of preempted vm not observed")
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: wait for power on reports preempted VM powered on before watch", func(t *testing.T) {
+		simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{
+				vcclient: client,
+				clock:    clock.NewMock(),
+			}
+
+			vms, err := getAllVms(ctx, client)
+			s.NoError(err)
+
+			actEnv := s.NewTestActivityEnvironment()
+			actEnv.RegisterActivity(&c)
+
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("AlarmStatusChangedEvent")
+			e.SetSource("https://vcenter.test/sdk")
+
+			// vms are powered on, the graceful shutdown of vms[1] may still be
+			// in progress
+			forced := []vimtypes.ManagedObjectReference{vms[0].Reference()}
+			graceful := []vimtypes.ManagedObjectReference{vms[1].Reference()}
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, forced, AnnotationRecord{Preempted: true, ForcedShutdown: true, Event: &e}, "")
+			s.Require().NoError(err)
+			_, err = actEnv.ExecuteActivity(c.AnnotateVms, graceful, AnnotationRecord{Preempted: true, Event: &e}, "")
+			s.Require().NoError(err)
+
+			val, err := actEnv.ExecuteActivity(c.WaitForPowerOn, append(forced, graceful...), nil)
+			s.Require().NoError(err)
+
+			var poweredOn []vimtypes.ManagedObjectReference
+			s.NoError(val.Get(&poweredOn))
+			s.Equal(forced, poweredOn)
+			return nil
+		})
+	})
+
+	s.T().Run("e2e: migrate preemptible VMs to overflow cluster", func(t *testing.T) {
+		model := simulator.VPX()
+		model.Cluster = 2
+		defer model.Remove()
+
+		err := model.Run(func(ctx context.Context, client *vim25.Client) error {
+			rc := rest.NewClient(client)
+			err := rc.Login(ctx, simulator.DefaultLogin)
+			s.NoError(err)
+
+			c := Client{
+				vcclient:   client,
+				clock:      clock.NewMock(),
+				tagManager: tags.NewManager(rc),
+			}
+
+			cID, err := c.tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "test-category",
+				Description:     "test category",
+				AssociableTypes: []string{"VirtualMachine"},
+				Cardinality:     "SINGLE",
+			})
+			s.NoError(err)
+
+			const tagName = "preemptible"
+			_, err = c.tagManager.CreateTag(ctx, &tags.Tag{
+				Name:        tagName,
+				Description: "test tag",
+				CategoryID:  cID,
+			})
+			s.NoError(err)
+
+			const (
+				cluster  = "DC0_C0"
+				overflow = "DC0_C1"
+			)
+
+			vms, err := find.NewFinder(client).VirtualMachineList(ctx, "/DC0/vm/"+cluster+"*")
+			s.NoError(err)
+			s.Len(vms, 2)
+
+			var tagVms []mo.Reference
+			for _, vm := range vms {
+				tagVms = append(tagVms, vm)
+			}
+			err = c.tagManager.AttachTagToMultipleObjects(ctx, tagName, tagVms)
+			s.NoError(err)
+
+			overflowCluster, err := c.findCluster(ctx, overflow)
+			s.NoError(err)
+
+			var ccr mo.ClusterComputeResource
+			err = overflowCluster.Properties(ctx, overflowCluster.Reference(), []string{"host"}, &ccr)
+			s.NoError(err)
+
+			env := s.NewTestWorkflowEnvironment()
+			env.RegisterDelayedCallback(func() {
+				e := ce.NewEvent()
+				e.SetID("1")
+				e.SetType("AlarmStatusChangedEvent")
+				e.SetSource("https://vcenter.test/sdk")
+
+				req := WorkflowRequest{
+					Tag:         tagName,
+					Cluster:     cluster,
+					Criticality: CriticalityHigh,
+					Event:       e,
+					Migrate:     &MigrationTarget{Cluster: overflow},
 				}
+				env.SignalWorkflow(SignalChannel, req)
+			}, time.Minute)
+
+			env.RegisterDelayedCallback(func() {
+				env.CancelWorkflow()
+			}, time.Minute*10)
+
+			env.RegisterActivity(&c)
+			env.ExecuteWorkflow(PreemptVMsWorkflow, nil)
+
+			s.True(env.IsWorkflowCompleted())
+			s.NoError(env.GetWorkflowError())
+
+			var res WorkflowResponse
+			s.NoError(env.GetWorkflowResult(&res))
+			s.Equal(RunStatusSucceeded, res.Status)
+			s.Empty(res.VirtualMachines)
+			s.Len(res.Migrated, len(vms))
+
+			for _, vm := range vms {
+				state, err := vm.PowerState(ctx)
+				s.NoError(err)
+				s.Equal(vimtypes.VirtualMachinePowerStatePoweredOn, state, "vm %q", vm.Name())
+
+				host, err := vm.HostSystem(ctx)
+				s.NoError(err)
+				s.Contains(ccr.Host, host.Reference(), "vm %q", vm.Name())
 			}
-			s.Equal(true, found, "custom field %q value not found", customField)
 
 			env.AssertExpectations(t)
 
 			return nil
 		})
+		s.NoError(err)
+	})
+
+	s.T().Run("e2e: migrate VMs skips VMs migrated in previous attempt and returns migrated VMs on failure", func(t *testing.T) {
+		model := simulator.VPX()
+		model.Cluster = 2
+		defer model.Remove()
+
+		err := model.Run(func(ctx context.Context, client *vim25.Client) error {
+			c := Client{
+				vcclient: client,
+				clock:    clock.NewMock(),
+			}
+
+			const (
+				cluster  = "DC0_C0"
+				overflow = "DC0_C1"
+			)
+
+			vms, err := find.NewFinder(client).VirtualMachineList(ctx, "/DC0/vm/"+cluster+"*")
+			s.NoError(err)
+			s.Require().Len(vms, 2)
+			refs := []vimtypes.ManagedObjectReference{vms[0].Reference(), vms[1].Reference()}
+
+			overflowCluster, err := c.findCluster(ctx, overflow)
+			s.NoError(err)
+			pool, err := overflowCluster.ResourcePool(ctx)
+			s.NoError(err)
+
+			var ccr mo.ClusterComputeResource
+			err = overflowCluster.Properties(ctx, overflowCluster.Reference(), []string{"host"}, &ccr)
+			s.NoError(err)
+
+			// migrated in previous attempt
+			err = c.migrateVm(ctx, refs[0], pool.Reference(), ccr.Host[0], time.Minute)
+			s.NoError(err)
+
+			var h mo.HostSystem
+			err = object.NewHostSystem(client, ccr.Host[0]).Properties(ctx, ccr.Host[0], []string{"name"}, &h)
+			s.NoError(err)
+
+			t.Run("fails with migrated VMs as details", func(t *testing.T) {
+				actEnv := s.NewTestActivityEnvironment()
+				actEnv.RegisterActivity(&c)
+				actEnv.SetHeartbeatDetails(refs[:1])
+
+				_, err = actEnv.ExecuteActivity(c.MigrateVMs, refs, MigrationTarget{Cluster: overflow, HostGroup: "does-not-exist"})
+				s.Require().Error(err)
+
+				var appErr *temporal.ApplicationError
+				s.Require().True(errors.As(err, &appErr))
+				s.True(appErr.NonRetryable())
+
+				var migrated []vimtypes.ManagedObjectReference
+				s.Require().NoError(appErr.Details(&migrated))
+				s.Equal(refs[:1], migrated)
+			})
+
+			t.Run("migrates remaining VMs", func(t *testing.T) {
+				actEnv := s.NewTestActivityEnvironment()
+				actEnv.RegisterActivity(&c)
+				actEnv.SetHeartbeatDetails(refs[:1])
+
+				val, err := actEnv.ExecuteActivity(c.MigrateVMs, refs, MigrationTarget{Cluster: overflow})
+				s.Require().NoError(err)
+
+				var migrations []Migration
+				s.NoError(val.Get(&migrations))
+				s.Require().Len(migrations, 2)
+				s.Equal(Migration{VM: refs[0], Cluster: overflow, Host: h.Name}, migrations[0])
+				s.Equal(refs[1], migrations[1].VM)
+				s.NotEmpty(migrations[1].Host)
+
+				host, err := vms[1].HostSystem(ctx)
+				s.NoError(err)
+				s.Contains(ccr.Host, host.Reference())
+			})
+
+			return nil
+		})
+		s.NoError(err)
 	})
 }
 